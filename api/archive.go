@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"predictor/archive"
+	"time"
+)
+
+// The maximum time range of an archive query, to bound the size of the response.
+const maxArchiveRange = 31 * 24 * time.Hour
+
+// Interface to other packages.
+var readArchive = archive.Read // func ref
+
+// Handle an archive query, e.g. /archive?thing=96_22&from=...&to=...
+// The time range defaults to the last day.
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	thingName := r.URL.Query().Get("thing")
+	if thingName == "" {
+		writeError(w, http.StatusBadRequest, "missing thing parameter")
+		return
+	}
+	if !archive.IsValidThingName(thingName) {
+		writeError(w, http.StatusBadRequest, "invalid thing parameter")
+		return
+	}
+	to, err := parseTimeParam(r, "to", now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid to parameter, expected RFC3339")
+		return
+	}
+	from, err := parseTimeParam(r, "from", to.AddDate(0, 0, -1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid from parameter, expected RFC3339")
+		return
+	}
+	if to.Before(from) {
+		writeError(w, http.StatusBadRequest, "to must not be before from")
+		return
+	}
+	if to.Sub(from) > maxArchiveRange {
+		writeError(w, http.StatusBadRequest, "time range must not exceed 31 days")
+		return
+	}
+	entries, err := readArchive(thingName, from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
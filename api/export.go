@@ -0,0 +1,79 @@
+package api
+
+import (
+	"net/http"
+	"predictor/archive"
+	"predictor/export"
+	"predictor/log"
+	"strings"
+)
+
+// Interface to other packages.
+var writeExport = export.Write // func ref
+
+// Handle an export query, e.g. /export?things=96_22&program=3&from=...&to=...&variant=cycles&format=csv
+// The time range defaults to the last day. The things or the crossing must be given,
+// since exporting all things reads every history and archive file.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("things") == "" && query.Get("crossing") == "" {
+		writeError(w, http.StatusBadRequest, "missing things or crossing parameter")
+		return
+	}
+	variant, format := query.Get("variant"), query.Get("format")
+	if variant == "" {
+		variant = export.VariantCycles
+	}
+	if format == "" {
+		format = export.FormatCSV
+	}
+	if err := export.Validate(variant, format); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	program, err := export.ParseProgram(query.Get("program"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := parseTimeParam(r, "to", now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid to parameter, expected RFC3339")
+		return
+	}
+	from, err := parseTimeParam(r, "from", to.AddDate(0, 0, -1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid from parameter, expected RFC3339")
+		return
+	}
+	if to.Before(from) || to.Sub(from) > maxArchiveRange {
+		writeError(w, http.StatusBadRequest, "time range must be positive and not exceed 31 days")
+		return
+	}
+	filter := export.Filter{Crossing: query.Get("crossing"), Program: program, From: from, To: to}
+	if things := query.Get("things"); things != "" {
+		filter.Things = strings.Split(things, ",")
+	}
+	for _, thingName := range filter.Things {
+		if !archive.IsValidThingName(thingName) {
+			writeError(w, http.StatusBadRequest, "invalid things parameter")
+			return
+		}
+	}
+
+	if format == export.FormatNDJSON {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/csv")
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\"export-"+variant+"."+format+"\"")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	// Errors can only be logged, since the rows are streamed into the response.
+	if _, err := writeExport(w, filter, variant, format); err != nil {
+		log.Error.Println("Could not write export:", err)
+	}
+}
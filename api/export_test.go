@@ -0,0 +1,32 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"predictor/export"
+	"testing"
+)
+
+func TestHandleExport(t *testing.T) {
+	writeExport = func(w io.Writer, filter export.Filter, variant string, format string) (int, error) {
+		return 0, nil
+	}
+	defer func() { writeExport = export.Write }()
+
+	cases := map[string]int{
+		"/export?things=96_22":            http.StatusOK,
+		"/export?crossing=96":             http.StatusOK,
+		"/export":                         http.StatusBadRequest,
+		"/export?things=96_22&format=xml": http.StatusBadRequest,
+		"/export?things=96_22,../../x":    http.StatusBadRequest,
+	}
+	for url, status := range cases {
+		recorder := httptest.NewRecorder()
+		newMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+		if recorder.Code != status {
+			t.Errorf("unexpected status code for %s: %d", url, recorder.Code)
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"net/http"
+	"predictor/histories"
+	"strings"
+)
+
+// Interface to other packages.
+var loadHistory = histories.LoadHistory // func ref
+
+// Handle a history query, e.g. /history/96_22-P3.json
+// This serves the histories to the cycle analyzer, regardless of the store backend.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	key := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/history/"), ".json")
+	if key == "" || strings.Contains(key, "/") {
+		writeError(w, http.StatusBadRequest, "invalid history name")
+		return
+	}
+	history, err := loadHistory(key)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "no history found: "+key)
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
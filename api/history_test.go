@@ -0,0 +1,32 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"predictor/histories"
+	"testing"
+)
+
+func TestHandleHistory(t *testing.T) {
+	loadHistory = func(key string) (histories.History, error) {
+		if key != "96_22-P3" {
+			return histories.History{}, fmt.Errorf("no history found")
+		}
+		return histories.History{Cycles: []histories.HistoryCycle{{}}}, nil
+	}
+
+	cases := map[string]int{
+		"/history/96_22-P3.json": http.StatusOK,
+		"/history/96_22.json":    http.StatusNotFound,
+		"/history/":              http.StatusBadRequest,
+	}
+	for url, status := range cases {
+		recorder := httptest.NewRecorder()
+		newMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+		if recorder.Code != status {
+			t.Errorf("unexpected status code for %s: %d", url, recorder.Code)
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"predictor/export"
+	"predictor/histories"
+	"strconv"
+)
+
+// The default and maximum number of index entries in a response.
+const (
+	defaultIndexLimit = 100
+	maxIndexLimit     = 1000
+)
+
+// A page of the history index.
+type IndexResponse struct {
+	// The number of entries that match the filters.
+	Total   int                    `json:"total"`
+	Offset  int                    `json:"offset"`
+	Limit   int                    `json:"limit"`
+	Entries []histories.IndexEntry `json:"entries"`
+}
+
+// Interface to other packages.
+var queryHistoryIndex = histories.QueryHistoryIndex // func ref
+
+// Parse an optional non-negative integer query parameter.
+func parseIntParam(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return parsed, nil
+}
+
+// Handle a history index query, e.g. /index?crossing=96&program=3&detector=car&sort=discardRate&order=desc&offset=0&limit=100
+// The entries are sorted by their file by default.
+func handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	query := r.URL.Query()
+	program, err := export.ParseProgram(query.Get("program"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	minCycles, err := parseIntParam(r, "minCycles", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid minCycles parameter")
+		return
+	}
+	offset, err := parseIntParam(r, "offset", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid offset parameter")
+		return
+	}
+	limit, err := parseIntParam(r, "limit", defaultIndexLimit)
+	if err != nil || limit == 0 || limit > maxIndexLimit {
+		writeError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+		return
+	}
+	order := query.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		writeError(w, http.StatusBadRequest, "order must be asc or desc")
+		return
+	}
+	entries, total, err := queryHistoryIndex(histories.IndexQuery{
+		Thing:         query.Get("thing"),
+		Crossing:      query.Get("crossing"),
+		Program:       program,
+		Detector:      query.Get("detector"),
+		MinCycleCount: minCycles,
+		Sort:          query.Get("sort"),
+		Descending:    order == "desc",
+		Offset:        offset,
+		Limit:         limit,
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, IndexResponse{Total: total, Offset: offset, Limit: limit, Entries: entries})
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"predictor/histories"
+	"testing"
+)
+
+func TestHandleIndex(t *testing.T) {
+	var lastQuery histories.IndexQuery
+	queryHistoryIndex = func(q histories.IndexQuery) ([]histories.IndexEntry, int, error) {
+		lastQuery = q
+		return []histories.IndexEntry{{File: "96_22-P3.json"}}, 1, nil
+	}
+
+	cases := map[string]int{
+		"/index": http.StatusOK,
+		"/index?crossing=96&program=3&order=desc":     http.StatusOK,
+		"/index?program=abc":                          http.StatusBadRequest,
+		"/index?limit=0":                              http.StatusBadRequest,
+		"/index?limit=5000":                           http.StatusBadRequest,
+		"/index?offset=-1":                            http.StatusBadRequest,
+		"/index?order=random":                         http.StatusBadRequest,
+		"/index?minCycles=3&sort=discardRate&limit=5": http.StatusOK,
+	}
+	for url, status := range cases {
+		recorder := httptest.NewRecorder()
+		newMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+		if recorder.Code != status {
+			t.Errorf("unexpected status code for %s: %d", url, recorder.Code)
+			t.FailNow()
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	newMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/index?crossing=96&program=3&order=desc", nil))
+	if lastQuery.Crossing != "96" || lastQuery.Program == nil || *lastQuery.Program != 3 || !lastQuery.Descending || lastQuery.Limit != 100 {
+		t.Errorf("unexpected query: %+v", lastQuery)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"predictor/env"
+	"predictor/log"
+)
+
+// Register the handlers of the HTTP API.
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/timeline", handleTimeline)
+	mux.HandleFunc("/history/", handleHistory)
+	mux.HandleFunc("/index", handleIndex)
+	mux.HandleFunc("/archive", handleArchive)
+	mux.HandleFunc("/export", handleExport)
+	return mux
+}
+
+// Serve the HTTP API on the configured address.
+// This blocks until the server fails, so it should be run in a goroutine.
+func Serve() {
+	if env.ApiAddress == "" {
+		log.Info.Println("HTTP API is disabled.")
+		return
+	}
+	log.Info.Println("Serving HTTP API on", env.ApiAddress)
+	if err := http.ListenAndServe(env.ApiAddress, newMux()); err != nil {
+		log.Error.Println("HTTP API stopped:", err)
+	}
+}
+
+// Write a JSON response.
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Warning.Println("Could not write HTTP response:", err)
+	}
+}
+
+// Write a JSON error response.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"predictor/env"
+	"predictor/observations"
+	"time"
+)
+
+// The response of a timeline query.
+type TimelineResponse struct {
+	Thing        string                     `json:"thing"`
+	Layer        string                     `json:"layer"`
+	From         time.Time                  `json:"from"`
+	To           time.Time                  `json:"to"`
+	Observations []observations.Observation `json:"observations"`
+}
+
+// Interfaces to other packages.
+var (
+	getTimeline = observations.GetTimeline // func ref
+	now         = time.Now                 // func ref
+)
+
+// Parse an optional RFC3339 time from the query, or return the fallback.
+func parseTimeParam(r *http.Request, name string, fallback time.Time) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Handle a timeline query, e.g. /timeline?thing=96_22&layer=primary_signal&from=...&to=...
+// The layer defaults to primary_signal, the time range defaults to the whole timeline window.
+func handleTimeline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	thingName := r.URL.Query().Get("thing")
+	if thingName == "" {
+		writeError(w, http.StatusBadRequest, "missing thing parameter")
+		return
+	}
+	layerName := r.URL.Query().Get("layer")
+	if layerName == "" {
+		layerName = "primary_signal"
+	}
+	to, err := parseTimeParam(r, "to", now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid to parameter, expected RFC3339")
+		return
+	}
+	from, err := parseTimeParam(r, "from", to.Add(-env.TimelineWindow))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid from parameter, expected RFC3339")
+		return
+	}
+	if to.Before(from) {
+		writeError(w, http.StatusBadRequest, "to must not be before from")
+		return
+	}
+	timeline, err := getTimeline(thingName, layerName, from, to)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, TimelineResponse{
+		Thing:        thingName,
+		Layer:        layerName,
+		From:         from,
+		To:           to,
+		Observations: timeline,
+	})
+}
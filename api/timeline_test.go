@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"predictor/observations"
+	"testing"
+	"time"
+)
+
+func TestHandleTimeline(t *testing.T) {
+	var gotFrom, gotTo time.Time
+	getTimeline = func(thingName string, layerName string, from time.Time, to time.Time) ([]observations.Observation, error) {
+		if thingName != "96_22" || layerName != "primary_signal" {
+			return nil, fmt.Errorf("no timeline found for thing %s", thingName)
+		}
+		gotFrom, gotTo = from, to
+		return []observations.Observation{{PhenomenonTime: from, Result: 3}}, nil
+	}
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/timeline?thing=96_22&from=2022-10-10T14:02:00Z&to=2022-10-10T14:10:00Z", nil)
+	newMux().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("unexpected status code: %d", recorder.Code)
+		t.FailNow()
+	}
+	if !gotFrom.Equal(time.Date(2022, 10, 10, 14, 2, 0, 0, time.UTC)) || !gotTo.Equal(time.Date(2022, 10, 10, 14, 10, 0, 0, time.UTC)) {
+		t.Errorf("unexpected time range: %s - %s", gotFrom, gotTo)
+		t.FailNow()
+	}
+	var response TimelineResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Errorf("could not unmarshal response: %s", err)
+		t.FailNow()
+	}
+	if response.Layer != "primary_signal" || len(response.Observations) != 1 || response.Observations[0].Result != 3 {
+		t.Errorf("unexpected response: %+v", response)
+		t.FailNow()
+	}
+}
+
+func TestHandleTimelineErrors(t *testing.T) {
+	getTimeline = func(thingName string, layerName string, from time.Time, to time.Time) ([]observations.Observation, error) {
+		return nil, fmt.Errorf("no timeline found for thing %s", thingName)
+	}
+
+	cases := map[string]int{
+		"/timeline":                            http.StatusBadRequest,
+		"/timeline?thing=96_22&from=yesterday": http.StatusBadRequest,
+		"/timeline?thing=96_22&from=2022-10-10T14:10:00Z&to=2022-10-10T14:02:00Z": http.StatusBadRequest,
+		"/timeline?thing=unknown": http.StatusNotFound,
+	}
+	for url, status := range cases {
+		recorder := httptest.NewRecorder()
+		newMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+		if recorder.Code != status {
+			t.Errorf("unexpected status code for %s: %d", url, recorder.Code)
+			t.FailNow()
+		}
+	}
+}
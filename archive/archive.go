@@ -0,0 +1,297 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"predictor/deadletters"
+	"predictor/env"
+	"predictor/histories"
+	"predictor/log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The layout of the day directories in the archive.
+const dayLayout = "2006-01-02"
+
+// An archived cycle of a thing.
+type Entry struct {
+	// The name of the thing.
+	Thing string `json:"thing"`
+	// The completed cycle.
+	Cycle histories.HistoryCycle `json:"cycle"`
+}
+
+// The cycles of a thing that were not yet written to the archive.
+type buffer struct {
+	// The lock that must be used when accessing the entries.
+	lock sync.Mutex
+	// The pending entries, in the order in which they were added.
+	entries []Entry
+}
+
+// The pending cycles by their thing name.
+var buffers = &sync.Map{}
+
+// The maximum number of pending cycles per thing. While the archive can't be
+// written, e.g. since the disk is full, the oldest cycles are dropped instead
+// of filling up the memory. This covers about a day of 90-second cycles.
+var maxBufferedEntries = 1000
+
+// The number of cycles that were written to the archive.
+var CyclesArchived uint64 = 0
+
+// The number of cycles that could not be written to the archive.
+// Failed cycles are retried with the next flush, so they may be counted multiple times.
+var CyclesFailed uint64 = 0
+
+// The number of cycles that were dropped since too many cycles were pending.
+var CyclesDropped uint64 = 0
+
+// The lock that ensures that only one flush runs at a time.
+var flushLock = &sync.Mutex{}
+
+// Add a completed cycle to the archive.
+// The cycle is buffered and written with the next flush.
+func Add(thingName string, cycle histories.HistoryCycle) {
+	if env.ArchivePath == "" {
+		return
+	}
+	val, _ := buffers.LoadOrStore(thingName, &buffer{})
+	b := val.(*buffer)
+	b.lock.Lock()
+	b.entries = append(b.entries, Entry{Thing: thingName, Cycle: cycle})
+	dropped := b.trim()
+	b.lock.Unlock()
+	discard(dropped)
+}
+
+// Drop the oldest entries that exceed the maximum number of pending cycles.
+// The lock of the buffer must be held. Returns the dropped entries.
+func (b *buffer) trim() []Entry {
+	if len(b.entries) <= maxBufferedEntries {
+		return nil
+	}
+	excess := len(b.entries) - maxBufferedEntries
+	dropped := b.entries[:excess:excess]
+	b.entries = b.entries[excess:]
+	return dropped
+}
+
+// Count the dropped entries and keep them as dead letters.
+func discard(dropped []Entry) {
+	if len(dropped) == 0 {
+		return
+	}
+	atomic.AddUint64(&CyclesDropped, uint64(len(dropped)))
+	log.Warning.Printf("Dropped %d cycles of thing %s that could not be archived.", len(dropped), dropped[0].Thing)
+	for _, entry := range dropped {
+		deadletters.Add(deadletters.Letter{
+			Thing:    entry.Thing,
+			Stage:    deadletters.StageArchive,
+			Reason:   "too many cycles are pending for the archive",
+			Snapshot: entry.Cycle,
+		})
+	}
+}
+
+// Get the path of the archive file of a thing on a day.
+func filePath(thingName string, day string) string {
+	return fmt.Sprintf("%s/%s/%s.ndjson.gz", env.ArchivePath, day, thingName)
+}
+
+// Get the day of a cycle, by its start time in UTC.
+func dayOf(cycle histories.HistoryCycle) string {
+	return cycle.StartTime.UTC().Format(dayLayout)
+}
+
+// Write the pending cycles of all things to the archive.
+// Each flush appends a gzip member with one json line per cycle to the file of
+// the thing and day. Concatenated gzip members are read as a single stream.
+func Flush() {
+	flushLock.Lock()
+	defer flushLock.Unlock()
+	buffers.Range(func(key, value interface{}) bool {
+		thingName := key.(string)
+		b := value.(*buffer)
+		b.lock.Lock()
+		entries := b.entries
+		b.entries = nil
+		b.lock.Unlock()
+		if len(entries) == 0 {
+			return true
+		}
+		// Partition the entries by day, so that each day is rolled over into its own file.
+		byDay := map[string][]Entry{}
+		for _, entry := range entries {
+			day := dayOf(entry.Cycle)
+			byDay[day] = append(byDay[day], entry)
+		}
+		failed := []Entry{}
+		for day, dayEntries := range byDay {
+			if err := appendEntries(filePath(thingName, day), dayEntries); err != nil {
+				log.Error.Printf("Could not archive %d cycles of thing %s: %v", len(dayEntries), thingName, err)
+				atomic.AddUint64(&CyclesFailed, uint64(len(dayEntries)))
+				failed = append(failed, dayEntries...)
+				continue
+			}
+			atomic.AddUint64(&CyclesArchived, uint64(len(dayEntries)))
+		}
+		if len(failed) > 0 {
+			// Put the failed entries back in front of the new ones, so that they are retried with the next flush.
+			sort.SliceStable(failed, func(i, j int) bool {
+				return failed[i].Cycle.StartTime.Before(failed[j].Cycle.StartTime)
+			})
+			b.lock.Lock()
+			b.entries = append(failed, b.entries...)
+			dropped := b.trim()
+			b.lock.Unlock()
+			discard(dropped)
+		}
+		return true
+	})
+}
+
+// Append the entries as a compressed gzip member to an archive file.
+func appendEntries(path string, entries []Entry) error {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	if err := repairOnce(path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// The member is written at once, so that a crash can only cut off the last member.
+	// Such a member is removed by the repair before the next member is appended.
+	if _, err := file.Write(compressed.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// The archive files that were checked for a cut off member since the start.
+var repaired = &sync.Map{}
+
+// Remove a cut off member from the end of an archive file, before anything is appended to it.
+// Otherwise, the members appended after it could not be read anymore.
+// A member can only be cut off by a crash, so each file is only checked once after the start.
+func repairOnce(path string) error {
+	if _, ok := repaired.Load(path); ok {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if end := validEnd(data); end < len(data) {
+		log.Warning.Printf("Removing %d bytes of a cut off member from archive file %s", len(data)-end, path)
+		if err := os.Truncate(path, int64(end)); err != nil {
+			return err
+		}
+	}
+	repaired.Store(path, true)
+	return nil
+}
+
+// Get the length of the complete gzip members at the start of the data.
+func validEnd(data []byte) int {
+	// The reader is a byte reader, so the gzip reader doesn't read ahead of the current member.
+	reader := bytes.NewReader(data)
+	end := 0
+	for reader.Len() > 0 {
+		member, err := gzip.NewReader(reader)
+		if err != nil {
+			break
+		}
+		member.Multistream(false)
+		if _, err := io.Copy(io.Discard, member); err != nil {
+			break
+		}
+		end = len(data) - reader.Len()
+	}
+	return end
+}
+
+// Remove the days of the archive that are older than the retention.
+func applyRetention(now time.Time) {
+	if env.ArchiveRetention == 0 {
+		return
+	}
+	days, err := listDays()
+	if err != nil {
+		log.Error.Println("Could not list archive days:", err)
+		return
+	}
+	oldest := now.Add(-env.ArchiveRetention).UTC().Format(dayLayout)
+	for _, day := range days {
+		if day >= oldest {
+			break
+		}
+		dayPath := fmt.Sprintf("%s/%s", env.ArchivePath, day)
+		if err := os.RemoveAll(dayPath); err != nil {
+			log.Error.Println("Could not remove archive day:", err)
+			continue
+		}
+		repaired.Range(func(path, _ interface{}) bool {
+			if strings.HasPrefix(path.(string), dayPath+"/") {
+				repaired.Delete(path)
+			}
+			return true
+		})
+		log.Info.Println("Removed archive day", day, "after the retention period.")
+	}
+}
+
+// Get the days in the archive, sorted ascending.
+func listDays() ([]string, error) {
+	entries, err := os.ReadDir(env.ArchivePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	days := []string{}
+	for _, entry := range entries {
+		if _, err := time.Parse(dayLayout, entry.Name()); entry.IsDir() && err == nil {
+			days = append(days, entry.Name())
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// Flush the archive and apply the retention periodically.
+func RunPeriodically() {
+	if env.ArchivePath == "" {
+		return
+	}
+	for {
+		time.Sleep(60 * time.Second)
+		Flush()
+		applyRetention(time.Now())
+	}
+}
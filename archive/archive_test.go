@@ -0,0 +1,178 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"predictor/deadletters"
+	"predictor/env"
+	"predictor/histories"
+	"testing"
+	"time"
+)
+
+func makeCycle(start time.Time) histories.HistoryCycle {
+	return histories.HistoryCycle{
+		StartTime: start,
+		EndTime:   start.Add(90 * time.Second),
+		Phases:    []histories.HistoryPhaseEvent{{Time: start, Color: 3}},
+	}
+}
+
+func TestArchive(t *testing.T) {
+	env.ArchivePath = t.TempDir()
+	defer func() { env.ArchivePath = "" }()
+
+	day1 := time.Date(2023, 10, 2, 23, 58, 0, 0, time.UTC)
+	Add("1337_1", makeCycle(day1))
+	Flush()
+	// The second flush appends another gzip member and rolls over to the next day.
+	Add("1337_1", makeCycle(day1.Add(90*time.Second)))
+	Add("1337_1", makeCycle(day1.Add(180*time.Second)))
+	Add("1337_2", makeCycle(day1))
+	Flush()
+
+	if _, err := os.Stat(filePath("1337_1", "2023-10-03")); err != nil {
+		t.Errorf("cycle was not rolled over to the next day: %s", err)
+		t.FailNow()
+	}
+	entries, err := Read("1337_1", day1, day1.Add(time.Hour))
+	if err != nil || len(entries) != 3 {
+		t.Errorf("unexpected archived cycles: %v, %v", entries, err)
+		t.FailNow()
+	}
+	entries, _ = Read("1337_1", day1.Add(time.Minute), day1.Add(150*time.Second))
+	if len(entries) != 1 || !entries[0].Cycle.StartTime.Equal(day1.Add(90*time.Second)) {
+		t.Errorf("time range was not applied: %v", entries)
+		t.FailNow()
+	}
+}
+
+func TestArchiveTruncatedFile(t *testing.T) {
+	env.ArchivePath = t.TempDir()
+	defer func() { env.ArchivePath = "" }()
+
+	day := time.Date(2023, 10, 2, 12, 0, 0, 0, time.UTC)
+	Add("1337_1", makeCycle(day))
+	Flush()
+	// Simulate a crash while writing the second member.
+	file, _ := os.OpenFile(filePath("1337_1", "2023-10-02"), os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0x1f, 0x8b, 0x08, 0x00})
+	file.Close()
+
+	entries, err := Read("1337_1", day, day.Add(time.Hour))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("entries before the truncated member should be read: %v, %v", entries, err)
+		t.FailNow()
+	}
+}
+
+func TestArchiveAppendsAfterTruncatedMember(t *testing.T) {
+	env.ArchivePath = t.TempDir()
+	defer func() { env.ArchivePath = "" }()
+
+	day := time.Date(2023, 10, 2, 12, 0, 0, 0, time.UTC)
+	Add("1337_4", makeCycle(day))
+	Flush()
+	// Simulate a crash while writing the second member, and a restart.
+	file, _ := os.OpenFile(filePath("1337_4", "2023-10-02"), os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0x1f, 0x8b, 0x08, 0x00, 0x00})
+	file.Close()
+	repaired.Delete(filePath("1337_4", "2023-10-02"))
+
+	Add("1337_4", makeCycle(day.Add(90*time.Second)))
+	Flush()
+	entries, err := Read("1337_4", day, day.Add(time.Hour))
+	if err != nil || len(entries) != 2 {
+		t.Errorf("entries after the truncated member should be read: %v, %v", entries, err)
+		t.FailNow()
+	}
+}
+
+func TestRetention(t *testing.T) {
+	env.ArchivePath = t.TempDir()
+	env.ArchiveRetention = 48 * time.Hour
+	defer func() { env.ArchivePath, env.ArchiveRetention = "", 0 }()
+
+	for _, day := range []string{"2023-09-29", "2023-09-30", "2023-10-01", "2023-10-02"} {
+		os.MkdirAll(fmt.Sprintf("%s/%s", env.ArchivePath, day), os.ModePerm)
+	}
+	applyRetention(time.Date(2023, 10, 2, 12, 0, 0, 0, time.UTC))
+	days, _ := listDays()
+	if fmt.Sprint(days) != "[2023-09-30 2023-10-01 2023-10-02]" {
+		t.Errorf("unexpected days after retention: %v", days)
+		t.FailNow()
+	}
+}
+
+func TestArchiveRetriesFailedEntries(t *testing.T) {
+	env.ArchivePath = t.TempDir()
+	defer func() { env.ArchivePath = "" }()
+
+	day := time.Date(2023, 10, 2, 12, 0, 0, 0, time.UTC)
+	// A file in place of the day directory makes the write fail.
+	os.WriteFile(fmt.Sprintf("%s/2023-10-02", env.ArchivePath), []byte{}, 0644)
+	Add("1337_3", makeCycle(day))
+	Flush()
+	if _, err := Read("1337_3", day, day.Add(time.Hour)); err == nil {
+		t.Errorf("the archive should not be readable yet")
+		t.FailNow()
+	}
+
+	os.Remove(fmt.Sprintf("%s/2023-10-02", env.ArchivePath))
+	Add("1337_3", makeCycle(day.Add(90*time.Second)))
+	Flush()
+	entries, err := Read("1337_3", day, day.Add(time.Hour))
+	if err != nil || len(entries) != 2 || !entries[0].Cycle.StartTime.Equal(day) {
+		t.Errorf("failed entries were not retried in order: %v, %v", entries, err)
+		t.FailNow()
+	}
+}
+
+func TestReadRejectsPathTraversal(t *testing.T) {
+	env.ArchivePath = t.TempDir()
+	defer func() { env.ArchivePath = "" }()
+
+	for _, thingName := range []string{"../../x", "96_22/..", `..\x`, ""} {
+		if _, err := Read(thingName, time.Now().Add(-time.Hour), time.Now()); err == nil {
+			t.Errorf("expected thing name %q to be rejected", thingName)
+			t.FailNow()
+		}
+	}
+	if _, err := Read("96_22", time.Now().Add(-time.Hour), time.Now()); err != nil {
+		t.Errorf("unexpected error for a valid thing name: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestArchiveDropsOldestEntriesWhenFull(t *testing.T) {
+	env.ArchivePath = t.TempDir()
+	defer func() { env.ArchivePath = "" }()
+	maxBufferedEntries = 2
+	defer func() { maxBufferedEntries = 1000 }()
+	defer buffers.Delete("1337_4")
+
+	day := time.Date(2023, 10, 2, 12, 0, 0, 0, time.UTC)
+	// A file in place of the day directory makes the write fail.
+	os.WriteFile(fmt.Sprintf("%s/2023-10-02", env.ArchivePath), []byte{}, 0644)
+	dropped := CyclesDropped
+	for i := 0; i < 3; i++ {
+		Add("1337_4", makeCycle(day.Add(time.Duration(i)*90*time.Second)))
+		Flush()
+	}
+	if CyclesDropped != dropped+1 {
+		t.Errorf("expected the oldest cycle to be dropped, got %d", CyclesDropped-dropped)
+		t.FailNow()
+	}
+	if letters := deadletters.Get("1337_4"); len(letters) != 1 || letters[0].Stage != deadletters.StageArchive {
+		t.Errorf("dropped cycle was not dead-lettered: %v", letters)
+		t.FailNow()
+	}
+
+	os.Remove(fmt.Sprintf("%s/2023-10-02", env.ArchivePath))
+	Flush()
+	entries, err := Read("1337_4", day, day.Add(time.Hour))
+	if err != nil || len(entries) != 2 || !entries[0].Cycle.StartTime.Equal(day.Add(90*time.Second)) {
+		t.Errorf("the newest cycles should be archived: %v, %v", entries, err)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,77 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"predictor/env"
+	"predictor/log"
+	"strings"
+	"time"
+)
+
+// Check if a thing name can be used in the path of an archive file.
+// Names with path separators or `..` could read files outside the archive.
+func IsValidThingName(thingName string) bool {
+	return thingName != "" && !strings.ContainsAny(thingName, `/\`) && !strings.Contains(thingName, "..")
+}
+
+// Read the archived cycles of a thing that started in the time range [from, to].
+// The cycles are returned in the order in which they were archived.
+func Read(thingName string, from time.Time, to time.Time) ([]Entry, error) {
+	if env.ArchivePath == "" {
+		return nil, fmt.Errorf("the archive is disabled")
+	}
+	if !IsValidThingName(thingName) {
+		return nil, fmt.Errorf("invalid thing name: %q", thingName)
+	}
+	entries := []Entry{}
+	day := from.UTC().Truncate(24 * time.Hour)
+	for !day.After(to) {
+		dayEntries, err := readFile(filePath(thingName, day.Format(dayLayout)))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range dayEntries {
+			if entry.Cycle.StartTime.Before(from) || entry.Cycle.StartTime.After(to) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		day = day.Add(24 * time.Hour)
+	}
+	return entries, nil
+}
+
+// Read all entries of an archive file.
+// If the last gzip member was cut off by a crash, the entries before it are returned.
+// Such a member is removed before the next member is appended, see repairOnce.
+func readFile(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	entries := []Entry{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Warning.Printf("Skipping corrupt entry in archive file %s: %v", path, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Warning.Printf("Archive file %s is truncated: %v", path, err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,154 @@
+package backfill
+
+import (
+	"flag"
+	"fmt"
+	"predictor/histories"
+	"predictor/log"
+	"predictor/observations"
+	"predictor/things"
+	"sort"
+	"time"
+)
+
+// An observation from the archive, with the layer of its datastream.
+type archivedObservation struct {
+	layerName   string
+	observation observations.Observation
+}
+
+// The number of cycles after which the progress of a thing is saved,
+// so that an interrupted run doesn't append the same cycles again.
+var checkpointCycles = 50
+
+// Interfaces to overwrite for tests.
+var updateHistory = histories.UpdateHistory
+var flushHistories = histories.FlushHistories
+
+// Rebuild the history files from the observation archive of the SensorThings API.
+// The arguments are the command line flags of the `backfill` command.
+func Run(args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	hours := flags.Int("hours", 24, "The number of past hours to backfill.")
+	rate := flags.Float64("rate", 2, "The maximum number of requests per second.")
+	statePath := flags.String("state", "backfill-state.json", "The file in which the progress is stored.")
+	restart := flags.Bool("restart", false, "Ignore the progress of a previous run.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *hours <= 0 {
+		return fmt.Errorf("hours must be positive: %d", *hours)
+	}
+	if *rate <= 0 {
+		return fmt.Errorf("rate must be positive: %f", *rate)
+	}
+
+	// Resume the previous run, if there is one. The time range of the
+	// previous run is kept, so that already written cycles are skipped.
+	state, err := loadState(*statePath)
+	if err != nil || *restart {
+		until := time.Now()
+		state = newState(until.Add(-time.Duration(*hours)*time.Hour), until)
+	} else {
+		log.Info.Printf("Resuming backfill from %s to %s.", state.Since, state.Until)
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer ticker.Stop()
+
+	thingNames := []string{}
+	things.Things.Range(func(key, value interface{}) bool {
+		thingNames = append(thingNames, key.(string))
+		return true
+	})
+	sort.Strings(thingNames)
+
+	for i, thingName := range thingNames {
+		if state.Done[thingName] {
+			continue
+		}
+		val, _ := things.Things.Load(thingName)
+		written, err := backfillThing(val.(things.Thing), state, *statePath, ticker.C)
+		if err != nil {
+			// Save the progress so far, so that the run can be resumed.
+			saveDurably(state, *statePath)
+			return fmt.Errorf("could not backfill thing %s: %v", thingName, err)
+		}
+		state.Done[thingName] = true
+		if err := saveDurably(state, *statePath); err != nil {
+			return err
+		}
+		log.Info.Printf("Backfilled thing %s (%d/%d) with %d cycles.", thingName, i+1, len(thingNames), written)
+	}
+	log.Info.Println("Backfill finished.")
+	return nil
+}
+
+// Backfill the history of a single thing.
+// Returns the number of cycles that were written to the history.
+// The progress is saved periodically, after the written cycles are durable.
+func backfillThing(thing things.Thing, state *State, statePath string, limiter <-chan time.Time) (int, error) {
+	archived := []archivedObservation{}
+	for _, datastream := range thing.Datastreams {
+		layerName, ok := things.DatastreamMqttTopics.Load(datastream.MqttTopic())
+		if !ok {
+			continue
+		}
+		fetched, err := fetchObservations(datastream, state.Since, state.Until, limiter)
+		if err != nil {
+			return 0, err
+		}
+		for _, o := range fetched {
+			archived = append(archived, archivedObservation{layerName.(string), o})
+		}
+	}
+
+	// Replay the observations in the order they were observed, like they would arrive live.
+	sort.SliceStable(archived, func(i, j int) bool {
+		return archived[i].observation.PhenomenonTime.Before(archived[j].observation.PhenomenonTime)
+	})
+	written, processed := 0, 0
+	for _, a := range archived {
+		// The replay clock is the time of the observation itself,
+		// since the time when it was received is not archived.
+		o := a.observation
+		completed, err := observations.ReplayObservation(thing.Name, a.layerName, o, o.PhenomenonTime)
+		if err != nil || completed == nil {
+			continue
+		}
+		// Skip cycles that were already written in a previous run.
+		if !completed.EndTime.After(state.Progress[thing.Name]) {
+			continue
+		}
+		_, err = updateHistory(
+			thing.Name,
+			completed.StartTime, completed.EndTime,
+			completed.Layers["primary_signal"],
+			completed.Layers["signal_program"],
+			completed.Layers["cycle_second"],
+			completed.Layers["detector_car"],
+			completed.Layers["detector_bike"],
+		)
+		state.Progress[thing.Name] = completed.EndTime
+		if err == nil {
+			written++
+		}
+		processed++
+		if processed%checkpointCycles == 0 {
+			if err := saveDurably(state, statePath); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Save the state after the written histories are durable in the store.
+// With write-behind, the histories are only in the cache until they are flushed,
+// and the state must not mark cycles as written that would be lost on a crash.
+func saveDurably(state *State, path string) error {
+	if err := flushHistories(); err != nil {
+		return fmt.Errorf("could not flush histories: %v", err)
+	}
+	return state.save(path)
+}
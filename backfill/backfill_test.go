@@ -0,0 +1,258 @@
+package backfill
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"predictor/env"
+	"predictor/histories"
+	"predictor/observations"
+	"predictor/things"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serve the archived observations of a primary signal and a cycle second datastream.
+func mockArchive(t *testing.T, base time.Time) *httptest.Server {
+	primarySignal := []map[string]interface{}{}
+	cycleSecond := []map[string]interface{}{}
+	for i := 0; i < 4; i++ {
+		cycleStart := base.Add(time.Duration(i*60) * time.Second)
+		// The cycle second is delayed by a second, which must be snapped away.
+		cycleSecond = append(cycleSecond, map[string]interface{}{
+			"phenomenonTime": cycleStart.Add(time.Second).Format(time.RFC3339),
+			"result":         0,
+		})
+		primarySignal = append(primarySignal, map[string]interface{}{
+			"phenomenonTime": cycleStart.Add(2 * time.Second).Format(time.RFC3339),
+			"result":         3,
+		})
+		primarySignal = append(primarySignal, map[string]interface{}{
+			"phenomenonTime": cycleStart.Add(30 * time.Second).Format(time.RFC3339),
+			"result":         1,
+		})
+	}
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var value []map[string]interface{}
+		switch {
+		case strings.Contains(req.URL.Path, "Datastreams(1)"):
+			value = primarySignal
+		case strings.Contains(req.URL.Path, "Datastreams(2)"):
+			value = cycleSecond
+		default:
+			t.Errorf("unexpected request: %s", req.URL)
+		}
+		res.WriteHeader(200)
+		json.NewEncoder(res).Encode(map[string]interface{}{"value": value})
+	}))
+}
+
+// Register a mock thing with a primary signal and a cycle second datastream.
+func mockThing(name string) things.Thing {
+	thing := things.Thing{Name: name}
+	for id, layerName := range map[int]string{1: "primary_signal", 2: "cycle_second"} {
+		datastream := things.Datastream{IotId: id}
+		datastream.Properties.LayerName = layerName
+		thing.Datastreams = append(thing.Datastreams, datastream)
+		things.DatastreamMqttTopics.Store(datastream.MqttTopic(), layerName)
+	}
+	things.Things.Store(name, thing)
+	return thing
+}
+
+func TestBackfill(t *testing.T) {
+	base := time.Date(2024, 4, 30, 3, 0, 0, 0, time.UTC)
+	testServer := mockArchive(t, base)
+	defer testServer.Close()
+	env.SensorThingsBaseUrlObservations = fmt.Sprintf("%s/", testServer.URL)
+	env.CycleRaster = 5 * time.Second
+	mockThing("1337_1")
+
+	updated := []time.Time{}
+	updateHistory = func(
+		thingName string,
+		newCycleStartTime time.Time, newCycleEndTime time.Time,
+		_ observations.CycleSnapshot, _ observations.CycleSnapshot, _ observations.CycleSnapshot,
+		_ observations.CycleSnapshot, _ observations.CycleSnapshot,
+	) (histories.History, error) {
+		// Once the cycle model is learned, the boundaries move from the raster to the model.
+		if d := newCycleEndTime.Sub(newCycleStartTime); d < 59*time.Second || d > 61*time.Second {
+			t.Errorf("unexpected cycle: %s - %s", newCycleStartTime, newCycleEndTime)
+		}
+		updated = append(updated, newCycleEndTime)
+		return histories.History{}, nil
+	}
+
+	flushed := 0
+	flushHistories = func() error {
+		flushed++
+		return nil
+	}
+
+	statePath := t.TempDir() + "/state.json"
+	if err := Run([]string{"-state", statePath, "-rate", "1000"}); err != nil {
+		t.Errorf("backfill failed: %v", err)
+		t.FailNow()
+	}
+	if flushed == 0 {
+		t.Errorf("histories were not flushed before the state was saved")
+		t.FailNow()
+	}
+	// The first cycle second only marks the start of the first cycle.
+	if len(updated) != 3 {
+		t.Errorf("expected 3 cycles, got %d", len(updated))
+		t.FailNow()
+	}
+	if !updated[0].Equal(base.Add(60 * time.Second)) {
+		t.Errorf("cycle end time was not snapped: %s", updated[0])
+		t.FailNow()
+	}
+
+	state, err := loadState(statePath)
+	if err != nil {
+		t.Errorf("state could not be loaded: %v", err)
+		t.FailNow()
+	}
+	if !state.Done["1337_1"] || !state.Progress["1337_1"].Equal(updated[2]) {
+		t.Errorf("unexpected state: %v", state)
+		t.FailNow()
+	}
+}
+
+func TestBackfillSkipsWrittenCycles(t *testing.T) {
+	base := time.Date(2024, 4, 30, 3, 0, 0, 0, time.UTC)
+	testServer := mockArchive(t, base)
+	defer testServer.Close()
+	env.SensorThingsBaseUrlObservations = fmt.Sprintf("%s/", testServer.URL)
+	env.CycleRaster = 5 * time.Second
+	thing := mockThing("1337_2")
+
+	written := 0
+	updateHistory = func(
+		thingName string,
+		newCycleStartTime time.Time, newCycleEndTime time.Time,
+		_ observations.CycleSnapshot, _ observations.CycleSnapshot, _ observations.CycleSnapshot,
+		_ observations.CycleSnapshot, _ observations.CycleSnapshot,
+	) (histories.History, error) {
+		written++
+		return histories.History{}, nil
+	}
+
+	// Pretend that a previous run was interrupted after the second cycle.
+	state := newState(base, base.Add(time.Hour))
+	state.Progress[thing.Name] = base.Add(120 * time.Second)
+	limiter := make(chan time.Time)
+	close(limiter)
+	n, err := backfillThing(thing, state, t.TempDir()+"/state.json", limiter)
+	if err != nil {
+		t.Errorf("backfill failed: %v", err)
+		t.FailNow()
+	}
+	if n != 1 || written != 1 {
+		t.Errorf("expected only the last cycle to be written, got %d", n)
+		t.FailNow()
+	}
+}
+
+func TestBackfillSavesProgressDuringThing(t *testing.T) {
+	base := time.Date(2024, 4, 30, 3, 0, 0, 0, time.UTC)
+	testServer := mockArchive(t, base)
+	defer testServer.Close()
+	env.SensorThingsBaseUrlObservations = fmt.Sprintf("%s/", testServer.URL)
+	env.CycleRaster = 5 * time.Second
+	thing := mockThing("1337_4")
+	checkpointCycles = 1
+	defer func() { checkpointCycles = 50 }()
+	flushed := 0
+	flushHistories = func() error {
+		flushed++
+		return nil
+	}
+	defer func() { flushHistories = histories.FlushHistories }()
+
+	statePath := t.TempDir() + "/state.json"
+	updated := []time.Time{}
+	updateHistory = func(
+		thingName string,
+		newCycleStartTime time.Time, newCycleEndTime time.Time,
+		_ observations.CycleSnapshot, _ observations.CycleSnapshot, _ observations.CycleSnapshot,
+		_ observations.CycleSnapshot, _ observations.CycleSnapshot,
+	) (histories.History, error) {
+		// The progress of the previous cycle must already be saved, in case the run is killed now.
+		if len(updated) > 0 {
+			state, err := loadState(statePath)
+			if err != nil || !state.Progress[thingName].Equal(updated[len(updated)-1]) {
+				t.Errorf("progress was not saved before the next cycle: %v, %v", state, err)
+			}
+		}
+		updated = append(updated, newCycleEndTime)
+		return histories.History{}, nil
+	}
+
+	limiter := make(chan time.Time)
+	close(limiter)
+	state := newState(base, base.Add(time.Hour))
+	if _, err := backfillThing(thing, state, statePath, limiter); err != nil {
+		t.Errorf("backfill failed: %v", err)
+		t.FailNow()
+	}
+	if len(updated) != 3 || flushed != 3 {
+		t.Errorf("expected a flush for each of the 3 cycles, got %d flushes for %d cycles", flushed, len(updated))
+		t.FailNow()
+	}
+}
+
+func TestBackfillKeepsStateIfFlushFails(t *testing.T) {
+	base := time.Date(2024, 4, 30, 3, 0, 0, 0, time.UTC)
+	testServer := mockArchive(t, base)
+	defer testServer.Close()
+	env.SensorThingsBaseUrlObservations = fmt.Sprintf("%s/", testServer.URL)
+	env.CycleRaster = 5 * time.Second
+	things.Things.Range(func(key, _ interface{}) bool {
+		things.Things.Delete(key)
+		return true
+	})
+	mockThing("1337_3")
+	updateHistory = func(
+		thingName string,
+		newCycleStartTime time.Time, newCycleEndTime time.Time,
+		_ observations.CycleSnapshot, _ observations.CycleSnapshot, _ observations.CycleSnapshot,
+		_ observations.CycleSnapshot, _ observations.CycleSnapshot,
+	) (histories.History, error) {
+		return histories.History{}, nil
+	}
+	flushHistories = func() error { return fmt.Errorf("disk full") }
+	defer func() { flushHistories = histories.FlushHistories }()
+
+	statePath := t.TempDir() + "/state.json"
+	if err := Run([]string{"-state", statePath, "-rate", "1000"}); err == nil {
+		t.Errorf("backfill should fail if the histories can't be flushed")
+		t.FailNow()
+	}
+	if _, err := loadState(statePath); err == nil {
+		t.Errorf("the state should not be saved if the histories can't be flushed")
+		t.FailNow()
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	path := t.TempDir() + "/state.json"
+	since := time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC)
+	state := newState(since, since.Add(time.Hour))
+	state.Done["1337_1"] = true
+	if err := state.save(path); err != nil {
+		t.Errorf("state could not be saved: %v", err)
+		t.FailNow()
+	}
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Errorf("state could not be loaded: %v", err)
+		t.FailNow()
+	}
+	if !loaded.Since.Equal(state.Since) || !loaded.Until.Equal(state.Until) || !loaded.Done["1337_1"] {
+		t.Errorf("unexpected state: %v", loaded)
+		t.FailNow()
+	}
+}
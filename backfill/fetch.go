@@ -0,0 +1,66 @@
+package backfill
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"predictor/env"
+	"predictor/observations"
+	"predictor/things"
+	"time"
+)
+
+// The number of observations that are requested per page.
+const observationsPerPage = 1000
+
+// Build the url for the observations of a datastream within a time range.
+func observationsUrl(datastream things.Datastream, since time.Time, until time.Time) string {
+	return env.SensorThingsBaseUrlObservations + fmt.Sprintf("Datastreams(%d)/Observations?", datastream.IotId) + url.QueryEscape(
+		"$filter="+
+			"phenomenonTime ge "+since.UTC().Format(time.RFC3339)+" "+
+			"and phenomenonTime lt "+until.UTC().Format(time.RFC3339)+
+			"&$orderby=phenomenonTime asc"+
+			fmt.Sprintf("&$top=%d", observationsPerPage),
+	)
+}
+
+// Fetch all observations of a datastream within a time range.
+// Before each request, a tick is awaited from the limiter.
+func fetchObservations(
+	datastream things.Datastream,
+	since time.Time, until time.Time,
+	limiter <-chan time.Time,
+) ([]observations.Observation, error) {
+	fetched := []observations.Observation{}
+	pageUrl := observationsUrl(datastream, since, until)
+	for {
+		<-limiter
+		resp, err := http.Get(pageUrl)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 300 {
+			return nil, fmt.Errorf("could not fetch observations: %s", resp.Status)
+		}
+
+		var observationsResponse struct {
+			Value   []observations.Observation `json:"value"`
+			NextUri *string                    `json:"@iot.nextLink"`
+		}
+		if err := json.Unmarshal(body, &observationsResponse); err != nil {
+			return nil, err
+		}
+		fetched = append(fetched, observationsResponse.Value...)
+		if observationsResponse.NextUri == nil {
+			return fetched, nil
+		}
+		pageUrl = *observationsResponse.NextUri
+	}
+}
@@ -0,0 +1,71 @@
+package backfill
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The progress of a backfill run, persisted so that an interrupted run can be resumed.
+type State struct {
+	// The start of the backfilled time range.
+	Since time.Time `json:"since"`
+	// The end of the backfilled time range.
+	Until time.Time `json:"until"`
+	// The end time of the last cycle that was written to the history, by thing name.
+	Progress map[string]time.Time `json:"progress"`
+	// The things that were completely backfilled, by thing name.
+	Done map[string]bool `json:"done"`
+}
+
+// Create a new state for the given time range.
+func newState(since time.Time, until time.Time) *State {
+	return &State{
+		Since:    since,
+		Until:    until,
+		Progress: make(map[string]time.Time),
+		Done:     make(map[string]bool),
+	}
+}
+
+// Load the state from a file. Returns an error if no state exists.
+func loadState(path string) (*State, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var state State
+	if err := json.NewDecoder(file).Decode(&state); err != nil {
+		return nil, err
+	}
+	if state.Progress == nil {
+		state.Progress = make(map[string]time.Time)
+	}
+	if state.Done == nil {
+		state.Done = make(map[string]bool)
+	}
+	return &state, nil
+}
+
+// Save the state to a file.
+// The state is written to a temporary file first, so that it is never left half-written.
+func (s *State) save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(file).Encode(s); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,152 @@
+package deadletters
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"predictor/env"
+	"predictor/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The stages at which data can be discarded.
+const (
+	// The datastream or thing of a message could not be found.
+	StageLookup = "lookup"
+	// The payload of a message could not be decoded.
+	StageDecode = "decode"
+	// The datastream of the message was quarantined, since it misbehaved.
+	StageQuarantine = "quarantine"
+	// The observation violated a validation rule.
+	StageValidation = "validation"
+	// The observation could not be handled, e.g. the cycle could not be completed.
+	StageHandling = "handling"
+	// The completed cycle could not be added to the history.
+	StageHistory = "history"
+	// The completed cycle could not be written to the archive.
+	StageArchive = "archive"
+)
+
+// The maximum number of dead letters that are kept per thing.
+// When this limit is reached, the oldest dead letters are dropped.
+const maxLettersPerThing = 50
+
+// The maximum number of payload bytes that are kept per dead letter.
+const maxPayloadLength = 1024
+
+// The name under which dead letters without a known thing are stored.
+const unknownThing = "unknown"
+
+// A discarded message or cycle, together with the reason why it was discarded.
+type Letter struct {
+	// The time when the data was discarded.
+	Time time.Time `json:"time"`
+	// The thing that the data belongs to, if known.
+	Thing string `json:"thing"`
+	// The MQTT topic of the message, if the data was received via MQTT.
+	Topic string `json:"topic,omitempty"`
+	// The stage at which the data was discarded.
+	Stage string `json:"stage"`
+	// The reason why the data was discarded.
+	Reason string `json:"reason"`
+	// The raw payload of the message, if the data was received via MQTT.
+	Payload string `json:"payload,omitempty"`
+	// A snapshot of the discarded data, e.g. a cycle.
+	Snapshot interface{} `json:"snapshot,omitempty"`
+}
+
+// A bounded list of dead letters for a thing.
+type mailbox struct {
+	// The lock that must be used when accessing the letters.
+	lock sync.RWMutex
+	// The letters, sorted by time ascending.
+	letters []Letter
+}
+
+// The mailboxes by their thing name.
+var mailboxes = &sync.Map{}
+
+// The number of dead letters that were added.
+var LettersAdded uint64 = 0
+
+// Add a dead letter to the store.
+func Add(letter Letter) {
+	if letter.Time.IsZero() {
+		letter.Time = time.Now()
+	}
+	if len(letter.Payload) > maxPayloadLength {
+		letter.Payload = letter.Payload[:maxPayloadLength]
+	}
+	key := letter.Thing
+	if key == "" {
+		key = unknownThing
+	}
+	val, _ := mailboxes.LoadOrStore(key, &mailbox{})
+	box := val.(*mailbox)
+	box.lock.Lock()
+	defer box.lock.Unlock()
+	box.letters = append(box.letters, letter)
+	if len(box.letters) > maxLettersPerThing {
+		box.letters = box.letters[len(box.letters)-maxLettersPerThing:]
+	}
+	atomic.AddUint64(&LettersAdded, 1)
+}
+
+// Get a copy of the dead letters for a thing, sorted by time ascending.
+// Dead letters without a known thing are stored under the name `unknown`.
+func Get(thingName string) []Letter {
+	val, ok := mailboxes.Load(thingName)
+	if !ok {
+		return []Letter{}
+	}
+	box := val.(*mailbox)
+	box.lock.RLock()
+	defer box.lock.RUnlock()
+	letters := make([]Letter, len(box.letters))
+	copy(letters, box.letters)
+	return letters
+}
+
+// Count the dead letters by their stage, for a thing.
+func CountByStage(thingName string) map[string]int {
+	counts := make(map[string]int)
+	for _, letter := range Get(thingName) {
+		counts[letter.Stage]++
+	}
+	return counts
+}
+
+// Write the dead letters of each thing into a json file.
+func WriteFiles() {
+	mailboxes.Range(func(key, value interface{}) bool {
+		thingName := key.(string)
+		filePath := fmt.Sprintf("%s/deadletters/%s.json", env.StaticPath, thingName)
+		// Make sure the directory exists, otherwise create it.
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err != nil {
+			log.Error.Println("Error creating directory for dead letters:", err)
+			return false
+		}
+		jsonBytes, err := json.Marshal(Get(thingName))
+		if err != nil {
+			log.Error.Println("Error marshaling dead letters:", err)
+			return true
+		}
+		err = os.WriteFile(filePath, jsonBytes, 0644)
+		if err != nil {
+			log.Error.Println("Error writing dead letters:", err)
+		}
+		return true
+	})
+}
+
+// Write the dead letter files periodically.
+func WriteFilesPeriodically() {
+	for {
+		time.Sleep(30 * time.Second)
+		WriteFiles()
+	}
+}
@@ -0,0 +1,68 @@
+package deadletters
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"predictor/env"
+	"testing"
+)
+
+func TestAddAndGet(t *testing.T) {
+	Add(Letter{Thing: "1337_1", Stage: StageDecode, Reason: "invalid json", Payload: "{"})
+	Add(Letter{Thing: "1337_1", Stage: StageValidation, Reason: "signal_color"})
+	Add(Letter{Stage: StageLookup, Reason: "unknown topic"})
+
+	letters := Get("1337_1")
+	if len(letters) != 2 {
+		t.Errorf("expected 2 dead letters, got %d", len(letters))
+		t.FailNow()
+	}
+	if letters[0].Stage != StageDecode || letters[0].Payload != "{" || letters[0].Time.IsZero() {
+		t.Errorf("dead letter was not stored correctly")
+		t.FailNow()
+	}
+	if len(Get(unknownThing)) != 1 {
+		t.Errorf("dead letters without thing should be stored as unknown")
+		t.FailNow()
+	}
+	counts := CountByStage("1337_1")
+	if counts[StageDecode] != 1 || counts[StageValidation] != 1 {
+		t.Errorf("unexpected counts by stage: %v", counts)
+	}
+}
+
+func TestMailboxIsBounded(t *testing.T) {
+	for i := 0; i < maxLettersPerThing+10; i++ {
+		Add(Letter{Thing: "1337_2", Reason: fmt.Sprintf("%d", i)})
+	}
+	letters := Get("1337_2")
+	if len(letters) != maxLettersPerThing {
+		t.Errorf("mailbox should be bounded")
+		t.FailNow()
+	}
+	if letters[0].Reason != "10" {
+		t.Errorf("the oldest dead letters should be dropped first")
+	}
+}
+
+func TestWriteFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	env.StaticPath = tempDir
+	Add(Letter{Thing: "1337_3", Stage: StageHistory, Reason: "no phases"})
+	WriteFiles()
+
+	data, err := os.ReadFile(fmt.Sprintf("%s/deadletters/1337_3.json", tempDir))
+	if err != nil {
+		t.Errorf("dead letter file could not be read: %s", err.Error())
+		t.FailNow()
+	}
+	var letters []Letter
+	if err := json.Unmarshal(data, &letters); err != nil {
+		t.Errorf("dead letter file could not be decoded: %s", err.Error())
+		t.FailNow()
+	}
+	if len(letters) != 1 || letters[0].Reason != "no phases" {
+		t.Errorf("unexpected dead letters in file")
+	}
+}
@@ -3,7 +3,9 @@ package env
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Load a *required* string environment variable.
@@ -29,6 +31,45 @@ func loadOptional(name string, validate func(string) *error) string {
 	return value
 }
 
+// Parse an optional duration that was validated with the `durationValidator`.
+// This will return the fallback if the value is empty.
+func parseDuration(value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// Parse an optional rate that was validated with the `rateValidator`.
+// This will return the fallback if the value is empty.
+func parseRate(value string, fallback float64) float64 {
+	if value == "" {
+		return fallback
+	}
+	r, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Parse an optional integer that was validated with the `positiveIntValidator`.
+// This will return the fallback if the value is empty.
+func parseInt(value string, fallback int) int {
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		panic(err)
+	}
+	return i
+}
+
 // The path under which the history files are stored, from the environment variable.
 var StaticPath string
 
@@ -50,6 +91,95 @@ var PredictionMqttUsername string
 // The password to use for the prediction MQTT broker.
 var PredictionMqttPassword string
 
+// The name of this predictor instance, used to derive stable MQTT client ids.
+// If empty, a random client id is generated on every start.
+var InstanceName string
+
+// If the MQTT clients should use persistent sessions (clean session off).
+// This requires a stable instance name.
+var MqttPersistentSession bool
+
+// The directory under which the MQTT clients store in-flight messages and their subscribed topics.
+// If empty, the messages are only kept in memory and persistent sessions are cleared on start.
+var MqttStorePath string
+
+// The duration without `primary_signal` observations after which a thing is marked offline.
+// If zero, things are never marked offline.
+var StaleThingTimeout time.Duration
+
+// The duration of recent observations that are prefetched on startup.
+// If zero, only the most recent observation of each datastream is prefetched.
+var PrefetchWindow time.Duration
+
+// The maximum number of messages per second on a single datastream topic.
+// If zero, the message rate is not limited.
+var TopicRateLimit float64
+
+// The maximum number of signal color changes per second on a single datastream topic.
+// If zero, flapping signals are not detected.
+var FlappingLimit float64
+
+// The duration for which a misbehaving datastream topic is quarantined.
+var QuarantineDuration time.Duration
+
+// If the cycles of things without a `cycle_second` datastream are inferred
+// from the periodicity of their `primary_signal` observations.
+var CycleInference bool
+
+// The raster to which cycle boundaries are snapped, as long as no cycle model was learned.
+// If zero, the boundaries are not snapped.
+var CycleRaster time.Duration
+
+// The duration of recent observations that are kept in the timeline of each thing and layer.
+// If zero, no timelines are kept.
+var TimelineWindow time.Duration
+
+// The address on which the HTTP API listens, e.g. ":8080".
+// If empty, the HTTP API is disabled.
+var ApiAddress string
+
+// The backend in which the histories are stored, either "file" or "bolt".
+var HistoryStore string
+
+// The path of the database file of the "bolt" history store.
+var HistoryDbPath string
+
+// The encoding in which the histories are written, either "json" or "binary".
+var HistoryEncoding string
+
+// If the histories are segmented by day type and time-of-day window.
+var HistorySegmentation bool
+
+// The time-of-day windows by which the histories are segmented, e.g. "rush=06:00-09:00,midday=09:00-15:00".
+// If empty, the histories are only segmented by day type.
+var HistoryTimeWindows string
+
+// The timezone in which the time-of-day windows and day types are evaluated.
+var HistoryTimezone string
+
+// The path of the holiday calendar file, with one date (YYYY-MM-DD) per line.
+// If empty, no days are treated as holidays.
+var HolidayCalendarPath string
+
+// The minimum number of cycles that a history adapts to.
+var HistoryMinLength int
+
+// The maximum number of cycles that a history adapts to.
+var HistoryMaxLength int
+
+// The directory of the long-term archive of all completed cycles.
+// If empty, no cycles are archived.
+var ArchivePath string
+
+// The duration after which days are removed from the archive.
+// If zero, the archive is kept forever.
+var ArchiveRetention time.Duration
+
+// The interval in which changed histories are written to the store.
+// With cycles of 60 to 120 seconds, a history collects 5 to 10 cycles per write
+// at the default of 10 minutes. If zero, every change is written through immediately.
+var HistoryFlushInterval time.Duration
+
 var staticPathValidator = func(value string) *error {
 	if strings.HasSuffix(value, "/") {
 		err := fmt.Errorf("static path shouldn't end with a slash")
@@ -82,6 +212,110 @@ var predictionMqttUrlValidator = func(value string) *error {
 	return nil
 }
 
+var mqttStorePathValidator = func(value string) *error {
+	if strings.HasSuffix(value, "/") {
+		err := fmt.Errorf("mqtt store path shouldn't end with a slash")
+		return &err
+	}
+	return nil
+}
+
+var instanceNameValidator = func(value string) *error {
+	for _, c := range value {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' {
+			continue
+		}
+		err := fmt.Errorf("instance name may only contain letters, digits, dashes and underscores")
+		return &err
+	}
+	return nil
+}
+
+var apiAddressValidator = func(value string) *error {
+	if value != "" && !strings.Contains(value, ":") {
+		err := fmt.Errorf("api address must contain a port, e.g. :8080")
+		return &err
+	}
+	return nil
+}
+
+var archivePathValidator = func(value string) *error {
+	if strings.HasSuffix(value, "/") {
+		err := fmt.Errorf("archive path shouldn't end with a slash")
+		return &err
+	}
+	return nil
+}
+
+var historyStoreValidator = func(value string) *error {
+	if value != "" && value != "file" && value != "bolt" {
+		err := fmt.Errorf("history store must be file or bolt")
+		return &err
+	}
+	return nil
+}
+
+var historyEncodingValidator = func(value string) *error {
+	if value != "" && value != "json" && value != "binary" {
+		err := fmt.Errorf("history encoding must be json or binary")
+		return &err
+	}
+	return nil
+}
+
+var boolValidator = func(value string) *error {
+	if value != "" && value != "true" && value != "false" {
+		err := fmt.Errorf("expected true or false")
+		return &err
+	}
+	return nil
+}
+
+var rateValidator = func(value string) *error {
+	if value == "" {
+		return nil
+	}
+	r, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return &err
+	}
+	if r < 0 {
+		err := fmt.Errorf("rate must not be negative")
+		return &err
+	}
+	return nil
+}
+
+var positiveIntValidator = func(value string) *error {
+	if value == "" {
+		return nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return &err
+	}
+	if i <= 0 {
+		err := fmt.Errorf("value must be positive")
+		return &err
+	}
+	return nil
+}
+
+var durationValidator = func(value string) *error {
+	if value == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return &err
+	}
+	if d < 0 {
+		err := fmt.Errorf("duration must not be negative")
+		return &err
+	}
+	return nil
+}
+
 var emptyValidator = func(value string) *error {
 	return nil
 }
@@ -94,4 +328,46 @@ func Init() {
 	PredictionMqttUrl = loadRequired("PREDICTION_MQTT_URL", predictionMqttUrlValidator)
 	PredictionMqttUsername = loadOptional("PREDICTION_MQTT_USERNAME", emptyValidator)
 	PredictionMqttPassword = loadOptional("PREDICTION_MQTT_PASSWORD", emptyValidator)
+	InstanceName = loadOptional("INSTANCE_NAME", instanceNameValidator)
+	MqttPersistentSession = loadOptional("MQTT_PERSISTENT_SESSION", boolValidator) == "true"
+	MqttStorePath = loadOptional("MQTT_STORE_PATH", mqttStorePathValidator)
+	StaleThingTimeout = parseDuration(loadOptional("STALE_THING_TIMEOUT", durationValidator), 5*time.Minute)
+	PrefetchWindow = parseDuration(loadOptional("PREFETCH_WINDOW", durationValidator), 5*time.Minute)
+	TopicRateLimit = parseRate(loadOptional("TOPIC_RATE_LIMIT", rateValidator), 5)
+	FlappingLimit = parseRate(loadOptional("FLAPPING_LIMIT", rateValidator), 1)
+	QuarantineDuration = parseDuration(loadOptional("QUARANTINE_DURATION", durationValidator), 10*time.Minute)
+	CycleInference = loadOptional("CYCLE_INFERENCE", boolValidator) == "true"
+	CycleRaster = parseDuration(loadOptional("CYCLE_RASTER", durationValidator), 5*time.Second)
+	TimelineWindow = parseDuration(loadOptional("TIMELINE_WINDOW", durationValidator), 60*time.Minute)
+	ApiAddress = loadOptional("API_ADDRESS", apiAddressValidator)
+	HistoryStore = loadOptional("HISTORY_STORE", historyStoreValidator)
+	if HistoryStore == "" {
+		HistoryStore = "file"
+	}
+	HistoryDbPath = loadOptional("HISTORY_DB_PATH", emptyValidator)
+	HistoryMinLength = parseInt(loadOptional("HISTORY_MIN_LENGTH", positiveIntValidator), 5)
+	HistoryMaxLength = parseInt(loadOptional("HISTORY_MAX_LENGTH", positiveIntValidator), 50)
+	ArchivePath = loadOptional("ARCHIVE_PATH", archivePathValidator)
+	ArchiveRetention = parseDuration(loadOptional("ARCHIVE_RETENTION", durationValidator), 365*24*time.Hour)
+	HistoryFlushInterval = parseDuration(loadOptional("HISTORY_FLUSH_INTERVAL", durationValidator), 10*time.Minute)
+	HistorySegmentation = loadOptional("HISTORY_SEGMENTATION", boolValidator) == "true"
+	HistoryTimeWindows = loadOptional("HISTORY_TIME_WINDOWS", emptyValidator)
+	HistoryTimezone = loadOptional("HISTORY_TIMEZONE", emptyValidator)
+	if HistoryTimezone == "" {
+		HistoryTimezone = "Europe/Berlin"
+	}
+	HolidayCalendarPath = loadOptional("HOLIDAY_CALENDAR_PATH", emptyValidator)
+	HistoryEncoding = loadOptional("HISTORY_ENCODING", historyEncodingValidator)
+	if HistoryEncoding == "" {
+		HistoryEncoding = "json"
+	}
+	if MqttPersistentSession && InstanceName == "" {
+		panic("Persistent MQTT sessions require INSTANCE_NAME to be set.")
+	}
+	if HistoryMinLength > HistoryMaxLength {
+		panic("HISTORY_MIN_LENGTH must not be greater than HISTORY_MAX_LENGTH.")
+	}
+	if HistoryStore == "bolt" && HistoryDbPath == "" {
+		panic("The bolt history store requires HISTORY_DB_PATH to be set.")
+	}
 }
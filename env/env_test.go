@@ -86,4 +86,40 @@ func TestValidators(t *testing.T) {
 	if predictionMqttUrlValidator("ws://localhost:80") == nil {
 		t.Errorf("prediction mqtt url validator should catch wrong protocol")
 	}
+	if instanceNameValidator("predictor/a") == nil {
+		t.Errorf("instance name validator should catch invalid characters")
+	}
+	if durationValidator("5 minutes") == nil || durationValidator("-5m") == nil {
+		t.Errorf("duration validator should catch invalid durations")
+	}
+	if rateValidator("fast") == nil || rateValidator("-1") == nil {
+		t.Errorf("rate validator should catch invalid rates")
+	}
+	if boolValidator("yes") == nil {
+		t.Errorf("bool validator should catch values other than true or false")
+	}
+	if positiveIntValidator("ten") == nil || positiveIntValidator("0") == nil {
+		t.Errorf("positive int validator should catch invalid values")
+	}
+	if apiAddressValidator("localhost") == nil {
+		t.Errorf("api address validator should catch missing ports")
+	}
+	if historyStoreValidator("sqlite") == nil || historyEncodingValidator("xml") == nil {
+		t.Errorf("history validators should catch unknown backends and encodings")
+	}
+}
+
+func TestPersistentSessionRequiresInstanceName(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("should panic")
+		}
+	}()
+	t.Setenv("STATIC_PATH", "/usr/share/nginx/html")
+	t.Setenv("SENSORTHINGS_URL_THINGS", "https://tld.iot.hamburg.de/v1.1/")
+	t.Setenv("SENSORTHINGS_URL_OBSERVATIONS", "https://tld.iot.hamburg.de/v1.1/")
+	t.Setenv("SENSORTHINGS_MQTT_URL", "tcp://tld.iot.hamburg.de:1883")
+	t.Setenv("PREDICTION_MQTT_URL", "tcp://predictor-mosquitto:1883")
+	t.Setenv("MQTT_PERSISTENT_SESSION", "true")
+	Init()
 }
@@ -0,0 +1,156 @@
+package events
+
+import (
+	"fmt"
+	"hash/fnv"
+	"predictor/log"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// The number of workers that deliver the events of a bus.
+// Events of the same thing are always delivered by the same worker.
+const shardsPerBus = 16
+
+// The number of events that can be queued per worker before publishing blocks.
+const eventsPerShard = 1024
+
+// A subscriber of a bus.
+type subscriber[T any] struct {
+	// The id of the subscription, used to unsubscribe.
+	id uint64
+	// The name of the subscriber, used for logging.
+	name string
+	// The function that handles the events.
+	handle func(event T)
+}
+
+// An event that is queued for delivery.
+type delivery[T any] struct {
+	// The name of the thing that the event belongs to.
+	thingName string
+	// The event itself.
+	event T
+}
+
+// A typed event bus with multiple subscribers.
+// Events of the same thing are delivered to all subscribers in the order
+// they were published. Events of different things are delivered concurrently.
+// A panicking subscriber doesn't affect the other subscribers.
+type Bus[T any] struct {
+	// The name of the bus, used for logging and metrics.
+	name string
+	// The lock that must be used when accessing the subscribers.
+	lock sync.RWMutex
+	// The current subscribers.
+	subscribers []subscriber[T]
+	// The id of the next subscription.
+	nextId uint64
+	// The queues of the workers.
+	shards []chan delivery[T]
+	// Start the workers on the first published event.
+	start sync.Once
+	// The statistics of the bus.
+	stats *Stats
+}
+
+// The statistics of a bus.
+type Stats struct {
+	// The name of the bus.
+	Bus string
+	// The number of published events.
+	Published uint64
+	// The number of events that were delivered to a subscriber.
+	Delivered uint64
+	// The number of events for which a subscriber panicked.
+	Panics uint64
+}
+
+// The statistics of all buses, by their name.
+var stats = &sync.Map{}
+
+// Create a new bus with a unique name.
+func NewBus[T any](name string) *Bus[T] {
+	s := &Stats{Bus: name}
+	if _, loaded := stats.LoadOrStore(name, s); loaded {
+		panic(fmt.Sprintf("bus %s already exists", name))
+	}
+	return &Bus[T]{name: name, stats: s}
+}
+
+// Subscribe to the events of the bus.
+// Returns a function that cancels the subscription.
+func (b *Bus[T]) Subscribe(name string, handle func(event T)) (unsubscribe func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.nextId++
+	id := b.nextId
+	b.subscribers = append(b.subscribers, subscriber[T]{id, name, handle})
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		for i, s := range b.subscribers {
+			if s.id == id {
+				b.subscribers = append(b.subscribers[:i:i], b.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish an event of a thing to all subscribers.
+// This blocks if the queue of the thing's worker is full.
+func (b *Bus[T]) Publish(thingName string, event T) {
+	b.start.Do(func() {
+		b.shards = make([]chan delivery[T], shardsPerBus)
+		for i := range b.shards {
+			b.shards[i] = make(chan delivery[T], eventsPerShard)
+			go b.work(b.shards[i])
+		}
+	})
+	atomic.AddUint64(&b.stats.Published, 1)
+	hash := fnv.New32a()
+	hash.Write([]byte(thingName))
+	b.shards[hash.Sum32()%shardsPerBus] <- delivery[T]{thingName, event}
+}
+
+// Deliver the queued events to the subscribers, one after another.
+func (b *Bus[T]) work(queue chan delivery[T]) {
+	for d := range queue {
+		b.lock.RLock()
+		subscribers := b.subscribers
+		b.lock.RUnlock()
+		for _, s := range subscribers {
+			b.deliver(s, d)
+		}
+	}
+}
+
+// Deliver an event to a single subscriber and recover from its panics.
+func (b *Bus[T]) deliver(s subscriber[T], d delivery[T]) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&b.stats.Panics, 1)
+			log.Error.Printf("Subscriber %s of %s panicked for %s: %v\n%s", s.name, b.name, d.thingName, r, debug.Stack())
+		}
+	}()
+	s.handle(d.event)
+	atomic.AddUint64(&b.stats.Delivered, 1)
+}
+
+// Get the statistics of all buses.
+func GetStats() []Stats {
+	all := []Stats{}
+	stats.Range(func(_, v interface{}) bool {
+		s := v.(*Stats)
+		all = append(all, Stats{
+			Bus:       s.Bus,
+			Published: atomic.LoadUint64(&s.Published),
+			Delivered: atomic.LoadUint64(&s.Delivered),
+			Panics:    atomic.LoadUint64(&s.Panics),
+		})
+		return true
+	})
+	return all
+}
@@ -0,0 +1,86 @@
+package events
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrderedDelivery(t *testing.T) {
+	bus := NewBus[int]("test_ordered")
+	var lock sync.Mutex
+	received := map[string][]int{}
+	var wg sync.WaitGroup
+	wg.Add(200)
+	bus.Subscribe("test", func(event int) {
+		defer wg.Done()
+		thingName := "1337_1"
+		if event >= 100 {
+			thingName = "1337_2"
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		received[thingName] = append(received[thingName], event)
+	})
+	for i := 0; i < 100; i++ {
+		bus.Publish("1337_1", i)
+		bus.Publish("1337_2", 100+i)
+	}
+	wg.Wait()
+
+	for thingName, events := range received {
+		for i := 1; i < len(events); i++ {
+			if events[i] < events[i-1] {
+				t.Errorf("events of %s were delivered out of order: %v", thingName, events)
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestPanicIsolation(t *testing.T) {
+	bus := NewBus[string]("test_panic")
+	delivered := make(chan string, 2)
+	bus.Subscribe("panicking", func(event string) {
+		panic("test panic")
+	})
+	unsubscribe := bus.Subscribe("unsubscribed", func(event string) {
+		t.Errorf("unsubscribed subscriber received an event")
+	})
+	unsubscribe()
+	bus.Subscribe("healthy", func(event string) {
+		delivered <- event
+	})
+
+	bus.Publish("1337_1", "a")
+	bus.Publish("1337_1", "b")
+	for _, expected := range []string{"a", "b"} {
+		select {
+		case event := <-delivered:
+			if event != expected {
+				t.Errorf("expected event %s, got %s", expected, event)
+				t.FailNow()
+			}
+		case <-time.After(time.Second):
+			t.Errorf("event was not delivered after a panic")
+			t.FailNow()
+		}
+	}
+
+	for _, s := range GetStats() {
+		if s.Bus == "test_panic" && (s.Published != 2 || s.Panics != 2) {
+			t.Errorf("unexpected stats: %+v", s)
+			t.FailNow()
+		}
+	}
+}
+
+func TestNewBusTwice(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("should panic")
+		}
+	}()
+	NewBus[int]("test_twice")
+	NewBus[int]("test_twice")
+}
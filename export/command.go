@@ -0,0 +1,101 @@
+package export
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"predictor/log"
+	"predictor/things"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interface to other packages.
+var syncThings = things.SyncThings // func ref
+
+// Parse an optional program id.
+func ParseProgram(value string) (*byte, error) {
+	if value == "" {
+		return nil, nil
+	}
+	program, err := strconv.ParseUint(value, 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid program: %s", value)
+	}
+	p := byte(program)
+	return &p, nil
+}
+
+// Export the histories and the archive into a file.
+// The arguments are the command line flags of the `export` command.
+func Run(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	thingNames := flags.String("things", "", "The comma separated names of the things to export. Empty for all things.")
+	crossing := flags.String("crossing", "", "The crossing (traffic lights id) of the things to export.")
+	program := flags.String("program", "", "The program of the cycles to export.")
+	hours := flags.Int("hours", 24, "The number of past hours to export, if no time range is given.")
+	from := flags.String("from", "", "The start of the time range (RFC3339).")
+	to := flags.String("to", "", "The end of the time range (RFC3339).")
+	variant := flags.String("variant", VariantCycles, "The rows to export: cycles or phases.")
+	format := flags.String("format", FormatCSV, "The format of the export: csv or ndjson.")
+	out := flags.String("out", "", "The file to write the export to. Empty for stdout.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := Validate(*variant, *format); err != nil {
+		return err
+	}
+
+	filter := Filter{Crossing: *crossing, To: time.Now()}
+	if *thingNames != "" {
+		filter.Things = strings.Split(*thingNames, ",")
+	}
+	var err error
+	if filter.Program, err = ParseProgram(*program); err != nil {
+		return err
+	}
+	if *to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			return fmt.Errorf("invalid end of time range: %v", err)
+		}
+	}
+	filter.From = filter.To.Add(-time.Duration(*hours) * time.Hour)
+	if *from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			return fmt.Errorf("invalid start of time range: %v", err)
+		}
+	}
+
+	// Don't mix the log into the export on stdout.
+	if *out == "" {
+		log.Info.SetOutput(os.Stderr)
+		log.Warning.SetOutput(os.Stderr)
+		defer log.Info.SetOutput(os.Stdout)
+		defer log.Warning.SetOutput(os.Stdout)
+	}
+	// The things of the crossings are only known after syncing the things.
+	if filter.Crossing != "" {
+		syncThings()
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	rows, err := Write(w, filter, *variant, *format)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		log.Info.Printf("Exported %d rows to stdout.", rows)
+	} else {
+		log.Info.Printf("Exported %d rows to %s.", rows, *out)
+	}
+	return nil
+}
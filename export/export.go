@@ -0,0 +1,256 @@
+package export
+
+import (
+	"predictor/archive"
+	"predictor/env"
+	"predictor/histories"
+	"predictor/phases"
+	"predictor/things"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The filter of an export. Empty fields don't filter.
+type Filter struct {
+	// The names of the things to export.
+	Things []string
+	// The crossing (traffic lights id) of the things to export.
+	Crossing string
+	// The program of the cycles to export.
+	Program *byte
+	// The time range in which the exported cycles started.
+	From time.Time
+	To   time.Time
+}
+
+// A cycle of a thing, as exported.
+type CycleRow struct {
+	Thing     string    `json:"thing"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	Program   *byte     `json:"program"`
+	// The durations of the colors within the cycle, in seconds.
+	Duration float64 `json:"duration"`
+	Green    float64 `json:"green"`
+	Red      float64 `json:"red"`
+	Amber    float64 `json:"amber"`
+	RedAmber float64 `json:"redAmber"`
+	Other    float64 `json:"other"`
+	// The number of detector events within the cycle.
+	Cars  int `json:"cars"`
+	Bikes int `json:"bikes"`
+}
+
+// A phase event of a cycle, as exported.
+type PhaseRow struct {
+	Thing     string    `json:"thing"`
+	StartTime time.Time `json:"startTime"`
+	Program   *byte     `json:"program"`
+	Time      time.Time `json:"time"`
+	// The seconds since the start of the cycle, negative before the cycle started.
+	Offset float64 `json:"offset"`
+	Color  byte    `json:"color"`
+}
+
+// Interfaces to other packages.
+var (
+	getHistoryKeys = histories.Keys        // func ref
+	loadHistory    = histories.PeekHistory // func ref
+	readArchive    = archive.Read          // func ref
+)
+
+// Get the names of the things of a crossing.
+var getThingsOfCrossing = func(crossing string) []string {
+	names, ok := things.Crossings.Load(crossing)
+	if !ok {
+		return []string{}
+	}
+	return names.([]string)
+}
+
+// Check if a cycle passes the program and time filter.
+func (f Filter) matchesCycle(cycle histories.HistoryCycle) bool {
+	if f.Program != nil && (cycle.Program == nil || *cycle.Program != *f.Program) {
+		return false
+	}
+	if !f.From.IsZero() && cycle.StartTime.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && cycle.StartTime.After(f.To) {
+		return false
+	}
+	return true
+}
+
+// Check if a thing passes the thing and crossing filter.
+func (f Filter) matchesThing(thingName string) bool {
+	if len(f.Things) > 0 && !contains(f.Things, thingName) {
+		return false
+	}
+	if f.Crossing != "" && !contains(getThingsOfCrossing(f.Crossing), thingName) {
+		return false
+	}
+	return true
+}
+
+// Check if a name is in a list of names.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Collect the cycles that pass the filter, from the histories and the archive.
+// The cycles are passed to `emit` for one thing at a time, sorted by thing and start time,
+// so that only the cycles of a single thing are kept in memory.
+// Cycles that are in multiple histories (e.g. segments) or also in the archive are only emitted once.
+func collect(filter Filter, emit func(thingName string, cycles []histories.HistoryCycle) error) error {
+	keys, err := getHistoryKeys()
+	if err != nil {
+		return err
+	}
+	keysByThing := map[string][]string{}
+	for _, key := range keys {
+		// The key starts with the thing name, followed by the program and segment.
+		thingName, _, _ := strings.Cut(key, "-")
+		keysByThing[thingName] = append(keysByThing[thingName], key)
+	}
+	// Things that are only in the archive must be named explicitly.
+	candidates := map[string]bool{}
+	for thingName := range keysByThing {
+		candidates[thingName] = true
+	}
+	for _, thingName := range filter.Things {
+		candidates[thingName] = true
+	}
+	if filter.Crossing != "" {
+		for _, thingName := range getThingsOfCrossing(filter.Crossing) {
+			candidates[thingName] = true
+		}
+	}
+	thingNames := []string{}
+	for thingName := range candidates {
+		if filter.matchesThing(thingName) {
+			thingNames = append(thingNames, thingName)
+		}
+	}
+	sort.Strings(thingNames)
+
+	for _, thingName := range thingNames {
+		cycles := []histories.HistoryCycle{}
+		seen := map[int64]bool{}
+		add := func(cycle histories.HistoryCycle) {
+			id := cycle.StartTime.UnixMilli()
+			if seen[id] || !filter.matchesCycle(cycle) {
+				return
+			}
+			seen[id] = true
+			cycles = append(cycles, cycle)
+		}
+		if env.ArchivePath != "" {
+			from, to := filter.From, filter.To
+			if to.IsZero() {
+				to = time.Now()
+			}
+			entries, err := readArchive(thingName, from, to)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				add(entry.Cycle)
+			}
+		}
+		for _, key := range keysByThing[thingName] {
+			history, err := loadHistory(key)
+			if err != nil {
+				continue
+			}
+			for _, cycle := range history.Cycles {
+				add(cycle)
+			}
+		}
+		if len(cycles) == 0 {
+			continue
+		}
+		sort.Slice(cycles, func(i, j int) bool {
+			return cycles[i].StartTime.Before(cycles[j].StartTime)
+		})
+		if err := emit(thingName, cycles); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Make the exported row of a cycle.
+func makeCycleRow(thingName string, cycle histories.HistoryCycle) CycleRow {
+	row := CycleRow{
+		Thing:     thingName,
+		StartTime: cycle.StartTime,
+		EndTime:   cycle.EndTime,
+		Program:   cycle.Program,
+		Duration:  cycle.EndTime.Sub(cycle.StartTime).Seconds(),
+	}
+	// Sum up the time of each color within the cycle. Phases before the cycle started
+	// (the color at the start of the cycle) are clipped to the start.
+	for i, phase := range cycle.Phases {
+		from := phase.Time
+		if from.Before(cycle.StartTime) {
+			from = cycle.StartTime
+		}
+		to := cycle.EndTime
+		if i < len(cycle.Phases)-1 && cycle.Phases[i+1].Time.Before(to) {
+			to = cycle.Phases[i+1].Time
+		}
+		if !to.After(from) {
+			continue
+		}
+		seconds := to.Sub(from).Seconds()
+		switch phase.Color {
+		case phases.Green:
+			row.Green += seconds
+		case phases.Red:
+			row.Red += seconds
+		case phases.Amber:
+			row.Amber += seconds
+		case phases.RedAmber:
+			row.RedAmber += seconds
+		default:
+			row.Other += seconds
+		}
+	}
+	row.Cars = countWithin(cycle.Cars, cycle)
+	row.Bikes = countWithin(cycle.Bikes, cycle)
+	return row
+}
+
+// Count the detection events within a cycle.
+func countWithin(events []histories.HistoryDetectionEvent, cycle histories.HistoryCycle) int {
+	count := 0
+	for _, event := range events {
+		if !event.Time.Before(cycle.StartTime) && event.Time.Before(cycle.EndTime) {
+			count++
+		}
+	}
+	return count
+}
+
+// Make the exported rows of the phase events of a cycle.
+func makePhaseRows(thingName string, cycle histories.HistoryCycle) []PhaseRow {
+	rows := make([]PhaseRow, 0, len(cycle.Phases))
+	for _, phase := range cycle.Phases {
+		rows = append(rows, PhaseRow{
+			Thing:     thingName,
+			StartTime: cycle.StartTime,
+			Program:   cycle.Program,
+			Time:      phase.Time,
+			Offset:    phase.Time.Sub(cycle.StartTime).Seconds(),
+			Color:     phase.Color,
+		})
+	}
+	return rows
+}
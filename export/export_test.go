@@ -0,0 +1,151 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"predictor/archive"
+	"predictor/env"
+	"predictor/histories"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A cycle of 90 seconds: amber at the start, green for 30 seconds, red for the rest.
+func makeCycle(start int64, program byte) histories.HistoryCycle {
+	return histories.HistoryCycle{
+		StartTime: time.Unix(start, 0).UTC(),
+		EndTime:   time.Unix(start+90, 0).UTC(),
+		Program:   &program,
+		Phases: []histories.HistoryPhaseEvent{
+			{Time: time.Unix(start-3, 0).UTC(), Color: 2},
+			{Time: time.Unix(start+2, 0).UTC(), Color: 3},
+			{Time: time.Unix(start+32, 0).UTC(), Color: 1},
+		},
+		Cars: []histories.HistoryDetectionEvent{
+			{Time: time.Unix(start-10, 0).UTC(), Signal: "96_22", Pct: 100}, // Before the cycle
+			{Time: time.Unix(start+10, 0).UTC(), Signal: "96_22", Pct: 100},
+		},
+	}
+}
+
+func prepareMocks() {
+	env.ArchivePath = "/archive"
+	stored := map[string]histories.History{
+		"96_22-P3":         {Cycles: []histories.HistoryCycle{makeCycle(1000, 3), makeCycle(1090, 3)}},
+		"96_22-P3-weekday": {Cycles: []histories.HistoryCycle{makeCycle(1090, 3)}}, // Same cycle in a segment
+		"96_22-P4":         {Cycles: []histories.HistoryCycle{makeCycle(1180, 4)}},
+		"97_1":             {Cycles: []histories.HistoryCycle{makeCycle(1000, 1)}},
+	}
+	getHistoryKeys = func() ([]string, error) {
+		keys := []string{}
+		for key := range stored {
+			keys = append(keys, key)
+		}
+		return keys, nil
+	}
+	loadHistory = func(key string) (histories.History, error) {
+		history, ok := stored[key]
+		if !ok {
+			return history, fmt.Errorf("no history found")
+		}
+		return history, nil
+	}
+	readArchive = func(thingName string, from time.Time, to time.Time) ([]archive.Entry, error) {
+		if thingName != "96_22" {
+			return []archive.Entry{}, nil
+		}
+		// An older cycle that is only in the archive, and one that is also in the history.
+		return []archive.Entry{
+			{Thing: thingName, Cycle: makeCycle(910, 3)},
+			{Thing: thingName, Cycle: makeCycle(1000, 3)},
+		}, nil
+	}
+	getThingsOfCrossing = func(crossing string) []string {
+		if crossing == "96" {
+			return []string{"96_22"}
+		}
+		return []string{}
+	}
+}
+
+func TestExportCyclesCSV(t *testing.T) {
+	prepareMocks()
+	defer func() { env.ArchivePath = "" }()
+
+	var buf bytes.Buffer
+	program := byte(3)
+	rows, err := Write(&buf, Filter{Crossing: "96", Program: &program}, VariantCycles, FormatCSV)
+	if err != nil || rows != 3 {
+		t.Errorf("unexpected export result: %d rows, %v", rows, err)
+		t.FailNow()
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if lines[0] != "thing,start,end,program,duration,green,red,amber,red_amber,other,cars,bikes" {
+		t.Errorf("unexpected header: %s", lines[0])
+		t.FailNow()
+	}
+	if lines[1] != "96_22,1970-01-01T00:15:10Z,1970-01-01T00:16:40Z,3,90,30,58,2,0,0,1,0" {
+		t.Errorf("unexpected row: %s", lines[1])
+		t.FailNow()
+	}
+}
+
+func TestExportPhasesNDJSON(t *testing.T) {
+	prepareMocks()
+	defer func() { env.ArchivePath = "" }()
+
+	var buf bytes.Buffer
+	filter := Filter{Things: []string{"96_22"}, From: time.Unix(1000, 0), To: time.Unix(1100, 0)}
+	rows, err := Write(&buf, filter, VariantPhases, FormatNDJSON)
+	if err != nil || rows != 6 {
+		t.Errorf("unexpected export result: %d rows, %v", rows, err)
+		t.FailNow()
+	}
+	var first PhaseRow
+	if err := json.Unmarshal([]byte(strings.Split(buf.String(), "\n")[0]), &first); err != nil {
+		t.Errorf("could not unmarshal row: %s", err)
+		t.FailNow()
+	}
+	if first.Offset != -3 || first.Color != 2 || first.Thing != "96_22" {
+		t.Errorf("unexpected first row: %+v", first)
+		t.FailNow()
+	}
+}
+
+func TestExportInvalid(t *testing.T) {
+	if _, err := Write(&bytes.Buffer{}, Filter{}, "rows", FormatCSV); err == nil {
+		t.Errorf("unknown variant should fail")
+		t.FailNow()
+	}
+	if _, err := ParseProgram("300"); err == nil {
+		t.Errorf("program out of range should fail")
+		t.FailNow()
+	}
+}
+
+func TestExportStreamsThings(t *testing.T) {
+	prepareMocks()
+	defer func() { env.ArchivePath = "" }()
+
+	var buf bytes.Buffer
+	rows, err := Write(&buf, Filter{}, VariantCycles, FormatNDJSON)
+	if err != nil || rows != 5 {
+		t.Errorf("unexpected export result: %d rows, %v", rows, err)
+		t.FailNow()
+	}
+	// The rows are grouped by thing, and sorted by the start time within a thing.
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var last CycleRow
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil || last.Thing != "97_1" {
+		t.Errorf("unexpected last row: %+v, %v", last, err)
+		t.FailNow()
+	}
+	// Without matching cycles, only the csv header is written.
+	buf.Reset()
+	if _, err := Write(&buf, Filter{Things: []string{"98_1"}}, VariantCycles, FormatCSV); err != nil || strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("expected only the header, got %q, %v", buf.String(), err)
+		t.FailNow()
+	}
+}
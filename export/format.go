@@ -0,0 +1,144 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"predictor/histories"
+	"strconv"
+	"time"
+)
+
+// The variants of an export.
+const (
+	// One row per cycle, with the durations of the colors and the detector counts.
+	VariantCycles = "cycles"
+	// One row per phase event.
+	VariantPhases = "phases"
+)
+
+// The formats of an export.
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// Check the variant and format of an export.
+func Validate(variant string, format string) error {
+	if variant != VariantCycles && variant != VariantPhases {
+		return fmt.Errorf("unknown export variant: %s", variant)
+	}
+	if format != FormatCSV && format != FormatNDJSON {
+		return fmt.Errorf("unknown export format: %s", format)
+	}
+	return nil
+}
+
+// Write the cycles that pass the filter in the given variant and format.
+// The rows are written for one thing at a time, so that they can be streamed.
+func Write(w io.Writer, filter Filter, variant string, format string) (int, error) {
+	if err := Validate(variant, format); err != nil {
+		return 0, err
+	}
+	var write func(thingName string, cycles []histories.HistoryCycle) (int, error)
+	if format == FormatNDJSON {
+		write = ndjsonWriter(w, variant)
+	} else {
+		write = csvWriter(w, variant)
+	}
+	rows := 0
+	err := collect(filter, func(thingName string, cycles []histories.HistoryCycle) error {
+		written, err := write(thingName, cycles)
+		rows += written
+		return err
+	})
+	return rows, err
+}
+
+// Get a writer of one json object per line.
+func ndjsonWriter(w io.Writer, variant string) func(string, []histories.HistoryCycle) (int, error) {
+	encoder := json.NewEncoder(w)
+	return func(thingName string, cycles []histories.HistoryCycle) (int, error) {
+		rows := 0
+		for _, cycle := range cycles {
+			if variant == VariantCycles {
+				if err := encoder.Encode(makeCycleRow(thingName, cycle)); err != nil {
+					return rows, err
+				}
+				rows++
+				continue
+			}
+			for _, row := range makePhaseRows(thingName, cycle) {
+				if err := encoder.Encode(row); err != nil {
+					return rows, err
+				}
+				rows++
+			}
+		}
+		return rows, nil
+	}
+}
+
+// Format a program for csv, which is empty if the program is unknown.
+func formatProgram(program *byte) string {
+	if program == nil {
+		return ""
+	}
+	return strconv.Itoa(int(*program))
+}
+
+// Format seconds for csv.
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', -1, 64)
+}
+
+// Get a writer of a csv file. The header is written before the first rows.
+func csvWriter(w io.Writer, variant string) func(string, []histories.HistoryCycle) (int, error) {
+	writer := csv.NewWriter(w)
+	if variant == VariantCycles {
+		writer.Write([]string{"thing", "start", "end", "program", "duration", "green", "red", "amber", "red_amber", "other", "cars", "bikes"})
+	} else {
+		writer.Write([]string{"thing", "cycle_start", "program", "time", "offset", "color"})
+	}
+	// The header is also written if no thing has matching cycles.
+	writer.Flush()
+	return func(thingName string, cycles []histories.HistoryCycle) (int, error) {
+		rows := 0
+		for _, cycle := range cycles {
+			if variant == VariantCycles {
+				row := makeCycleRow(thingName, cycle)
+				writer.Write([]string{
+					row.Thing,
+					row.StartTime.UTC().Format(time.RFC3339),
+					row.EndTime.UTC().Format(time.RFC3339),
+					formatProgram(row.Program),
+					formatSeconds(row.Duration),
+					formatSeconds(row.Green),
+					formatSeconds(row.Red),
+					formatSeconds(row.Amber),
+					formatSeconds(row.RedAmber),
+					formatSeconds(row.Other),
+					strconv.Itoa(row.Cars),
+					strconv.Itoa(row.Bikes),
+				})
+				rows++
+				continue
+			}
+			for _, row := range makePhaseRows(thingName, cycle) {
+				writer.Write([]string{
+					row.Thing,
+					row.StartTime.UTC().Format(time.RFC3339),
+					formatProgram(row.Program),
+					row.Time.UTC().Format(time.RFC3339),
+					formatSeconds(row.Offset),
+					strconv.Itoa(int(row.Color)),
+				})
+				rows++
+			}
+		}
+		// Flush the rows of each thing, so that they are streamed.
+		writer.Flush()
+		return rows, writer.Error()
+	}
+}
@@ -5,10 +5,12 @@ go 1.19
 require (
 	github.com/eclipse/paho.mqtt.golang v1.4.2
 	github.com/paulmach/go.geojson v1.4.0
+	go.etcd.io/bbolt v1.3.7
 )
 
 require (
 	github.com/gorilla/websocket v1.5.0 // indirect
 	golang.org/x/net v0.23.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
 )
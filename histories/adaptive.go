@@ -0,0 +1,49 @@
+package histories
+
+import (
+	"predictor/calc"
+	"predictor/env"
+)
+
+// The length of new histories, and of all histories if no length bounds are configured.
+// A longer history will be more robust for statistical evaluation.
+// A shorter history will react faster to changes in the program behavior.
+const defaultHistoryLength = 10
+
+// Get the bounds of the adaptive history length.
+func lengthBounds() (minLength int, maxLength int) {
+	if env.HistoryMaxLength == 0 {
+		return defaultHistoryLength, defaultHistoryLength
+	}
+	return env.HistoryMinLength, env.HistoryMaxLength
+}
+
+// Get the maximum number of cycles of a history.
+func (h History) effectiveLength() int {
+	if h.Length == 0 {
+		return defaultHistoryLength
+	}
+	return h.Length
+}
+
+// Append a cycle to a history and adapt the length of the history.
+// The history grows while new cycles fall into the clusters of the previous cycles,
+// which is typical for fixed-time signals. If two cycles in a row diverge from
+// their predecessors, the behavior changed and the history is halved to react faster.
+func appendAdaptive(history History, newCycle HistoryCycle) History {
+	minLength, maxLength := lengthBounds()
+	length := history.effectiveLength()
+	newFlattened := History{Cycles: []HistoryCycle{newCycle}}.Flatten()
+	flattened := history.Flatten()
+	// Cycles that can't be flattened (e.g. too short) don't change the length.
+	if len(newFlattened) == 1 && len(flattened) > 0 {
+		if fitsAnyCluster(newFlattened[0], flattened) {
+			length++
+		} else if len(flattened) > 1 && !fitsAnyCluster(flattened[len(flattened)-1], flattened[:len(flattened)-1]) {
+			length /= 2
+		}
+	}
+	history.Length = calc.Max(minLength, calc.Min(length, maxLength))
+	history.Cycles = appendCycle(history.Cycles, newCycle, history.Length)
+	return history
+}
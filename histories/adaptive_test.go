@@ -0,0 +1,66 @@
+package histories
+
+import (
+	"predictor/env"
+	"testing"
+	"time"
+)
+
+// Make a cycle that is green for the given number of seconds and red for the rest of 90 seconds.
+func makeCycle(start int64, green int64) HistoryCycle {
+	return HistoryCycle{
+		StartTime: time.Unix(start, 0),
+		EndTime:   time.Unix(start+90, 0),
+		Phases: []HistoryPhaseEvent{
+			{Time: time.Unix(start, 0), Color: 3},
+			{Time: time.Unix(start+green, 0), Color: 1},
+		},
+	}
+}
+
+func TestAdaptiveLength(t *testing.T) {
+	env.HistoryMinLength, env.HistoryMaxLength = 4, 12
+	defer func() { env.HistoryMinLength, env.HistoryMaxLength = 0, 0 }()
+
+	// Similar cycles let the history grow up to the maximum length.
+	history := History{}
+	for i := int64(0); i < 20; i++ {
+		history = appendAdaptive(history, makeCycle(i*90, 30))
+	}
+	if history.Length != 12 || len(history.Cycles) != 12 {
+		t.Errorf("history should have grown to the maximum length: %d, %d cycles", history.Length, len(history.Cycles))
+		t.FailNow()
+	}
+
+	// A single outlier doesn't change the length.
+	history = appendAdaptive(history, makeCycle(20*90, 70))
+	if history.Length != 12 {
+		t.Errorf("outlier should not change the length: %d", history.Length)
+		t.FailNow()
+	}
+
+	// A second diverging cycle in a row halves the history.
+	history = appendAdaptive(history, makeCycle(21*90, 5))
+	if history.Length != 6 || len(history.Cycles) != 6 {
+		t.Errorf("history should have been halved: %d, %d cycles", history.Length, len(history.Cycles))
+		t.FailNow()
+	}
+
+	// The history doesn't shrink below the minimum length.
+	history = appendAdaptive(history, makeCycle(22*90, 50))
+	if history.Length != 4 || len(history.Cycles) != 4 {
+		t.Errorf("history should be bounded by the minimum length: %d", history.Length)
+		t.FailNow()
+	}
+}
+
+func TestFixedLengthWithoutBounds(t *testing.T) {
+	history := History{}
+	for i := int64(0); i < 20; i++ {
+		history = appendAdaptive(history, makeCycle(i*90, 30))
+	}
+	if history.Length != defaultHistoryLength || len(history.Cycles) != defaultHistoryLength {
+		t.Errorf("history should have the default length: %d", history.Length)
+		t.FailNow()
+	}
+}
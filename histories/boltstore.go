@@ -0,0 +1,159 @@
+package histories
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The bucket in which the histories are stored.
+var historiesBucket = []byte("histories")
+
+// A history store that keeps all histories in a single embedded database file.
+// Each append runs in its own transaction, so that a history is never partially written.
+type BoltStore struct {
+	db *bolt.DB
+	// The encoding in which the histories are written.
+	encoding string
+}
+
+// Open or create the database file of a bolt store, which writes histories in the given encoding.
+func OpenBoltStore(path string, encoding string) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		// The database is locked by another process, usually the running service.
+		return nil, fmt.Errorf("history database %s is locked by another process, stop the running predictor first", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historiesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db, encoding: encoding}, nil
+}
+
+// Open the database file of a bolt store only for reading, e.g. the database of another instance.
+// The file is not created or changed, and a database without histories has no keys.
+func OpenBoltStoreReadOnly(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0444, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("history database %s is locked by another process, stop the running predictor first", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db, encoding: EncodingJSON}, nil
+}
+
+// Load the history from the database.
+func (s *BoltStore) Load(key string) (History, error) {
+	var history History
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historiesBucket)
+		if bucket == nil {
+			return os.ErrNotExist
+		}
+		data := bucket.Get([]byte(key))
+		if data == nil {
+			return os.ErrNotExist
+		}
+		// The data is only valid within the transaction, and is copied when decoded.
+		decoded, err := decodeHistory(data)
+		history = decoded
+		return err
+	})
+	if err != nil {
+		return History{}, err
+	}
+	return history, nil
+}
+
+// Update the history within a single transaction.
+func (s *BoltStore) Update(key string, update func(History) History) (History, error) {
+	var history History
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historiesBucket)
+		// If no history exists yet, create a new one.
+		if data := bucket.Get([]byte(key)); data != nil {
+			if decoded, err := decodeHistory(data); err == nil {
+				history = decoded
+			}
+		}
+		history = update(history)
+		data, err := encodeHistory(history, s.encoding)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), data)
+	})
+	if err != nil {
+		return History{}, err
+	}
+	return history, nil
+}
+
+// Replace the history in the database.
+func (s *BoltStore) Save(key string, history History) error {
+	data, err := encodeHistory(history, s.encoding)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(historiesBucket).Put([]byte(key), data)
+	})
+}
+
+// Replace multiple histories in the database within a single transaction.
+func (s *BoltStore) SaveBatch(histories map[string]History) error {
+	encoded := make(map[string][]byte, len(histories))
+	for key, history := range histories {
+		data, err := encodeHistory(history, s.encoding)
+		if err != nil {
+			return err
+		}
+		encoded[key] = data
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historiesBucket)
+		for key, data := range encoded {
+			if err := bucket.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Get the keys of all histories in the database.
+func (s *BoltStore) Keys() ([]string, error) {
+	keys := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historiesBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// Close the database file.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
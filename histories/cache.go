@@ -1,118 +1,180 @@
 package histories
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"predictor/env"
 	"predictor/log"
 	"predictor/observations"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// The maximum length of the history files.
-// A longer history will be more robust for statistical evaluation.
-// A shorter history will react faster to changes in the program behavior.
-const maxHistoryLength = 10
-
-// The current histories by their file path.
-// The cache is used to speedup access to the history files.
+// The current histories by their key.
+// The cache is used to speedup access to the history store.
 var cache = sync.Map{}
 
-// Locks that must be used when writing or reading a history file.
-var historyFileLocks = &sync.Map{}
+// Locks that must be used when writing or reading a history.
+var historyLocks = &sync.Map{}
+
+// Get the lock of the history with the given key.
+func historyLock(key string) *sync.Mutex {
+	lock, _ := historyLocks.LoadOrStore(key, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
 
-// Append a new cycle to a new or existing history file.
-func appendToHistoryFile(path string, newCycle HistoryCycle) (History, error) {
-	// Unmarshal the history from the file, if it exists.
-	// If none exists, create a new history.
-	val, _ := cache.LoadOrStore(path, History{})
-	history := val.(History)
-	// Append the new cycle to the history.
-	history.Cycles = append(history.Cycles, newCycle)
-	// If the history is too long, remove the oldest cycles.
-	if len(history.Cycles) > maxHistoryLength {
-		history.Cycles = history.Cycles[len(history.Cycles)-maxHistoryLength:]
+// Append a cycle to the cycles of a history, dropping the oldest cycles if it is too long.
+// The cycles are copied, so that histories that were handed out before are not changed.
+func appendCycle(cycles []HistoryCycle, newCycle HistoryCycle, maxLength int) []HistoryCycle {
+	if len(cycles) >= maxLength {
+		cycles = cycles[len(cycles)-maxLength+1:]
 	}
-	// Acquire the file lock for additional safety.
-	lock, _ := historyFileLocks.LoadOrStore(path, &sync.Mutex{})
-	lock.(*sync.Mutex).Lock()
-	defer lock.(*sync.Mutex).Unlock()
-	// Make sure the directory exists, otherwise create it.
-	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	appended := make([]HistoryCycle, 0, len(cycles)+1)
+	appended = append(appended, cycles...)
+	return append(appended, newCycle)
+}
+
+// Append a new cycle to a new or existing history.
+// If a flush interval is configured, the history is only updated in the cache
+// and marked as dirty, otherwise it is written through to the store.
+func appendToHistory(key string, newCycle HistoryCycle) (History, error) {
+	history, err := appendToHistoryLocked(key, newCycle)
 	if err != nil {
-		log.Error.Println(err)
 		return History{}, err
 	}
-	// Marshal the history to the file.
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		log.Error.Println(err)
-		return History{}, err
+	indexHistory(key, history)
+	return history, nil
+}
+
+// Append a new cycle to a history while holding the lock of the history.
+func appendToHistoryLocked(key string, newCycle HistoryCycle) (History, error) {
+	lock := historyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	atomic.AddUint64(&HistoryCyclesAppended, 1)
+	if env.HistoryFlushInterval == 0 {
+		history, err := store.Update(key, func(history History) History {
+			return appendAdaptive(history, newCycle)
+		})
+		if err != nil {
+			log.Error.Println(err)
+			return History{}, err
+		}
+		cache.Store(key, history)
+		return history, nil
 	}
-	defer file.Close()
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(history)
-	if err != nil {
+	// The cache is the source of truth, so the store is only read for unknown histories.
+	// Only missing histories are started anew, since flushing an empty history
+	// after a read error would overwrite all stored cycles.
+	var history History
+	if historyFromCache, ok := cache.Load(key); ok {
+		history = historyFromCache.(History)
+	} else if historyFromStore, err := store.Load(key); err == nil {
+		history = historyFromStore
+	} else if !errors.Is(err, os.ErrNotExist) {
 		log.Error.Println(err)
 		return History{}, err
 	}
-
-	cache.Store(path, history)
+	history = appendAdaptive(history, newCycle)
+	cache.Store(key, history)
+	markDirty(key)
 	return history, nil
 }
 
-// Load a history from a file path (or directly from the cache).
-func LoadHistory(path string) (History, error) {
-	historyFromCache, ok := cache.Load(path)
+// Load a history by its key from the store (or directly from the cache).
+func LoadHistory(key string) (History, error) {
+	historyFromCache, ok := cache.Load(key)
 	if ok {
 		return historyFromCache.(History), nil
 	}
-	// Load the history from the file and populate the cache.
-	lock, _ := historyFileLocks.LoadOrStore(path, &sync.Mutex{})
-	lock.(*sync.Mutex).Lock()
-	defer lock.(*sync.Mutex).Unlock()
-	// Load the history from the file.
-	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	// Load the history from the store and populate the cache.
+	lock := historyLock(key)
+	lock.Lock()
+	historyFromStore, err := store.Load(key)
 	if err != nil {
+		lock.Unlock()
 		return History{}, err
 	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	var historyFromFile History
-	err = decoder.Decode(&historyFromFile)
+	cache.Store(key, historyFromStore)
+	lock.Unlock()
+	indexHistory(key, historyFromStore)
+	return historyFromStore, nil
+}
+
+// Load a history by its key from the cache or the store, without populating the cache.
+// This is useful for bulk reads, e.g. exports, that should not keep all histories in memory.
+func PeekHistory(key string) (History, error) {
+	if historyFromCache, ok := cache.Load(key); ok {
+		return historyFromCache.(History), nil
+	}
+	lock := historyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	return store.Load(key)
+}
+
+// Get the keys of all histories, in the store and not yet flushed from the cache.
+func Keys() ([]string, error) {
+	keys, err := store.Keys()
 	if err != nil {
-		return History{}, err
+		return nil, err
+	}
+	known := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		known[key] = true
 	}
-	// Populate the cache.
-	cache.Store(path, historyFromFile)
-	return historyFromFile, nil
+	cache.Range(func(key, _ interface{}) bool {
+		if !known[key.(string)] {
+			keys = append(keys, key.(string))
+		}
+		return true
+	})
+	return keys, nil
 }
 
 // Interface to overwrite for tests.
 var getCurrentProgram = observations.GetCurrentProgram
 
+// Interface to overwrite for tests.
+var now = time.Now
+
 // Load the best fitting history for a given thing name.
 // This will lookup the program currently running on the thing and load the corresponding history.
-// If no such history exists, it will load the default history.
+// If segmentation is enabled, the history of the current day type and time window is preferred.
+// If no such history exists, it will fall back to the less specific histories, down to the default history.
 func LoadBestFittingHistory(thingName string) (history History, programId *byte, err error) {
-	programsToSearch := []*byte{}
 	// Lookup the last running program.
+	var currentProgram *byte
 	if programObservation, ok := getCurrentProgram(thingName); ok {
-		programsToSearch = append(programsToSearch, &programObservation.Result)
+		currentProgram = &programObservation.Result
+	}
+	return LoadBestFittingHistoryForProgram(thingName, currentProgram)
+}
+
+// Load the best fitting history for a given thing name and its currently running program.
+// The program may be nil if it is unknown. This is useful if the program was already
+// looked up in a snapshot, which must be consistent with other layers.
+func LoadBestFittingHistoryForProgram(thingName string, currentProgram *byte) (history History, programId *byte, err error) {
+	programsToSearch := []*byte{}
+	if currentProgram != nil {
+		programsToSearch = append(programsToSearch, currentProgram)
 	}
 	programsToSearch = append(programsToSearch, nil)
+	segments := segmentsAt(now())
 	for _, programId := range programsToSearch {
-		var path = fmt.Sprintf("%s/history/%s.json", env.StaticPath, thingName)
-		if programId != nil {
-			path = fmt.Sprintf("%s/history/%s-P%d.json", env.StaticPath, thingName, *programId)
-		}
-		history, err := LoadHistory(path)
-		if err != nil {
-			continue
+		for _, segment := range segments {
+			history, err := LoadHistory(historyKey(thingName, programId, segment))
+			if err != nil {
+				continue
+			}
+			// Segmented histories take a while to fill, so skip them until they have enough cycles.
+			if segment != "" && len(history.Cycles) < minSegmentCycles {
+				continue
+			}
+			return history, programId, nil
 		}
-		return history, programId, nil
 	}
 	return History{}, nil, fmt.Errorf("no history found for thing %s", thingName)
 }
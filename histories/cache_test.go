@@ -11,8 +11,8 @@ import (
 
 func TestHistoryFileConcurrentWriteAndLoad(t *testing.T) {
 	var concurrent uint = 0
-	tempDir := t.TempDir()
-	mockFilePath := fmt.Sprintf("%s/h.json", tempDir)
+	env.StaticPath = t.TempDir()
+	mockKey := "h"
 
 	var wg sync.WaitGroup
 	for {
@@ -21,11 +21,11 @@ func TestHistoryFileConcurrentWriteAndLoad(t *testing.T) {
 		}
 		wg.Add(1)
 		go func() {
-			appendToHistoryFile(mockFilePath, HistoryCycle{
+			appendToHistory(mockKey, HistoryCycle{
 				StartTime: time.Now(), // Just to have some variation in the writes
 			})
 			go func() {
-				_, err := LoadHistory(mockFilePath)
+				_, err := LoadHistory(mockKey)
 				if err != nil {
 					t.Fail()
 				}
@@ -39,14 +39,14 @@ func TestHistoryFileConcurrentWriteAndLoad(t *testing.T) {
 
 func TestBypassCache(t *testing.T) {
 	var runs uint = 0
-	tempDir := t.TempDir()
-	mockFilePath := fmt.Sprintf("%s/h.json", tempDir)
+	env.StaticPath = t.TempDir()
+	mockKey := "h"
 
 	for {
 		if runs > 10_000 {
 			break
 		}
-		appendToHistoryFile(mockFilePath, HistoryCycle{
+		appendToHistory(mockKey, HistoryCycle{
 			StartTime: time.Now(), // Just to have some variation in the writes
 		})
 		// Cleanup the cache to load from filesystem
@@ -54,7 +54,7 @@ func TestBypassCache(t *testing.T) {
 			cache.Delete(key)
 			return true
 		})
-		_, err := LoadHistory(mockFilePath)
+		_, err := LoadHistory(mockKey)
 		if err != nil {
 			t.Fail()
 		}
@@ -66,20 +66,20 @@ func TestLoadBestHistory(t *testing.T) {
 	tempDir := t.TempDir()
 	env.StaticPath = tempDir
 
-	unspecificHistoryFile := fmt.Sprintf("%s/history/%s", tempDir, "1337_1.json")
-	specificHistoryFile := fmt.Sprintf("%s/history/%s-P%d.json", tempDir, "1337_1", 123)
+	unspecificHistoryKey := "1337_1"
+	specificHistoryKey := fmt.Sprintf("%s-P%d", "1337_1", 123)
 	unspecificHistoryCycle1 := HistoryCycle{
 		StartTime: time.Now(),
 	}
 	specificHistoryCycle1 := HistoryCycle{
 		StartTime: time.Now(),
 	}
-	_, err := appendToHistoryFile(unspecificHistoryFile, unspecificHistoryCycle1)
+	_, err := appendToHistory(unspecificHistoryKey, unspecificHistoryCycle1)
 	if err != nil {
 		t.Errorf(err.Error())
 		t.FailNow()
 	}
-	_, err = appendToHistoryFile(specificHistoryFile, specificHistoryCycle1)
+	_, err = appendToHistory(specificHistoryKey, specificHistoryCycle1)
 	if err != nil {
 		t.Errorf(err.Error())
 		t.FailNow()
@@ -111,3 +111,24 @@ func TestLoadBestHistory(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestPeekHistory(t *testing.T) {
+	fileStore := &FileStore{Dir: t.TempDir()}
+	store = fileStore
+	defer func() { store = &FileStore{} }()
+	defer cache.Delete("1337_peek")
+
+	if err := fileStore.Save("1337_peek", History{Cycles: []HistoryCycle{{StartTime: time.Unix(1, 0)}}}); err != nil {
+		t.Errorf("could not save history: %v", err)
+		t.FailNow()
+	}
+	history, err := PeekHistory("1337_peek")
+	if err != nil || len(history.Cycles) != 1 {
+		t.Errorf("unexpected history: %v, %v", history, err)
+		t.FailNow()
+	}
+	if _, ok := cache.Load("1337_peek"); ok {
+		t.Errorf("peeked history should not be cached")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,70 @@
+package histories
+
+import (
+	"predictor/calc"
+	"sort"
+)
+
+// The max cluster distance defines how far apart two cycles can be
+// to be considered in the same cluster. Note that with a very
+// high value, two distinct programs will be mixed together. This
+// makes the prediction more robust against noise, but less agile.
+// Thus we need to find a good balance.
+const MaxClusterDistance = 20 // Seconds
+
+// An O(n) distance function between two phase arrays.
+func Distance(a []byte, b []byte) int {
+	lenA := len(a)
+	lenB := len(b)
+	if lenA == 0 {
+		return lenB
+	}
+	if lenB == 0 {
+		return lenA
+	}
+	var diff = 0
+	for i := 0; i < calc.Min(lenA, lenB); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		diff++
+	}
+	return diff + calc.Abs(lenA-lenB)
+}
+
+// If a flattened cycle would fall into the same cluster as any of the other cycles.
+func fitsAnyCluster(flattened []byte, others [][]byte) bool {
+	for _, other := range others {
+		if Distance(flattened, other) < MaxClusterDistance {
+			return true
+		}
+	}
+	return false
+}
+
+// Cluster a flattened history.
+// Returns the clusters ordered descending by size.
+func Cluster(flattened [][]byte) [][][]byte {
+	if len(flattened) == 0 {
+		return [][][]byte{}
+	}
+	clusters := [][][]byte{}
+	for _, colors := range flattened {
+		clustered := false
+		for i, cluster := range clusters {
+			if Distance(cluster[0], colors) < MaxClusterDistance {
+				clusters[i] = append(cluster, colors)
+				clustered = true
+				break
+			}
+		}
+		if !clustered {
+			clusters = append(clusters, [][]byte{colors})
+		}
+	}
+	// Sort the clusters by size.
+	sort.Slice(clusters, func(i, j int) bool {
+		return len(clusters[i]) > len(clusters[j])
+	})
+	return clusters
+}
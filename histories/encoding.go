@@ -0,0 +1,244 @@
+package histories
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The encodings in which histories can be stored.
+const (
+	// Human readable json, which can be read by the cycle analyzer.
+	EncodingJSON = "json"
+	// Compact binary, with delta-encoded timestamps and one byte per color and percentage.
+	EncodingBinary = "binary"
+)
+
+// The magic bytes at the beginning of a binary encoded history.
+// Json always starts with a bracket or whitespace, so the encodings can be told apart.
+var binaryMagic = []byte("PHIS")
+
+// The version of the binary encoding, written after the magic bytes.
+// Version 2 added the adaptive length of the history, version 1 can still be decoded.
+const binaryVersion byte = 2
+
+// Encode a history in the given encoding.
+func encodeHistory(history History, encoding string) ([]byte, error) {
+	switch encoding {
+	case EncodingJSON:
+		return json.Marshal(history)
+	case EncodingBinary:
+		return encodeBinary(history), nil
+	}
+	return nil, fmt.Errorf("unknown history encoding: %s", encoding)
+}
+
+// Decode a history, detecting its encoding from the data.
+func decodeHistory(data []byte) (History, error) {
+	if bytes.HasPrefix(data, binaryMagic) {
+		return decodeBinary(data)
+	}
+	var history History
+	if err := json.Unmarshal(data, &history); err != nil {
+		return History{}, err
+	}
+	return history, nil
+}
+
+// Encode a history in the compact binary format.
+// All timestamps are stored in milliseconds. The start time of each cycle is stored
+// as is, all other timestamps as the difference to the previous timestamp. The signal
+// names of the detection events are stored once in a table and referenced by index.
+func encodeBinary(history History) []byte {
+	buf := make([]byte, 0, 64*len(history.Cycles))
+	buf = append(buf, binaryMagic...)
+	buf = append(buf, binaryVersion)
+
+	signals := []string{}
+	signalIndices := map[string]uint64{}
+	for _, cycle := range history.Cycles {
+		for _, events := range [][]HistoryDetectionEvent{cycle.Cars, cycle.Bikes} {
+			for _, event := range events {
+				if _, ok := signalIndices[event.Signal]; !ok {
+					signalIndices[event.Signal] = uint64(len(signals))
+					signals = append(signals, event.Signal)
+				}
+			}
+		}
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(signals)))
+	for _, signal := range signals {
+		buf = binary.AppendUvarint(buf, uint64(len(signal)))
+		buf = append(buf, signal...)
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(history.Length))
+	buf = binary.AppendUvarint(buf, uint64(len(history.Cycles)))
+	for _, cycle := range history.Cycles {
+		start := cycle.StartTime.UnixMilli()
+		buf = binary.AppendVarint(buf, start)
+		buf = binary.AppendVarint(buf, cycle.EndTime.UnixMilli()-start)
+		if cycle.Program == nil {
+			buf = append(buf, 0)
+		} else {
+			buf = append(buf, 1, *cycle.Program)
+		}
+		prev := start
+		buf = binary.AppendUvarint(buf, uint64(len(cycle.Phases)))
+		for _, phase := range cycle.Phases {
+			buf = binary.AppendVarint(buf, phase.Time.UnixMilli()-prev)
+			buf = append(buf, phase.Color)
+			prev = phase.Time.UnixMilli()
+		}
+		for _, events := range [][]HistoryDetectionEvent{cycle.Cars, cycle.Bikes} {
+			prev = start
+			buf = binary.AppendUvarint(buf, uint64(len(events)))
+			for _, event := range events {
+				buf = binary.AppendVarint(buf, event.Time.UnixMilli()-prev)
+				buf = binary.AppendUvarint(buf, signalIndices[event.Signal])
+				buf = append(buf, event.Pct)
+				prev = event.Time.UnixMilli()
+			}
+		}
+	}
+	return buf
+}
+
+// A reader for the binary format that remembers the first error.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+// Read a signed varint.
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("invalid varint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// Read an unsigned varint.
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("invalid varint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// Read an unsigned varint that is used as a length, bounded by the remaining data.
+// This avoids huge allocations when decoding corrupt data.
+func (r *binaryReader) length() int {
+	v := r.uvarint()
+	if r.err == nil && v > uint64(len(r.data)) {
+		r.err = fmt.Errorf("invalid length: %d", v)
+		return 0
+	}
+	return int(v)
+}
+
+// Read a single byte.
+func (r *binaryReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) == 0 {
+		r.err = fmt.Errorf("unexpected end of data")
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+// Read a number of raw bytes.
+func (r *binaryReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = fmt.Errorf("unexpected end of data")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// Decode a history from the compact binary format.
+func decodeBinary(data []byte) (History, error) {
+	if !bytes.HasPrefix(data, binaryMagic) || len(data) <= len(binaryMagic) {
+		return History{}, fmt.Errorf("missing binary history header")
+	}
+	version := data[len(binaryMagic)]
+	if version < 1 || version > binaryVersion {
+		return History{}, fmt.Errorf("unsupported binary history version: %d", version)
+	}
+	r := &binaryReader{data: data[len(binaryMagic)+1:]}
+
+	signals := make([]string, r.length())
+	for i := range signals {
+		signals[i] = string(r.bytes(r.length()))
+	}
+
+	var length int
+	if version >= 2 {
+		length = int(r.uvarint())
+	}
+	history := History{Length: length}
+	history.Cycles = make([]HistoryCycle, r.length())
+	for i := range history.Cycles {
+		cycle := &history.Cycles[i]
+		start := r.varint()
+		cycle.StartTime = time.UnixMilli(start).UTC()
+		cycle.EndTime = time.UnixMilli(start + r.varint()).UTC()
+		if r.byte() == 1 {
+			program := r.byte()
+			cycle.Program = &program
+		}
+		prev := start
+		cycle.Phases = make([]HistoryPhaseEvent, r.length())
+		for j := range cycle.Phases {
+			prev += r.varint()
+			cycle.Phases[j] = HistoryPhaseEvent{Time: time.UnixMilli(prev).UTC(), Color: r.byte()}
+		}
+		for _, events := range []*[]HistoryDetectionEvent{&cycle.Cars, &cycle.Bikes} {
+			prev = start
+			*events = make([]HistoryDetectionEvent, r.length())
+			for j := range *events {
+				prev += r.varint()
+				event := HistoryDetectionEvent{Time: time.UnixMilli(prev).UTC()}
+				index := r.uvarint()
+				if r.err == nil && index >= uint64(len(signals)) {
+					r.err = fmt.Errorf("invalid signal index: %d", index)
+				}
+				if r.err == nil {
+					event.Signal = signals[index]
+				}
+				event.Pct = r.byte()
+				(*events)[j] = event
+			}
+		}
+		if r.err != nil {
+			break
+		}
+	}
+	if r.err != nil {
+		return History{}, fmt.Errorf("corrupt binary history: %v", r.err)
+	}
+	return history, nil
+}
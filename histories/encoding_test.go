@@ -0,0 +1,95 @@
+package histories
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBinaryEncoding(t *testing.T) {
+	program := byte(3)
+	history := History{Cycles: []HistoryCycle{
+		{
+			StartTime: time.Unix(1000, 0).UTC(),
+			EndTime:   time.Unix(1090, 0).UTC(),
+			Program:   &program,
+			Phases: []HistoryPhaseEvent{
+				{Time: time.Unix(995, 0).UTC(), Color: 1}, // Before the cycle started
+				{Time: time.Unix(1010, 500_000_000).UTC(), Color: 3},
+			},
+			Cars:  []HistoryDetectionEvent{{Time: time.Unix(1020, 0).UTC(), Signal: "96_22", Pct: 100}},
+			Bikes: []HistoryDetectionEvent{{Time: time.Unix(1030, 0).UTC(), Signal: "96_23", Pct: 50}},
+		},
+		{
+			StartTime: time.Unix(1090, 0).UTC(),
+			EndTime:   time.Unix(1180, 0).UTC(),
+			Phases:    []HistoryPhaseEvent{},
+			Cars:      []HistoryDetectionEvent{{Time: time.Unix(1100, 0).UTC(), Signal: "96_22", Pct: 0}},
+			Bikes:     []HistoryDetectionEvent{},
+		},
+	}, Length: 17}
+
+	data, err := encodeHistory(history, EncodingBinary)
+	if err != nil {
+		t.Errorf("could not encode history: %s", err)
+		t.FailNow()
+	}
+	jsonData, _ := encodeHistory(history, EncodingJSON)
+	if len(data) >= len(jsonData)/4 {
+		t.Errorf("binary encoding is not compact: %d bytes vs %d bytes json", len(data), len(jsonData))
+		t.FailNow()
+	}
+	decoded, err := decodeHistory(data)
+	if err != nil {
+		t.Errorf("could not decode history: %s", err)
+		t.FailNow()
+	}
+	// Using deep equals in the test is fine
+	if !reflect.DeepEqual(history, decoded) {
+		t.Errorf("decoded history does not correspond to encoded history: %v != %v", decoded, history)
+		t.FailNow()
+	}
+	// Json is still detected and decoded.
+	decoded, err = decodeHistory(jsonData)
+	if err != nil || len(decoded.Cycles) != 2 {
+		t.Errorf("could not decode json history: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestBinaryEncodingCorrupt(t *testing.T) {
+	data := encodeBinary(History{Cycles: []HistoryCycle{{
+		StartTime: time.Unix(1000, 0),
+		EndTime:   time.Unix(1090, 0),
+		Phases:    []HistoryPhaseEvent{{Time: time.Unix(1010, 0), Color: 3}},
+	}}})
+	for i := len(binaryMagic) + 1; i < len(data); i++ {
+		if _, err := decodeHistory(data[:i]); err == nil {
+			t.Errorf("truncated history at %d bytes should not decode", i)
+			t.FailNow()
+		}
+	}
+	data[len(binaryMagic)] = binaryVersion + 1
+	if _, err := decodeHistory(data); err == nil {
+		t.Errorf("unknown version should not decode")
+		t.FailNow()
+	}
+}
+
+func TestBinaryEncodingVersion1(t *testing.T) {
+	data := encodeBinary(History{Cycles: []HistoryCycle{{
+		StartTime: time.Unix(1000, 0),
+		EndTime:   time.Unix(1090, 0),
+	}}})
+	// Version 1 has no length after the (empty) signal table.
+	headerLength := len(binaryMagic) + 1
+	v1 := append([]byte{}, data[:headerLength]...)
+	v1[len(binaryMagic)] = 1
+	v1 = append(v1, data[headerLength])
+	v1 = append(v1, data[headerLength+2:]...)
+	history, err := decodeHistory(v1)
+	if err != nil || history.Length != 0 || len(history.Cycles) != 1 || history.Cycles[0].EndTime.Unix() != 1090 {
+		t.Errorf("could not decode version 1: %v, %v", history, err)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,16 @@
+package histories
+
+import "predictor/events"
+
+// A completed cycle that was appended to the history of a thing.
+type HistoryUpdated struct {
+	// The name of the thing.
+	Thing string
+	// The cycle that was appended.
+	Cycle HistoryCycle
+	// The updated history.
+	History History
+}
+
+// The bus on which history updates are published.
+var HistoryUpdatedBus = events.NewBus[HistoryUpdated]("history_updated")
@@ -0,0 +1,227 @@
+package histories
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"predictor/env"
+	"predictor/log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The number of corrupt history files that were quarantined.
+var HistoryFilesCorrupted uint64 = 0
+
+// The number of history files that were recovered from their backup.
+var HistoryFilesRecovered uint64 = 0
+
+// A history store that writes each history into its own file.
+// Json files can be served directly to the cycle analyzer.
+type FileStore struct {
+	// The directory of the history files.
+	// If empty, the history directory under the static path is used.
+	Dir string
+	// The encoding in which the history files are written.
+	// If empty, the histories are written as json.
+	Encoding string
+}
+
+// Get the directory of the history files.
+func (s *FileStore) dir() string {
+	if s.Dir != "" {
+		return s.Dir
+	}
+	return fmt.Sprintf("%s/history", env.StaticPath)
+}
+
+// Get the encoding of the history files.
+func (s *FileStore) encoding() string {
+	if s.Encoding != "" {
+		return s.Encoding
+	}
+	return EncodingJSON
+}
+
+// Get the file extension of the history files, which depends on their encoding.
+func (s *FileStore) extension() string {
+	if s.encoding() == EncodingBinary {
+		return ".hist"
+	}
+	return ".json"
+}
+
+// Get the path of the history file with the given key.
+func (s *FileStore) path(key string) string {
+	return fmt.Sprintf("%s/%s%s", s.dir(), key, s.extension())
+}
+
+// Load the history from its file.
+// If the file is corrupt, it is quarantined and the history is recovered from the backup.
+func (s *FileStore) Load(key string) (History, error) {
+	path := s.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		// A crash between the renames of a write may leave only the backup.
+		if !os.IsNotExist(err) {
+			return History{}, err
+		}
+		if _, bakErr := os.Stat(path + ".bak"); bakErr != nil {
+			return History{}, err
+		}
+		return s.recover(key)
+	}
+	history, err := decodeHistory(data)
+	if err == nil {
+		return history, nil
+	}
+	// Move the corrupt file aside, so that it can be inspected later.
+	atomic.AddUint64(&HistoryFilesCorrupted, 1)
+	log.Warning.Printf("History file %s is corrupt: %v", path, err)
+	corruptPath := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+	if err := os.Rename(path, corruptPath); err != nil {
+		log.Error.Println("Could not quarantine corrupt history file:", err)
+	}
+	return s.recover(key)
+}
+
+// Recover a history from its backup file and restore the history file.
+func (s *FileStore) recover(key string) (History, error) {
+	path := s.path(key)
+	history, err := decodeHistoryFile(path + ".bak")
+	if err != nil {
+		return History{}, fmt.Errorf("could not recover history %s from backup: %v", key, err)
+	}
+	if err := s.write(path, history); err != nil {
+		return History{}, fmt.Errorf("could not restore history %s from backup: %v", key, err)
+	}
+	atomic.AddUint64(&HistoryFilesRecovered, 1)
+	log.Info.Printf("Recovered history file %s from backup.", path)
+	return history, nil
+}
+
+// Decode a history from a file in any encoding.
+func decodeHistoryFile(path string) (History, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return History{}, err
+	}
+	return decodeHistory(data)
+}
+
+// Update the history file, which is rewritten as a whole.
+func (s *FileStore) Update(key string, update func(History) History) (History, error) {
+	// If no history exists yet, create a new one.
+	history, err := s.Load(key)
+	if err != nil {
+		history = History{}
+	}
+	history = update(history)
+	if err := s.Save(key, history); err != nil {
+		return History{}, err
+	}
+	return history, nil
+}
+
+// Write the history into its file.
+// The previous version of the file is kept as a backup.
+func (s *FileStore) Save(key string, history History) error {
+	path := s.path(key)
+	// Make sure the directory exists, otherwise create it.
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	// Corrupt files are quarantined when loaded, so the previous version can be kept as is.
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, path+".bak"); err != nil {
+			return err
+		}
+	}
+	return s.write(path, history)
+}
+
+// Encode a history and write it atomically to the given path.
+func (s *FileStore) write(path string, history History) error {
+	data, err := encodeHistory(history, s.encoding())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, data)
+}
+
+// Write data into a temporary file and rename it to the target path.
+// Since the rename is atomic, the target is never left empty or partially written.
+func writeFileAtomically(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	// Make sure the data is on the disk before the file is renamed.
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	// The rename is only durable once the directory entry is on the disk.
+	return syncDir(filepath.Dir(path))
+}
+
+// Flush the entries of a directory to the disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Write multiple histories into their files.
+// The files are written one by one, so a failed batch may be partially written.
+func (s *FileStore) SaveBatch(histories map[string]History) error {
+	var firstErr error
+	for key, history := range histories {
+		if err := s.Save(key, history); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Get the keys of all history files in the directory.
+func (s *FileStore) Keys() ([]string, error) {
+	entries, err := os.ReadDir(s.dir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	keys := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), s.extension()) {
+			continue
+		}
+		keys = append(keys, strings.TrimSuffix(entry.Name(), s.extension()))
+	}
+	return keys, nil
+}
+
+// The file store holds no resources.
+func (s *FileStore) Close() error {
+	return nil
+}
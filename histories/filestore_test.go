@@ -0,0 +1,87 @@
+package histories
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStoreKeepsBackup(t *testing.T) {
+	s := &FileStore{Dir: t.TempDir()}
+	s.Update("1337_1", appendTo(HistoryCycle{StartTime: time.Unix(1, 0)}, 10))
+	s.Update("1337_1", appendTo(HistoryCycle{StartTime: time.Unix(2, 0)}, 10))
+
+	backup, err := decodeHistoryFile(s.path("1337_1") + ".bak")
+	if err != nil || len(backup.Cycles) != 1 {
+		t.Errorf("previous version was not kept as backup: %v, %v", backup, err)
+		t.FailNow()
+	}
+	if _, err := os.Stat(s.path("1337_1") + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file was not renamed")
+		t.FailNow()
+	}
+}
+
+func TestFileStoreRecoversCorruptFile(t *testing.T) {
+	s := &FileStore{Dir: t.TempDir()}
+	s.Update("1337_1", appendTo(HistoryCycle{StartTime: time.Unix(1, 0)}, 10))
+	s.Update("1337_1", appendTo(HistoryCycle{StartTime: time.Unix(2, 0)}, 10))
+	// Simulate a partial write.
+	if err := os.WriteFile(s.path("1337_1"), []byte(`{"cycles":[{"sta`), 0644); err != nil {
+		t.Errorf("could not corrupt history file: %s", err)
+		t.FailNow()
+	}
+
+	corrupted, recovered := HistoryFilesCorrupted, HistoryFilesRecovered
+	history, err := s.Load("1337_1")
+	if err != nil || len(history.Cycles) != 1 {
+		t.Errorf("history was not recovered from backup: %v, %v", history, err)
+		t.FailNow()
+	}
+	if HistoryFilesCorrupted != corrupted+1 || HistoryFilesRecovered != recovered+1 {
+		t.Errorf("recovery was not counted")
+		t.FailNow()
+	}
+	quarantined, _ := filepath.Glob(s.path("1337_1") + ".corrupt-*")
+	if len(quarantined) != 1 {
+		t.Errorf("corrupt file was not quarantined")
+		t.FailNow()
+	}
+	// The restored file can be loaded without the backup.
+	if _, err := decodeHistoryFile(s.path("1337_1")); err != nil {
+		t.Errorf("history file was not restored: %s", err)
+		t.FailNow()
+	}
+}
+
+func TestFileStoreRecoversMissingFile(t *testing.T) {
+	s := &FileStore{Dir: t.TempDir()}
+	s.Update("1337_1", appendTo(HistoryCycle{StartTime: time.Unix(1, 0)}, 10))
+	s.Update("1337_1", appendTo(HistoryCycle{StartTime: time.Unix(2, 0)}, 10))
+	// Simulate a crash between the renames of a write.
+	os.Remove(s.path("1337_1"))
+
+	history, err := s.Load("1337_1")
+	if err != nil || len(history.Cycles) != 1 {
+		t.Errorf("history was not recovered from backup: %v, %v", history, err)
+		t.FailNow()
+	}
+}
+
+func TestFileStoreDoesNotQuarantineUnreadableFile(t *testing.T) {
+	s := &FileStore{Dir: t.TempDir()}
+	// A directory in place of the file can't be read, but it isn't corrupt.
+	os.MkdirAll(s.path("1337_1"), os.ModePerm)
+
+	corrupted := HistoryFilesCorrupted
+	if _, err := s.Load("1337_1"); err == nil {
+		t.Errorf("loading an unreadable history should fail")
+		t.FailNow()
+	}
+	quarantined, _ := filepath.Glob(s.path("1337_1") + ".corrupt-*")
+	if HistoryFilesCorrupted != corrupted || len(quarantined) != 0 {
+		t.Errorf("unreadable file was quarantined")
+		t.FailNow()
+	}
+}
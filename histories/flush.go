@@ -0,0 +1,106 @@
+package histories
+
+import (
+	"predictor/env"
+	"predictor/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The keys of the histories in the cache that were not yet written to the store.
+var dirty = &sync.Map{}
+
+// The number of dirty histories.
+var numDirty int64 = 0
+
+// The number of cycles that were appended to a history, in the cache or the store.
+// Compared with the written histories, this shows how many writes the write-behind saves.
+var HistoryCyclesAppended uint64 = 0
+
+// The number of histories that were written to the store by a flush.
+var HistoryFlushesWritten uint64 = 0
+
+// The number of histories that could not be written to the store by a flush.
+var HistoryFlushesFailed uint64 = 0
+
+// The duration of the last flush in milliseconds.
+var HistoryFlushDurationMs int64 = 0
+
+// The lock that ensures that only one flush runs at a time.
+var flushLock = &sync.Mutex{}
+
+// Mark a history as dirty, so that it is written with the next flush.
+func markDirty(key string) {
+	if _, loaded := dirty.LoadOrStore(key, true); !loaded {
+		atomic.AddInt64(&numDirty, 1)
+	}
+}
+
+// Get the number of histories that were not yet written to the store.
+func CountDirty() int64 {
+	return atomic.LoadInt64(&numDirty)
+}
+
+// Write all dirty histories from the cache to the store in a single batch.
+// Histories that could not be written stay dirty and are retried with the next flush.
+func FlushHistories() error {
+	flushLock.Lock()
+	defer flushLock.Unlock()
+	start := time.Now()
+
+	batch := map[string]History{}
+	dirty.Range(func(key, _ interface{}) bool {
+		// Take the lock, so that no cycle is appended between reading and unmarking.
+		lock := historyLock(key.(string))
+		lock.Lock()
+		if history, ok := cache.Load(key); ok {
+			batch[key.(string)] = history.(History)
+		}
+		dirty.Delete(key)
+		atomic.AddInt64(&numDirty, -1)
+		lock.Unlock()
+		return true
+	})
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if err := store.SaveBatch(batch); err != nil {
+		log.Error.Printf("Could not flush %d histories: %v", len(batch), err)
+		atomic.AddUint64(&HistoryFlushesFailed, uint64(len(batch)))
+		for key := range batch {
+			markDirty(key)
+		}
+		atomic.StoreInt64(&HistoryFlushDurationMs, time.Since(start).Milliseconds())
+		return err
+	}
+	atomic.AddUint64(&HistoryFlushesWritten, uint64(len(batch)))
+	atomic.StoreInt64(&HistoryFlushDurationMs, time.Since(start).Milliseconds())
+	return nil
+}
+
+// Flush the dirty histories periodically.
+// If no flush interval is configured, the histories are written through and nothing is done.
+func FlushHistoriesPeriodically() {
+	if env.HistoryFlushInterval == 0 {
+		return
+	}
+	for {
+		time.Sleep(env.HistoryFlushInterval)
+		FlushHistories()
+	}
+}
+
+// Flush the dirty histories if the calling goroutine panics, and panic again.
+// A panic exits the process without the shutdown handler, which would lose all
+// cycles since the last flush. This must be deferred directly, e.g. `defer FlushOnPanic()`.
+func FlushOnPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	log.Error.Printf("Flushing histories after panic: %v", r)
+	FlushHistories()
+	panic(r)
+}
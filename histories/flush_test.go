@@ -0,0 +1,118 @@
+package histories
+
+import (
+	"os"
+	"predictor/env"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriteBehind(t *testing.T) {
+	env.HistoryFlushInterval = time.Minute
+	defer func() { env.HistoryFlushInterval = 0 }()
+	fileStore := &FileStore{Dir: t.TempDir()}
+	store = fileStore
+	defer func() { store = &FileStore{} }()
+	defer cache.Delete("1337_flush")
+
+	appendToHistory("1337_flush", HistoryCycle{StartTime: time.Unix(1, 0)})
+	history, err := appendToHistory("1337_flush", HistoryCycle{StartTime: time.Unix(2, 0)})
+	if err != nil || len(history.Cycles) != 2 {
+		t.Errorf("unexpected history: %v, %v", history, err)
+		t.FailNow()
+	}
+	// The history is only in the cache until it is flushed.
+	if _, err := fileStore.Load("1337_flush"); err == nil {
+		t.Errorf("history was written before the flush")
+		t.FailNow()
+	}
+	if loaded, err := LoadHistory("1337_flush"); err != nil || len(loaded.Cycles) != 2 {
+		t.Errorf("history is not served from the cache: %v, %v", loaded, err)
+		t.FailNow()
+	}
+	if CountDirty() != 1 {
+		t.Errorf("unexpected number of dirty histories: %d", CountDirty())
+		t.FailNow()
+	}
+
+	written := HistoryFlushesWritten
+	FlushHistories()
+	if CountDirty() != 0 || HistoryFlushesWritten != written+1 {
+		t.Errorf("history was not flushed")
+		t.FailNow()
+	}
+	flushed, err := fileStore.Load("1337_flush")
+	if err != nil || len(flushed.Cycles) != 2 {
+		t.Errorf("flushed history was not written: %v, %v", flushed, err)
+		t.FailNow()
+	}
+}
+
+func TestWriteBehindRetriesFailedFlush(t *testing.T) {
+	env.HistoryFlushInterval = time.Minute
+	defer func() { env.HistoryFlushInterval = 0 }()
+	fileStore := &FileStore{Dir: t.TempDir()}
+	store = fileStore
+	defer func() { store = &FileStore{} }()
+	defer cache.Delete("1337_flush_failed")
+
+	appendToHistory("1337_flush_failed", HistoryCycle{StartTime: time.Unix(1, 0)})
+	// The directory can't be created below a file.
+	fileStore.Dir = "/dev/null/history"
+	failed := HistoryFlushesFailed
+	FlushHistories()
+	if HistoryFlushesFailed != failed+1 || CountDirty() != 1 {
+		t.Errorf("failed flush was not counted or the history is not dirty anymore")
+		t.FailNow()
+	}
+	dirty.Delete("1337_flush_failed")
+	atomic.AddInt64(&numDirty, -1)
+}
+
+func TestWriteBehindKeepsUnreadableHistory(t *testing.T) {
+	env.HistoryFlushInterval = time.Minute
+	defer func() { env.HistoryFlushInterval = 0 }()
+	fileStore := &FileStore{Dir: t.TempDir()}
+	store = fileStore
+	defer func() { store = &FileStore{} }()
+	defer cache.Delete("1337_unreadable")
+
+	// The history file can't be read, since it is a directory.
+	if err := os.MkdirAll(fileStore.path("1337_unreadable"), 0755); err != nil {
+		t.Errorf("could not create the unreadable history: %v", err)
+		t.FailNow()
+	}
+	if _, err := appendToHistory("1337_unreadable", HistoryCycle{StartTime: time.Unix(1, 0)}); err == nil {
+		t.Errorf("expected an error for an unreadable history")
+		t.FailNow()
+	}
+	if _, ok := cache.Load("1337_unreadable"); ok || CountDirty() != 0 {
+		t.Errorf("unreadable history should not be replaced by a new history")
+		t.FailNow()
+	}
+}
+
+func TestFlushOnPanic(t *testing.T) {
+	env.HistoryFlushInterval = time.Minute
+	defer func() { env.HistoryFlushInterval = 0 }()
+	fileStore := &FileStore{Dir: t.TempDir()}
+	store = fileStore
+	defer func() { store = &FileStore{} }()
+	defer cache.Delete("1337_panic")
+
+	appendToHistory("1337_panic", HistoryCycle{StartTime: time.Unix(1, 0)})
+	recovered := func() (r interface{}) {
+		defer func() { r = recover() }()
+		defer FlushOnPanic()
+		panic("fatal")
+	}()
+	if recovered != "fatal" {
+		t.Errorf("expected the panic to be passed on, got %v", recovered)
+		t.FailNow()
+	}
+	if flushed, err := fileStore.Load("1337_panic"); err != nil || len(flushed.Cycles) != 1 {
+		t.Errorf("history was not flushed before the panic: %v, %v", flushed, err)
+		t.FailNow()
+	}
+}
@@ -44,6 +44,9 @@ type HistoryCycle struct {
 type History struct {
 	// The rows (cycles) of the history.
 	Cycles []HistoryCycle `json:"cycles"`
+	// The adaptive maximum number of cycles in the history.
+	// If zero, the default history length is used.
+	Length int `json:"length,omitempty"`
 }
 
 // Flatten a history into an array of cycles of seconds by their color.
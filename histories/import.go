@@ -0,0 +1,221 @@
+package histories
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"predictor/log"
+	"sort"
+	"strings"
+)
+
+// The changes of merging imported cycles into a history.
+type mergeReport struct {
+	// The number of imported cycles that were added to the history.
+	Added int
+	// The number of imported cycles that already were in the history.
+	Duplicates int
+	// The number of imported cycles with invalid phases.
+	Invalid int
+	// The number of imported cycles that were older than the kept cycles.
+	Dropped int
+}
+
+// Add the counts of another report.
+func (r *mergeReport) add(other mergeReport) {
+	r.Added += other.Added
+	r.Duplicates += other.Duplicates
+	r.Invalid += other.Invalid
+	r.Dropped += other.Dropped
+}
+
+// Merge imported cycles into a local history.
+// Cycles are deduplicated by their start time, where the local cycle is kept.
+// The merged cycles are sorted by their start time and only the most recent
+// cycles are kept, up to the length of the local history (or of the imported
+// history, if there is no local one).
+func mergeHistories(local History, imported History) (History, mergeReport) {
+	report := mergeReport{}
+	seen := make(map[int64]bool, len(local.Cycles)+len(imported.Cycles))
+	for _, cycle := range local.Cycles {
+		seen[cycle.StartTime.UnixMilli()] = true
+	}
+	merged := make([]HistoryCycle, 0, len(local.Cycles)+len(imported.Cycles))
+	merged = append(merged, local.Cycles...)
+	imports := map[int64]bool{}
+	for _, cycle := range imported.Cycles {
+		startTime := cycle.StartTime.UnixMilli()
+		if seen[startTime] {
+			report.Duplicates++
+			continue
+		}
+		if err := validatePhases(cycle.StartTime, cycle.EndTime, cycle.Phases); err != nil {
+			report.Invalid++
+			continue
+		}
+		seen[startTime] = true
+		imports[startTime] = true
+		merged = append(merged, cycle)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].StartTime.Before(merged[j].StartTime)
+	})
+
+	length := local.effectiveLength()
+	if len(local.Cycles) == 0 {
+		length = imported.effectiveLength()
+	}
+	minLength, maxLength := lengthBounds()
+	if length < minLength {
+		length = minLength
+	}
+	if length > maxLength {
+		length = maxLength
+	}
+	if len(merged) > length {
+		merged = merged[len(merged)-length:]
+	}
+	for _, cycle := range merged {
+		if imports[cycle.StartTime.UnixMilli()] {
+			report.Added++
+		}
+	}
+	report.Dropped = len(imports) - report.Added
+	return History{Cycles: merged, Length: length}, report
+}
+
+// Read the histories to import from a directory with history files in any
+// encoding (e.g. the history directory of another instance), or from a history database.
+// The source is only read, corrupt files are skipped and not quarantined.
+// The csv and ndjson exports can't be imported, since they don't contain complete cycles.
+func readImportSource(path string) (map[string]History, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	imported := map[string]History{}
+	if !info.IsDir() {
+		source, err := OpenBoltStoreReadOnly(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not open history database %s: %v", path, err)
+		}
+		defer source.Close()
+		keys, err := source.Keys()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			history, err := source.Load(key)
+			if err != nil {
+				log.Warning.Printf("Skipping history %s that could not be read: %v", key, err)
+				continue
+			}
+			imported[key] = history
+		}
+		return imported, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		extension := filepath.Ext(entry.Name())
+		if entry.IsDir() || (extension != ".json" && extension != ".hist") {
+			continue
+		}
+		key := strings.TrimSuffix(entry.Name(), extension)
+		history, err := decodeHistoryFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			log.Warning.Printf("Skipping history file %s that could not be read: %v", entry.Name(), err)
+			continue
+		}
+		if existing, ok := imported[key]; ok {
+			// The same history in both encodings, e.g. after a conversion.
+			history, _ = mergeHistories(existing, history)
+		}
+		imported[key] = history
+	}
+	return imported, nil
+}
+
+// Merge the histories of another instance into the configured history store.
+// The arguments are the command line flags of the `import` command.
+// With a dry run, only the changes are reported and the store is not written.
+func RunImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	from := flags.String("from", "", "The history directory or database to import the histories from (exports are not supported).")
+	dryRun := flags.Bool("dry-run", false, "Only report the changes without writing the histories.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("missing -from")
+	}
+	imported, err := readImportSource(*from)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(imported))
+	for key := range imported {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	total := mergeReport{}
+	changed := 0
+	for _, key := range keys {
+		report, err := importHistory(key, imported[key], *dryRun)
+		if err != nil {
+			return err
+		}
+		if report.Added > 0 {
+			changed++
+			log.Info.Printf("History %s: %d added, %d duplicate, %d invalid, %d too old.", key, report.Added, report.Duplicates, report.Invalid, report.Dropped)
+		}
+		total.add(report)
+	}
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	log.Info.Printf(
+		"%s %d cycles into %d of %d histories (%d duplicate, %d invalid, %d too old).",
+		verb, total.Added, changed, len(keys), total.Duplicates, total.Invalid, total.Dropped,
+	)
+	return nil
+}
+
+// Merge an imported history into the store, or only report the changes with a dry run.
+// Histories without new cycles are not written.
+func importHistory(key string, imported History, dryRun bool) (mergeReport, error) {
+	merged, report, err := importHistoryLocked(key, imported, dryRun)
+	if err != nil || dryRun || report.Added == 0 {
+		return report, err
+	}
+	indexHistory(key, merged)
+	return report, nil
+}
+
+// Merge an imported history into the store while holding the lock of the history.
+func importHistoryLocked(key string, imported History, dryRun bool) (History, mergeReport, error) {
+	lock := historyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	local, err := store.Load(key)
+	if errors.Is(err, os.ErrNotExist) {
+		local = History{}
+	} else if err != nil {
+		return History{}, mergeReport{}, fmt.Errorf("could not read history %s: %v", key, err)
+	}
+	merged, report := mergeHistories(local, imported)
+	if dryRun || report.Added == 0 {
+		return merged, report, nil
+	}
+	if err := store.Save(key, merged); err != nil {
+		return merged, report, fmt.Errorf("could not write history %s: %v", key, err)
+	}
+	cache.Store(key, merged)
+	return merged, report, nil
+}
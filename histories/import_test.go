@@ -0,0 +1,121 @@
+package histories
+
+import (
+	"fmt"
+	"os"
+	"predictor/env"
+	"predictor/phases"
+	"testing"
+	"time"
+)
+
+// Get a valid cycle that starts at the given second.
+func validCycle(start int64) HistoryCycle {
+	return HistoryCycle{
+		StartTime: time.Unix(start, 0),
+		EndTime:   time.Unix(start+60, 0),
+		Phases: []HistoryPhaseEvent{
+			{Time: time.Unix(start-1, 0), Color: phases.Red},
+			{Time: time.Unix(start+30, 0), Color: phases.Green},
+		},
+	}
+}
+
+func TestMergeHistories(t *testing.T) {
+	env.HistoryMinLength, env.HistoryMaxLength = 2, 50
+	defer func() { env.HistoryMinLength, env.HistoryMaxLength = 0, 0 }()
+	local := History{Cycles: []HistoryCycle{validCycle(100), validCycle(300)}, Length: 3}
+	invalid := validCycle(400)
+	invalid.Phases = nil
+	imported := History{Cycles: []HistoryCycle{validCycle(0), validCycle(300), validCycle(200), invalid}}
+
+	merged, report := mergeHistories(local, imported)
+	if report != (mergeReport{Added: 1, Duplicates: 1, Invalid: 1, Dropped: 1}) {
+		t.Errorf("unexpected report: %+v", report)
+		t.FailNow()
+	}
+	if len(merged.Cycles) != 3 || merged.Length != 3 {
+		t.Errorf("unexpected merged history: %+v", merged)
+		t.FailNow()
+	}
+	for i, start := range []int64{100, 200, 300} {
+		if merged.Cycles[i].StartTime.Unix() != start {
+			t.Errorf("cycle %d starts at %d, expected %d", i, merged.Cycles[i].StartTime.Unix(), start)
+			t.FailNow()
+		}
+	}
+}
+
+func TestRunImport(t *testing.T) {
+	previousStore := store
+	defer func() { store = previousStore }()
+	local := &FileStore{Dir: t.TempDir()}
+	store = local
+	source := t.TempDir()
+	(&FileStore{Dir: source}).Save("1337_9", History{Cycles: []HistoryCycle{validCycle(100)}})
+	(&FileStore{Dir: source, Encoding: EncodingBinary}).Save("1337_9", History{Cycles: []HistoryCycle{validCycle(200)}})
+	local.Save("1337_9", History{Cycles: []HistoryCycle{validCycle(100)}})
+
+	if err := RunImport([]string{"-from", source, "-dry-run"}); err != nil {
+		t.Errorf("could not run dry import: %s", err)
+		t.FailNow()
+	}
+	if history, _ := local.Load("1337_9"); len(history.Cycles) != 1 {
+		t.Errorf("dry run changed the history: %+v", history)
+		t.FailNow()
+	}
+	if err := RunImport([]string{"-from", source}); err != nil {
+		t.Errorf("could not run import: %s", err)
+		t.FailNow()
+	}
+	history, err := local.Load("1337_9")
+	if err != nil || fmt.Sprint(len(history.Cycles), history.Cycles[1].StartTime.Unix()) != "2 200" {
+		t.Errorf("history was not imported: %+v, %v", history, err)
+		t.FailNow()
+	}
+	if err := RunImport([]string{"-from", source + "/missing"}); err == nil {
+		t.Errorf("importing from a missing source should fail")
+		t.FailNow()
+	}
+}
+
+func TestImportFromDatabaseIsReadOnly(t *testing.T) {
+	previousStore := store
+	defer func() { store = previousStore }()
+	store = &FileStore{Dir: t.TempDir()}
+	path := t.TempDir() + "/histories.db"
+	source, err := OpenBoltStore(path, EncodingBinary)
+	if err != nil {
+		t.Errorf("could not open bolt store: %s", err)
+		t.FailNow()
+	}
+	source.Save("1337_8", History{Cycles: []HistoryCycle{validCycle(100)}})
+	source.Close()
+	info, _ := os.Stat(path)
+
+	if err := RunImport([]string{"-from", path}); err != nil {
+		t.Errorf("could not import from database: %s", err)
+		t.FailNow()
+	}
+	defer cache.Delete("1337_8")
+	if history, err := store.Load("1337_8"); err != nil || len(history.Cycles) != 1 {
+		t.Errorf("history was not imported: %v, %v", history, err)
+		t.FailNow()
+	}
+	if after, _ := os.Stat(path); !after.ModTime().Equal(info.ModTime()) {
+		t.Errorf("source database was changed")
+		t.FailNow()
+	}
+
+	// An empty file is not turned into a database.
+	empty := t.TempDir() + "/empty.db"
+	os.WriteFile(empty, []byte{}, 0644)
+	if err := RunImport([]string{"-from", empty}); err == nil {
+		t.Errorf("importing from an empty file should fail")
+		t.FailNow()
+	}
+	if after, _ := os.Stat(empty); after.Size() != 0 {
+		t.Errorf("empty source file was changed")
+		t.FailNow()
+	}
+}
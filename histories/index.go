@@ -3,15 +3,29 @@ package histories
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"predictor/env"
+	"predictor/things"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type IndexEntry struct {
 	// The json file.
 	File string `json:"file"`
+	// The thing of the history.
+	Thing string `json:"thing"`
+	// The crossing of the thing, if the thing is known.
+	Crossing string `json:"crossing,omitempty"`
+	// The program of the history, if the history is program-specific.
+	Program *byte `json:"program"`
+	// The segment of the history, e.g. "weekday-rush", if the history is segmented.
+	Segment string `json:"segment,omitempty"`
 	// The time when the history was last updated.
 	LastUpdated time.Time `json:"lastUpdated"`
 	// If a car was detected in the history.
@@ -20,58 +34,148 @@ type IndexEntry struct {
 	BikeDetected bool `json:"bikeDetected"`
 	// The number of cycles in the history.
 	CycleCount int `json:"cycleCount"`
+	// The adaptive maximum number of cycles in the history.
+	Length int `json:"length"`
+	// The mean, min and max length of the cycles, in seconds.
+	MeanCycleSeconds float64 `json:"meanCycleSeconds"`
+	MinCycleSeconds  float64 `json:"minCycleSeconds"`
+	MaxCycleSeconds  float64 `json:"maxCycleSeconds"`
+	// The number of clusters of the cycles.
+	Clusters int `json:"clusters"`
+	// The share of the cycles in the largest cluster, between 0 and 1.
+	DominantClusterShare float64 `json:"dominantClusterShare"`
+	// The share of the cycles of the thing that were discarded by the validation, between 0 and 1.
+	DiscardRate float64 `json:"discardRate"`
 }
 
 // The lock that must be used when writing or reading the index file.
 // This is to gobally protect concurrent access to the same file.
 var indexFileLock = &sync.Mutex{}
 
-// Lookup all .json history files in the static path and write them into a json file.
-// This serves as an index for the cycle analyzer.
-func UpdateHistoryIndex() {
-	entries := make([]IndexEntry, 0)
-	cache.Range(func(key, value interface{}) bool {
-		path := key.(string)
-		history := value.(History)
-
-		var carDetected = false
-		var bikeDetected = false
-		var cycleLenSum = 0
-		for _, cycle := range history.Cycles {
-			if len(cycle.Cars) > 0 {
-				carDetected = true
-			}
-			if len(cycle.Bikes) > 0 {
-				bikeDetected = true
-			}
-			cycleLenSum += len(cycle.Phases)
+// The index entries by history key, which are updated with the histories.
+var index = sync.Map{}
+
+// If the index changed since the index file was written (1) or not (0).
+var indexChanged int32 = 1
+
+// Get the thing, program and segment from a history key, e.g. "96_22-P3-weekday-rush".
+func parseHistoryKey(key string) (thingName string, programId *byte, segment string) {
+	parts := strings.SplitN(key, "-", 2)
+	thingName = parts[0]
+	if len(parts) == 1 {
+		return thingName, nil, ""
+	}
+	rest := parts[1]
+	programPart, segmentPart, _ := strings.Cut(rest, "-")
+	if strings.HasPrefix(programPart, "P") {
+		if program, err := strconv.ParseUint(programPart[1:], 10, 8); err == nil {
+			p := byte(program)
+			return thingName, &p, segmentPart
 		}
-		var cycleCount = len(history.Cycles)
-		if cycleCount == 0 {
-			return true
+	}
+	return thingName, nil, rest
+}
+
+// Get the name of the file of a history, as it is served to the cycle analyzer.
+// Histories that are not stored in files are served as json by the API.
+func historyFileName(key string) string {
+	if fileStore, ok := store.(*FileStore); ok {
+		return key + fileStore.extension()
+	}
+	return key + ".json"
+}
+
+// Compute the index entry of a history.
+// Histories without cycles have no index entry.
+func makeIndexEntry(key string, history History) (IndexEntry, bool) {
+	cycleCount := len(history.Cycles)
+	if cycleCount == 0 {
+		return IndexEntry{}, false
+	}
+	thingName, programId, segment := parseHistoryKey(key)
+	entry := IndexEntry{
+		File:            historyFileName(key),
+		Thing:           thingName,
+		Program:         programId,
+		Segment:         segment,
+		LastUpdated:     history.Cycles[cycleCount-1].EndTime,
+		CycleCount:      cycleCount,
+		Length:          history.effectiveLength(),
+		MinCycleSeconds: math.MaxFloat64,
+	}
+	var cycleSecondsSum float64
+	for _, cycle := range history.Cycles {
+		if len(cycle.Cars) > 0 {
+			entry.CarDetected = true
 		}
-		// Split the filename from the path.
-		var filename = path
-		for i := len(path) - 1; i >= 0; i-- {
-			if path[i] == '/' {
-				filename = path[i+1:]
-				break
-			}
+		if len(cycle.Bikes) > 0 {
+			entry.BikeDetected = true
 		}
-		// Add the history to the index.
-		entries = append(entries, IndexEntry{
-			File:         filename,
-			LastUpdated:  history.Cycles[cycleCount-1].EndTime,
-			CarDetected:  carDetected,
-			BikeDetected: bikeDetected,
-			CycleCount:   cycleCount,
-		})
+		seconds := cycle.EndTime.Sub(cycle.StartTime).Seconds()
+		cycleSecondsSum += seconds
+		entry.MinCycleSeconds = math.Min(entry.MinCycleSeconds, seconds)
+		entry.MaxCycleSeconds = math.Max(entry.MaxCycleSeconds, seconds)
+	}
+	entry.MeanCycleSeconds = cycleSecondsSum / float64(cycleCount)
+	flattened := history.Flatten()
+	if clusters := Cluster(flattened); len(clusters) > 0 {
+		entry.Clusters = len(clusters)
+		entry.DominantClusterShare = float64(len(clusters[0])) / float64(len(flattened))
+	}
+	return entry, true
+}
+
+// Update the index entry of a history after the history changed.
+// This flattens and clusters the history, so it should not be called
+// while holding the lock of the history.
+func indexHistory(key string, history History) {
+	if entry, ok := makeIndexEntry(key, history); ok {
+		index.Store(key, entry)
+	} else {
+		index.Delete(key)
+	}
+	atomic.StoreInt32(&indexChanged, 1)
+}
+
+// Get all index entries sorted by their file.
+// The crossing and the discard rate may change independently of the history,
+// so they are looked up when the entries are requested.
+func indexEntries() []IndexEntry {
+	entries := make([]IndexEntry, 0)
+	index.Range(func(_, value interface{}) bool {
+		entry := value.(IndexEntry)
+		if thing, ok := things.Things.Load(entry.Thing); ok {
+			entry.Crossing = thing.(things.Thing).CrossingId()
+		}
+		entry.DiscardRate = discardRate(entry.Thing)
+		entries = append(entries, entry)
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].File < entries[j].File
+	})
+	return entries
+}
 
+// Rebuild the index from all histories in the cache and write it into a json file.
+// This serves as an index for the cycle analyzer.
+func UpdateHistoryIndex() {
+	index.Range(func(key, _ interface{}) bool {
+		index.Delete(key)
+		return true
+	})
+	cache.Range(func(key, value interface{}) bool {
+		indexHistory(key.(string), value.(History))
 		return true
 	})
+	writeHistoryIndex()
+}
 
+// Write the index entries into the index file.
+func writeHistoryIndex() {
+	atomic.StoreInt32(&indexChanged, 0)
 	// Write the json files into a json file (without ioutil).
-	jsonBytes, err := json.Marshal(entries)
+	jsonBytes, err := json.Marshal(indexEntries())
 	if err != nil {
 		panic(err)
 	}
@@ -89,10 +193,108 @@ func UpdateHistoryIndex() {
 	}
 }
 
-// Build the index file periodically.
+// Write the index file periodically, if the index changed.
 func UpdateHistoryIndexPeriodically() {
 	for {
 		time.Sleep(10 * time.Second)
-		UpdateHistoryIndex()
+		if atomic.LoadInt32(&indexChanged) == 1 {
+			writeHistoryIndex()
+		}
+	}
+}
+
+// A query of the history index.
+type IndexQuery struct {
+	// Only entries of this thing, if not empty.
+	Thing string
+	// Only entries of things of this crossing, if not empty.
+	Crossing string
+	// Only entries of this program, if not nil.
+	Program *byte
+	// Only entries with car ("car") or bike ("bike") detections, if not empty.
+	Detector string
+	// Only entries with at least this number of cycles.
+	MinCycleCount int
+	// The json name of the field to sort by, e.g. "discardRate". Defaults to the file.
+	Sort string
+	// If the entries are sorted in descending order.
+	Descending bool
+	// The number of entries to skip and the maximum number of entries to return.
+	// All entries are returned if the limit is 0.
+	Offset int
+	Limit  int
+}
+
+// The orders of the index entries by the json name of their field.
+var indexOrders = map[string]func(a, b IndexEntry) bool{
+	"file":                 func(a, b IndexEntry) bool { return a.File < b.File },
+	"thing":                func(a, b IndexEntry) bool { return a.Thing < b.Thing },
+	"crossing":             func(a, b IndexEntry) bool { return a.Crossing < b.Crossing },
+	"lastUpdated":          func(a, b IndexEntry) bool { return a.LastUpdated.Before(b.LastUpdated) },
+	"cycleCount":           func(a, b IndexEntry) bool { return a.CycleCount < b.CycleCount },
+	"meanCycleSeconds":     func(a, b IndexEntry) bool { return a.MeanCycleSeconds < b.MeanCycleSeconds },
+	"clusters":             func(a, b IndexEntry) bool { return a.Clusters < b.Clusters },
+	"dominantClusterShare": func(a, b IndexEntry) bool { return a.DominantClusterShare < b.DominantClusterShare },
+	"discardRate":          func(a, b IndexEntry) bool { return a.DiscardRate < b.DiscardRate },
+}
+
+// Check if an index entry matches the filters of the query.
+func (q IndexQuery) matches(entry IndexEntry) bool {
+	if q.Thing != "" && entry.Thing != q.Thing {
+		return false
+	}
+	if q.Crossing != "" && entry.Crossing != q.Crossing {
+		return false
+	}
+	if q.Program != nil && (entry.Program == nil || *entry.Program != *q.Program) {
+		return false
+	}
+	if q.Detector == "car" && !entry.CarDetected {
+		return false
+	}
+	if q.Detector == "bike" && !entry.BikeDetected {
+		return false
+	}
+	return entry.CycleCount >= q.MinCycleCount
+}
+
+// Query the history index with filtering, sorting and paging.
+// Returns the page of entries and the total number of matching entries.
+func QueryHistoryIndex(q IndexQuery) ([]IndexEntry, int, error) {
+	sortBy := q.Sort
+	if sortBy == "" {
+		sortBy = "file"
+	}
+	less, ok := indexOrders[sortBy]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown sort field: %s", q.Sort)
+	}
+	if q.Detector != "" && q.Detector != "car" && q.Detector != "bike" {
+		return nil, 0, fmt.Errorf("unknown detector: %s", q.Detector)
+	}
+	if q.Offset < 0 || q.Limit < 0 {
+		return nil, 0, fmt.Errorf("offset and limit must not be negative")
+	}
+	matching := make([]IndexEntry, 0)
+	for _, entry := range indexEntries() {
+		if q.matches(entry) {
+			matching = append(matching, entry)
+		}
+	}
+	// The entries are sorted by their file, which is kept for equal values.
+	sort.SliceStable(matching, func(i, j int) bool {
+		if q.Descending {
+			return less(matching[j], matching[i])
+		}
+		return less(matching[i], matching[j])
+	})
+	total := len(matching)
+	if q.Offset >= total {
+		return []IndexEntry{}, total, nil
+	}
+	page := matching[q.Offset:]
+	if q.Limit > 0 && len(page) > q.Limit {
+		page = page[:q.Limit]
 	}
+	return page, total, nil
 }
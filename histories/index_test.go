@@ -57,7 +57,7 @@ func TestHistoryIndex(t *testing.T) {
 		t.Errorf("could not write into history file: %s", err.Error())
 		t.FailNow()
 	}
-	cache.Store(historyFilePath, history)
+	cache.Store("1337_1", history)
 
 	env.StaticPath = tempDir
 	UpdateHistoryIndex()
@@ -80,9 +80,16 @@ func TestHistoryIndex(t *testing.T) {
 
 	expectedIndex := []IndexEntry{
 		{
-			File:        "1337_1.json",
-			LastUpdated: time.Unix(10, 0),
-			CycleCount:  2,
+			File:                 "1337_1.json",
+			Thing:                "1337_1",
+			LastUpdated:          time.Unix(10, 0),
+			CycleCount:           2,
+			Length:               10,
+			MeanCycleSeconds:     10,
+			MinCycleSeconds:      10,
+			MaxCycleSeconds:      10,
+			Clusters:             1,
+			DominantClusterShare: 1,
 		},
 	}
 
@@ -91,3 +98,74 @@ func TestHistoryIndex(t *testing.T) {
 		t.Errorf("expected index does not correspond with unmarshaled index: %v != %v", expectedIndex, unmarshaledIndex)
 	}
 }
+
+func TestParseHistoryKey(t *testing.T) {
+	cases := map[string]string{
+		"96_22":                 "96_22 <nil> ",
+		"96_22-P3":              "96_22 3 ",
+		"96_22-P3-weekday-rush": "96_22 3 weekday-rush",
+		"96_22-weekday":         "96_22 <nil> weekday",
+		"96_22-Pause-night":     "96_22 <nil> Pause-night",
+	}
+	for key, expected := range cases {
+		thingName, programId, segment := parseHistoryKey(key)
+		program := "<nil>"
+		if programId != nil {
+			program = fmt.Sprint(*programId)
+		}
+		if actual := fmt.Sprintf("%s %s %s", thingName, program, segment); actual != expected {
+			t.Errorf("unexpected parsed key %s: %s", key, actual)
+			t.FailNow()
+		}
+	}
+}
+
+func TestQueryHistoryIndex(t *testing.T) {
+	index.Range(func(key, _ interface{}) bool {
+		index.Delete(key)
+		return true
+	})
+	cycle := func(start int64, seconds int64) HistoryCycle {
+		return HistoryCycle{StartTime: time.Unix(start, 0), EndTime: time.Unix(start+seconds, 0)}
+	}
+	indexHistory("1337_1-P1", History{Cycles: []HistoryCycle{cycle(0, 60), cycle(60, 90)}})
+	indexHistory("1337_1-P2", History{Cycles: []HistoryCycle{cycle(0, 80)}})
+	indexHistory("1337_2-P1", History{Cycles: []HistoryCycle{cycle(0, 70), cycle(70, 70), cycle(140, 70)}})
+	indexHistory("1337_3", History{})
+
+	entries, total, err := QueryHistoryIndex(IndexQuery{MinCycleCount: 2, Sort: "meanCycleSeconds", Descending: true})
+	if err != nil || total != 2 || entries[0].File != "1337_1-P1.json" || entries[0].MinCycleSeconds != 60 {
+		t.Errorf("unexpected query result: %+v, %d, %v", entries, total, err)
+		t.FailNow()
+	}
+	program := byte(1)
+	entries, total, err = QueryHistoryIndex(IndexQuery{Program: &program, Offset: 1, Limit: 1})
+	if err != nil || total != 2 || len(entries) != 1 || entries[0].File != "1337_2-P1.json" {
+		t.Errorf("unexpected page: %+v, %d, %v", entries, total, err)
+		t.FailNow()
+	}
+	if _, _, err := QueryHistoryIndex(IndexQuery{Sort: "color"}); err == nil {
+		t.Errorf("sorting by an unknown field should fail")
+		t.FailNow()
+	}
+}
+
+func TestHistoryFileName(t *testing.T) {
+	defer func() { store = &FileStore{} }()
+
+	store = &FileStore{Encoding: EncodingBinary}
+	if file := historyFileName("1337_1-P1"); file != "1337_1-P1.hist" {
+		t.Errorf("expected the extension of binary history files, got %s", file)
+		t.FailNow()
+	}
+	store = &FileStore{}
+	if file := historyFileName("1337_1-P1"); file != "1337_1-P1.json" {
+		t.Errorf("expected the extension of json history files, got %s", file)
+		t.FailNow()
+	}
+	store = &BoltStore{}
+	if file := historyFileName("1337_1-P1"); file != "1337_1-P1.json" {
+		t.Errorf("expected histories from the database to be served as json, got %s", file)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,103 @@
+package histories
+
+import (
+	"flag"
+	"fmt"
+	"predictor/env"
+	"predictor/log"
+)
+
+// Copy all histories from one store backend into another, e.g. from the files into the database.
+// The arguments are the command line flags of the `migrate` command.
+func RunMigration(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	from := flags.String("from", "file", "The store backend to read the histories from (file or bolt).")
+	to := flags.String("to", "bolt", "The store backend to write the histories into (file or bolt).")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == *to {
+		return fmt.Errorf("source and target store are the same: %s", *from)
+	}
+	source, err := OpenStore(*from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := OpenStore(*to)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	migrated, err := migrate(source, target)
+	if err != nil {
+		return err
+	}
+	log.Info.Printf("Migrated %d histories from %s to %s.", migrated, *from, *to)
+	return nil
+}
+
+// Rewrite all histories of the configured store backend in another encoding.
+// The arguments are the command line flags of the `convert` command.
+// Converted history files are written next to the original ones, which are kept.
+func RunConversion(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	to := flags.String("to", EncodingJSON, "The encoding to convert the histories into (json or binary).")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var from string
+	switch *to {
+	case EncodingJSON:
+		from = EncodingBinary
+	case EncodingBinary:
+		from = EncodingJSON
+	default:
+		return fmt.Errorf("unknown history encoding: %s", *to)
+	}
+
+	var source, target HistoryStore
+	switch env.HistoryStore {
+	case "bolt":
+		// Since the histories are decoded in any encoding, they can be rewritten in place.
+		s, err := OpenBoltStore(env.HistoryDbPath, *to)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		source, target = s, s
+	default:
+		source = &FileStore{Encoding: from}
+		target = &FileStore{Encoding: *to}
+	}
+
+	converted, err := migrate(source, target)
+	if err != nil {
+		return err
+	}
+	log.Info.Printf("Converted %d histories from %s to %s.", converted, from, *to)
+	return nil
+}
+
+// Copy all histories from the source into the target store.
+// Histories that can't be read are skipped, existing histories in the target are replaced.
+func migrate(source HistoryStore, target HistoryStore) (int, error) {
+	keys, err := source.Keys()
+	if err != nil {
+		return 0, err
+	}
+	migrated := 0
+	for _, key := range keys {
+		history, err := source.Load(key)
+		if err != nil {
+			log.Warning.Printf("Skipping history %s that could not be read: %v", key, err)
+			continue
+		}
+		if err := target.Save(key, history); err != nil {
+			return migrated, fmt.Errorf("could not write history %s: %v", key, err)
+		}
+		migrated++
+	}
+	return migrated, nil
+}
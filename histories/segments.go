@@ -0,0 +1,168 @@
+package histories
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"predictor/env"
+	"strings"
+	"time"
+	_ "time/tzdata" // The container image has no timezone database.
+)
+
+// The day types by which the histories can be segmented.
+const (
+	DayTypeWeekday = "weekday"
+	DayTypeWeekend = "weekend"
+	DayTypeHoliday = "holiday"
+)
+
+// The minimum number of cycles of a segmented history before it is used for predictions.
+// Until then, the lookup falls back to the less specific histories.
+const minSegmentCycles = 3
+
+// A named time-of-day window, e.g. the morning rush hour.
+type timeWindow struct {
+	// The name of the window, used in the history key.
+	name string
+	// The start and end of the window, as minutes since midnight.
+	// If the end is before the start, the window wraps around midnight.
+	start int
+	end   int
+}
+
+// If the minute of the day is within the window.
+func (w timeWindow) contains(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// The segmentation of the histories.
+// If disabled, the histories are only distinguished by program.
+var segmentation = struct {
+	enabled  bool
+	location *time.Location
+	windows  []timeWindow
+	holidays map[string]bool
+}{}
+
+// Load the segmentation of the histories that is configured in the environment.
+func InitSegments() error {
+	if !env.HistorySegmentation {
+		return nil
+	}
+	location, err := time.LoadLocation(env.HistoryTimezone)
+	if err != nil {
+		return err
+	}
+	windows, err := parseTimeWindows(env.HistoryTimeWindows)
+	if err != nil {
+		return err
+	}
+	holidays := map[string]bool{}
+	if env.HolidayCalendarPath != "" {
+		holidays, err = loadHolidays(env.HolidayCalendarPath)
+		if err != nil {
+			return err
+		}
+	}
+	segmentation.enabled = true
+	segmentation.location = location
+	segmentation.windows = windows
+	segmentation.holidays = holidays
+	return nil
+}
+
+// Parse time windows like "rush=06:00-09:00,midday=09:00-15:00".
+func parseTimeWindows(value string) ([]timeWindow, error) {
+	windows := []timeWindow{}
+	if value == "" {
+		return windows, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		name, span, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid time window: %s", part)
+		}
+		for _, c := range name {
+			if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') {
+				return nil, fmt.Errorf("time window name may only contain lowercase letters and digits: %s", name)
+			}
+		}
+		from, to, ok := strings.Cut(span, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid time window: %s", part)
+		}
+		start, err := time.Parse("15:04", from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start of time window %s: %v", name, err)
+		}
+		end, err := time.Parse("15:04", to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end of time window %s: %v", name, err)
+		}
+		windows = append(windows, timeWindow{
+			name:  name,
+			start: start.Hour()*60 + start.Minute(),
+			end:   end.Hour()*60 + end.Minute(),
+		})
+	}
+	return windows, nil
+}
+
+// Load the holidays from a calendar file with one date (YYYY-MM-DD) per line.
+// Empty lines and lines starting with # are ignored.
+func loadHolidays(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	holidays := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Allow a description after the date, e.g. "2023-10-03 Tag der Deutschen Einheit".
+		date := strings.Fields(line)[0]
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return nil, fmt.Errorf("invalid holiday date: %s", date)
+		}
+		holidays[date] = true
+	}
+	return holidays, scanner.Err()
+}
+
+// Get the day type of a local time.
+func dayType(local time.Time) string {
+	if segmentation.holidays[local.Format("2006-01-02")] {
+		return DayTypeHoliday
+	}
+	if local.Weekday() == time.Saturday || local.Weekday() == time.Sunday {
+		return DayTypeWeekend
+	}
+	return DayTypeWeekday
+}
+
+// Get the segments of a time, from the most specific to the least specific.
+// The segments are used as suffixes of the history keys, the last one is always empty.
+func segmentsAt(t time.Time) []string {
+	if !segmentation.enabled {
+		return []string{""}
+	}
+	local := t.In(segmentation.location)
+	day := dayType(local)
+	segments := []string{}
+	minute := local.Hour()*60 + local.Minute()
+	for _, window := range segmentation.windows {
+		if window.contains(minute) {
+			segments = append(segments, fmt.Sprintf("%s-%s", day, window.name))
+			break
+		}
+	}
+	return append(segments, day, "")
+}
@@ -0,0 +1,124 @@
+package histories
+
+import (
+	"fmt"
+	"os"
+	"predictor/env"
+	"predictor/observations"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func enableSegmentation(t *testing.T) {
+	calendarPath := fmt.Sprintf("%s/holidays.txt", t.TempDir())
+	os.WriteFile(calendarPath, []byte("# Holidays\n2023-10-03 Tag der Deutschen Einheit\n"), 0644)
+	env.HistorySegmentation = true
+	env.HistoryTimezone = "Europe/Berlin"
+	env.HistoryTimeWindows = "rush=06:00-09:00,night=22:00-06:00"
+	env.HolidayCalendarPath = calendarPath
+	if err := InitSegments(); err != nil {
+		t.Errorf("could not init segments: %s", err)
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		env.HistorySegmentation = false
+		segmentation.enabled = false
+	})
+}
+
+func TestSegmentsAt(t *testing.T) {
+	enableSegmentation(t)
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+
+	cases := map[time.Time][]string{
+		// Monday morning in Berlin, but still night in UTC.
+		time.Date(2023, 10, 2, 7, 30, 0, 0, berlin): {"weekday-rush", "weekday", ""},
+		// Monday midday is in no time window.
+		time.Date(2023, 10, 2, 12, 0, 0, 0, berlin): {"weekday", ""},
+		// The night window wraps around midnight.
+		time.Date(2023, 10, 1, 2, 0, 0, 0, berlin): {"weekend-night", "weekend", ""},
+		// Tuesday is a holiday.
+		time.Date(2023, 10, 3, 7, 30, 0, 0, berlin): {"holiday-rush", "holiday", ""},
+	}
+	for at, expected := range cases {
+		if segments := segmentsAt(at.UTC()); !reflect.DeepEqual(segments, expected) {
+			t.Errorf("unexpected segments at %s: %v", at, segments)
+			t.FailNow()
+		}
+	}
+}
+
+func TestParseTimeWindowsInvalid(t *testing.T) {
+	for _, value := range []string{"rush", "rush=06:00", "Rush=06:00-09:00", "rush=6-9"} {
+		if _, err := parseTimeWindows(value); err == nil {
+			t.Errorf("time windows should be invalid: %s", value)
+			t.FailNow()
+		}
+	}
+}
+
+func TestLoadBestHistoryFallsBackToLessSpecificSegment(t *testing.T) {
+	enableSegmentation(t)
+	env.StaticPath = t.TempDir()
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	now = func() time.Time { return time.Date(2023, 10, 2, 7, 30, 0, 0, berlin) }
+	defer func() { now = time.Now }()
+	getCurrentProgram = func(_ string) (observations.Observation, bool) {
+		return observations.Observation{Result: 5}, true
+	}
+	defer cache.Delete("1337_seg-P5-weekday-rush")
+	defer cache.Delete("1337_seg-P5-weekday")
+
+	// Only two cycles in the rush hour segment are not enough.
+	for i := 0; i < minSegmentCycles-1; i++ {
+		appendToHistory("1337_seg-P5-weekday-rush", HistoryCycle{StartTime: time.Unix(int64(i), 0)})
+	}
+	for i := 0; i < minSegmentCycles; i++ {
+		appendToHistory("1337_seg-P5-weekday", HistoryCycle{StartTime: time.Unix(int64(i), 0)})
+	}
+	history, programId, err := LoadBestFittingHistory("1337_seg")
+	if err != nil || programId == nil || len(history.Cycles) != minSegmentCycles {
+		t.Errorf("weekday history should be used: %v, %v", history, err)
+		t.FailNow()
+	}
+
+	// With enough cycles, the most specific segment is used.
+	appendToHistory("1337_seg-P5-weekday-rush", HistoryCycle{StartTime: time.Unix(100, 0)})
+	history, _, _ = LoadBestFittingHistory("1337_seg")
+	if len(history.Cycles) != minSegmentCycles || history.Cycles[minSegmentCycles-1].StartTime.Unix() != 100 {
+		t.Errorf("rush hour history should be used: %v", history)
+		t.FailNow()
+	}
+}
+
+func TestUpdateHistoryAppendsToAllSegments(t *testing.T) {
+	enableSegmentation(t)
+	// Don't count this update in the metrics of other tests.
+	requested, processed := HistoryUpdatesRequested, HistoryUpdatesProcessed
+	defer func() { HistoryUpdatesRequested, HistoryUpdatesProcessed = requested, processed }()
+	env.StaticPath = t.TempDir()
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	start := time.Date(2023, 10, 2, 7, 30, 0, 0, berlin)
+	primarySignal := observations.CycleSnapshot{
+		Completed: []observations.Observation{
+			{PhenomenonTime: start, Result: 1},
+			{PhenomenonTime: start.Add(30 * time.Second), Result: 3},
+		},
+	}
+	program := observations.CycleSnapshot{Outdated: &observations.Observation{PhenomenonTime: start, Result: 5}}
+
+	_, err := UpdateHistory("1337_upd", start, start.Add(90*time.Second), primarySignal, program,
+		observations.CycleSnapshot{}, observations.CycleSnapshot{}, observations.CycleSnapshot{})
+	if err != nil {
+		t.Errorf("error during history update: %s", err)
+		t.FailNow()
+	}
+	for _, key := range []string{"1337_upd-P5-weekday-rush", "1337_upd-P5-weekday", "1337_upd-P5"} {
+		defer cache.Delete(key)
+		if history, err := LoadHistory(key); err != nil || len(history.Cycles) != 1 {
+			t.Errorf("cycle was not appended to %s: %v", key, err)
+			t.FailNow()
+		}
+	}
+}
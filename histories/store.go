@@ -0,0 +1,74 @@
+package histories
+
+import (
+	"fmt"
+	"predictor/env"
+)
+
+// A store that persists the histories by their key.
+// The key of a history is the thing name, optionally followed by the program, e.g. "96_22-P3".
+type HistoryStore interface {
+	// Load the history with the given key.
+	Load(key string) (History, error)
+	// Replace the history with the given key by the result of the update function and return it.
+	// The update function gets an empty history if none exists yet.
+	// Backends that support transactions read and write the history in a single transaction.
+	Update(key string, update func(History) History) (History, error)
+	// Replace the history with the given key.
+	Save(key string, history History) error
+	// Replace multiple histories by their key.
+	// Backends that support transactions write the whole batch at once.
+	SaveBatch(histories map[string]History) error
+	// Get the keys of all stored histories.
+	Keys() ([]string, error)
+	// Release the resources of the store.
+	Close() error
+}
+
+// The store in which the histories are persisted.
+var store HistoryStore = &FileStore{}
+
+// Get the key of the history of a thing, for a program or without a known program.
+// The segment, e.g. "weekday-rush", is appended to the key if it is not empty.
+func historyKey(thingName string, programId *byte, segment string) string {
+	key := thingName
+	if programId != nil {
+		key = fmt.Sprintf("%s-P%d", key, *programId)
+	}
+	if segment != "" {
+		key = fmt.Sprintf("%s-%s", key, segment)
+	}
+	return key
+}
+
+// Open a history store by its backend name.
+func OpenStore(backend string) (HistoryStore, error) {
+	switch backend {
+	case "file":
+		return &FileStore{Encoding: env.HistoryEncoding}, nil
+	case "bolt":
+		return OpenBoltStore(env.HistoryDbPath, env.HistoryEncoding)
+	}
+	return nil, fmt.Errorf("unknown history store backend: %s", backend)
+}
+
+// Open the history store that is configured in the environment.
+// This must be called before any history is loaded or updated.
+func InitStore() error {
+	configured, err := OpenStore(env.HistoryStore)
+	if err != nil {
+		return err
+	}
+	store = configured
+	return nil
+}
+
+// Write all dirty histories and close the store.
+// Histories that could not be flushed are lost, which is reported as an error.
+func CloseStore() error {
+	flushErr := FlushHistories()
+	if err := store.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
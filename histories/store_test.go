@@ -0,0 +1,114 @@
+package histories
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Get an update function that appends a cycle to a history with a fixed length.
+func appendTo(cycle HistoryCycle, maxLength int) func(History) History {
+	return func(history History) History {
+		history.Cycles = appendCycle(history.Cycles, cycle, maxLength)
+		return history
+	}
+}
+
+// Check the behavior that all history store backends must share.
+func testStore(t *testing.T, s HistoryStore) {
+	if _, err := s.Load("1337_1"); err == nil {
+		t.Errorf("loading a missing history should fail")
+		t.FailNow()
+	}
+	for i := 0; i < 5; i++ {
+		history, err := s.Update("1337_1", appendTo(HistoryCycle{StartTime: time.Unix(int64(i), 0)}, 3))
+		if err != nil {
+			t.Errorf("could not append to history: %s", err)
+			t.FailNow()
+		}
+		if len(history.Cycles) != i+1 && len(history.Cycles) != 3 {
+			t.Errorf("unexpected history length: %d", len(history.Cycles))
+			t.FailNow()
+		}
+	}
+	history, err := s.Load("1337_1")
+	if err != nil {
+		t.Errorf("could not load history: %s", err)
+		t.FailNow()
+	}
+	if len(history.Cycles) != 3 || history.Cycles[0].StartTime.Unix() != 2 {
+		t.Errorf("history was not truncated to the oldest cycles: %v", history.Cycles)
+		t.FailNow()
+	}
+	if err := s.Save("1337_1-P2", History{Cycles: []HistoryCycle{{StartTime: time.Unix(7, 0)}}}); err != nil {
+		t.Errorf("could not save history: %s", err)
+		t.FailNow()
+	}
+	keys, err := s.Keys()
+	if err != nil {
+		t.Errorf("could not list keys: %s", err)
+		t.FailNow()
+	}
+	sort.Strings(keys)
+	if fmt.Sprint(keys) != "[1337_1 1337_1-P2]" {
+		t.Errorf("unexpected keys: %v", keys)
+		t.FailNow()
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	testStore(t, &FileStore{Dir: t.TempDir()})
+	testStore(t, &FileStore{Dir: t.TempDir(), Encoding: EncodingBinary})
+}
+
+func TestBoltStore(t *testing.T) {
+	s, err := OpenBoltStore(fmt.Sprintf("%s/histories.db", t.TempDir()), EncodingBinary)
+	if err != nil {
+		t.Errorf("could not open bolt store: %s", err)
+		t.FailNow()
+	}
+	defer s.Close()
+	testStore(t, s)
+}
+
+func TestMigrate(t *testing.T) {
+	source := &FileStore{Dir: t.TempDir()}
+	target, err := OpenBoltStore(fmt.Sprintf("%s/histories.db", t.TempDir()), EncodingJSON)
+	if err != nil {
+		t.Errorf("could not open bolt store: %s", err)
+		t.FailNow()
+	}
+	defer target.Close()
+	source.Save("1337_1", History{Cycles: []HistoryCycle{{StartTime: time.Unix(1, 0)}}})
+	source.Save("1337_1-P2", History{Cycles: []HistoryCycle{{StartTime: time.Unix(2, 0)}, {StartTime: time.Unix(3, 0)}}})
+
+	migrated, err := migrate(source, target)
+	if err != nil || migrated != 2 {
+		t.Errorf("unexpected migration result: %d, %v", migrated, err)
+		t.FailNow()
+	}
+	history, err := target.Load("1337_1-P2")
+	if err != nil || len(history.Cycles) != 2 {
+		t.Errorf("history was not migrated: %v, %v", history, err)
+		t.FailNow()
+	}
+}
+
+func TestConvertFileEncoding(t *testing.T) {
+	dir := t.TempDir()
+	source := &FileStore{Dir: dir, Encoding: EncodingBinary}
+	target := &FileStore{Dir: dir, Encoding: EncodingJSON}
+	source.Save("1337_1", History{Cycles: []HistoryCycle{{StartTime: time.Unix(1, 0)}}})
+
+	converted, err := migrate(source, target)
+	if err != nil || converted != 1 {
+		t.Errorf("unexpected conversion result: %d, %v", converted, err)
+		t.FailNow()
+	}
+	history, err := decodeHistoryFile(fmt.Sprintf("%s/1337_1.json", dir))
+	if err != nil || len(history.Cycles) != 1 {
+		t.Errorf("history was not exported as json: %v, %v", history, err)
+		t.FailNow()
+	}
+}
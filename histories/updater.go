@@ -2,10 +2,11 @@ package histories
 
 import (
 	"fmt"
-	"predictor/env"
+	"predictor/deadletters"
 	"predictor/log"
 	"predictor/observations"
 	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -14,6 +15,42 @@ var HistoryUpdatesRequested uint64 = 0
 var HistoryUpdatesDiscarded uint64 = 0
 var HistoryUpdatesProcessed uint64 = 0
 
+// The processed and discarded history updates of a thing.
+type thingUpdates struct {
+	processed uint64
+	discarded uint64
+}
+
+// The history updates by thing name.
+var updatesByThing = sync.Map{}
+
+// Count a processed or discarded history update of a thing.
+func countThingUpdate(thingName string, discarded bool) {
+	value, _ := updatesByThing.LoadOrStore(thingName, &thingUpdates{})
+	updates := value.(*thingUpdates)
+	if discarded {
+		atomic.AddUint64(&updates.discarded, 1)
+	} else {
+		atomic.AddUint64(&updates.processed, 1)
+	}
+	atomic.StoreInt32(&indexChanged, 1)
+}
+
+// Get the share of the history updates of a thing that were discarded.
+func discardRate(thingName string) float64 {
+	value, ok := updatesByThing.Load(thingName)
+	if !ok {
+		return 0
+	}
+	updates := value.(*thingUpdates)
+	processed := atomic.LoadUint64(&updates.processed)
+	discarded := atomic.LoadUint64(&updates.discarded)
+	if processed+discarded == 0 {
+		return 0
+	}
+	return float64(discarded) / float64(processed+discarded)
+}
+
 // Update the history file for the given thing.
 func UpdateHistory(
 	thingName string,
@@ -64,6 +101,17 @@ func UpdateHistory(
 	err := validatePhases(newCycleStartTime, newCycleEndTime, phases)
 	if err != nil {
 		atomic.AddUint64(&HistoryUpdatesDiscarded, 1)
+		countThingUpdate(thingName, true)
+		deadletters.Add(deadletters.Letter{
+			Thing:  thingName,
+			Stage:  deadletters.StageHistory,
+			Reason: fmt.Sprintf("phase validity check failed: %v", err),
+			Snapshot: HistoryCycle{
+				StartTime: newCycleStartTime,
+				EndTime:   newCycleEndTime,
+				Phases:    phases,
+			},
+		})
 		return History{}, fmt.Errorf("phase validity check failed: %v", err)
 	}
 
@@ -137,22 +185,41 @@ func UpdateHistory(
 		Bikes:     bikes,
 	}
 
-	// Append this history to the history file.
-	var path = fmt.Sprintf("%s/history/%s.json", env.StaticPath, thingName)
-	// Get the last program that was running on the signal.
-	programObservation, err := completedSignalProgramCycle.GetMostRecentObservation()
-	if err == nil {
-		programId := programObservation.Result
-		path = fmt.Sprintf("%s/history/%s-P%d.json", env.StaticPath, thingName, programId)
-		historyCycle.Program = &programId
+	// Append this cycle to the history of the last program that was running on the signal.
+	var programId *byte
+	// Cycles without a known program are appended to the history without a program.
+	if programObservation, programErr := completedSignalProgramCycle.GetMostRecentObservation(); programErr == nil {
+		programId = &programObservation.Result
+		historyCycle.Program = programId
 	}
 
-	history, err := appendToHistoryFile(path, *historyCycle)
+	// Append the cycle to the histories of all segments, so that the less specific
+	// histories can be used as a fallback. The most specific history is returned.
+	var history History
+	for i, segment := range segmentsAt(newCycleStartTime) {
+		segmentHistory, appendErr := appendToHistory(historyKey(thingName, programId, segment), *historyCycle)
+		if appendErr != nil {
+			err = appendErr
+			break
+		}
+		if i == 0 {
+			history = segmentHistory
+		}
+	}
 	if err != nil {
 		atomic.AddUint64(&HistoryUpdatesDiscarded, 1)
+		countThingUpdate(thingName, true)
+		deadletters.Add(deadletters.Letter{
+			Thing:    thingName,
+			Stage:    deadletters.StageHistory,
+			Reason:   fmt.Sprintf("could not append to history: %v", err),
+			Snapshot: *historyCycle,
+		})
 		return History{}, err
 	}
 
 	atomic.AddUint64(&HistoryUpdatesProcessed, 1)
+	countThingUpdate(thingName, false)
+	HistoryUpdatedBus.Publish(thingName, HistoryUpdated{thingName, *historyCycle, history})
 	return history, nil
 }
@@ -131,3 +131,34 @@ func TestUpdater(t *testing.T) {
 		t.Errorf("there should be one requested history update")
 	}
 }
+
+func TestUpdaterWithoutProgram(t *testing.T) {
+	// Don't count this update in the metrics of other tests.
+	requested, processed, discarded := HistoryUpdatesRequested, HistoryUpdatesProcessed, HistoryUpdatesDiscarded
+	defer func() {
+		HistoryUpdatesRequested, HistoryUpdatesProcessed, HistoryUpdatesDiscarded = requested, processed, discarded
+	}()
+	env.StaticPath = t.TempDir()
+	primarySignal := observations.CycleSnapshot{
+		Completed: []observations.Observation{
+			{PhenomenonTime: time.Unix(0, 0), Result: 1},
+			{PhenomenonTime: time.Unix(30, 0), Result: 3},
+		},
+	}
+
+	history, err := UpdateHistory("1337_noprog", time.Unix(0, 0), time.Unix(90, 0), primarySignal,
+		observations.CycleSnapshot{}, observations.CycleSnapshot{}, observations.CycleSnapshot{}, observations.CycleSnapshot{})
+	defer cache.Delete("1337_noprog")
+	if err != nil {
+		t.Errorf("a cycle without a program should be appended: %s", err)
+		t.FailNow()
+	}
+	if len(history.Cycles) != 1 || history.Cycles[0].Program != nil {
+		t.Errorf("unexpected history: %v", history)
+		t.FailNow()
+	}
+	if HistoryUpdatesDiscarded != discarded || HistoryUpdatesProcessed != processed+1 {
+		t.Errorf("the update should be counted as processed")
+		t.FailNow()
+	}
+}
@@ -1,86 +1,210 @@
 package main
 
 import (
+	"os"
+	"os/signal"
+	"predictor/api"
+	"predictor/archive"
+	"predictor/backfill"
+	"predictor/deadletters"
 	"predictor/env"
+	"predictor/export"
 	"predictor/histories"
+	"predictor/log"
 	"predictor/monitor"
 	"predictor/observations"
 	"predictor/predictions"
 	"predictor/things"
-	"time"
+	"syscall"
 )
 
 func main() {
 	env.Init()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigration(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		runConversion(os.Args[2:])
+		return
+	}
+	// Open the store in which the histories are persisted.
+	if err := histories.InitStore(); err != nil {
+		log.Error.Println("Could not open history store:", err)
+		os.Exit(1)
+	}
+	// Load the segmentation of the histories by day type and time of day.
+	if err := histories.InitSegments(); err != nil {
+		log.Error.Println("Could not load history segments:", err)
+		os.Exit(1)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		runBackfill(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		runExport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
+	}
+	// Flush the histories if the service crashes, e.g. when no messages are received.
+	defer histories.FlushOnPanic()
 	// Sync the things.
 	things.SyncThings()
 	// Update the history index once for the cycle visualizer.
 	histories.UpdateHistoryIndex()
 	// Update the history index periodically for the cycle visualizer.
-	go histories.UpdateHistoryIndexPeriodically()
+	go flushOnPanic(histories.UpdateHistoryIndexPeriodically)
+	// Subscribe to the events of the pipeline.
+	subscribe()
 	// Prefetch all most recent observations.
 	observations.PrefetchMostRecentObservations()
 	// Connect to the mqtt broker and listen for observations.
 	observations.ConnectObservationListener()
 	// Check periodically how many messages were received.
-	go observations.CheckReceivedMessagesPeriodically()
+	go flushOnPanic(observations.CheckReceivedMessagesPeriodically)
 	// Run a cleanup periodically.
-	go observations.RunCleanupPeriodically()
+	go flushOnPanic(observations.RunCleanupPeriodically)
+	// Write the discarded observations and cycles periodically.
+	go flushOnPanic(deadletters.WriteFilesPeriodically)
 	// Connect the prediction publisher.
 	predictions.ConnectMQTTClient()
 	// Publish all predictions.
 	predictions.PublishAllBestPredictions()
 	// Publish all predictions periodically.
-	go predictions.PublishAllBestPredictionsPeriodically()
+	go flushOnPanic(predictions.PublishAllBestPredictionsPeriodically)
+	// Withdraw predictions of things that stopped sending data.
+	go flushOnPanic(predictions.CheckStaleThingsPeriodically)
 	// Check the quality of predictions periodically.
-	go predictions.CheckPredictionQualityPeriodically()
+	go flushOnPanic(predictions.CheckPredictionQualityPeriodically)
 	// Update the prediction metrics once for the dashboard.
 	monitor.UpdateMetricsFiles()
 	monitor.WriteGeoJSONMap()
 	monitor.WriteStatusForEachSG()
 	monitor.WriteSummary()
 	// Update the prediction metrics periodically for the dashboard.
-	go monitor.UpdateMetricsFilesPeriodically()
-	go monitor.UpdateGeoJSONMapPeriodically()
-	go monitor.UpdateSGStatusPeriodically()
-	go monitor.UpdateStatusSummaryPeriodically()
-	// Bind the callbacks.
-	observations.PrimarySignalCallback = func(thingName string) {
-		predictions.PublishBestPrediction(thingName)
+	go flushOnPanic(monitor.UpdateMetricsFilesPeriodically)
+	go flushOnPanic(monitor.UpdateGeoJSONMapPeriodically)
+	go flushOnPanic(monitor.UpdateSGStatusPeriodically)
+	go flushOnPanic(monitor.UpdateStatusSummaryPeriodically)
+	// Serve the HTTP API, e.g. for timeline queries.
+	go flushOnPanic(api.Serve)
+	// Flush the histories periodically to the store.
+	go flushOnPanic(histories.FlushHistoriesPeriodically)
+	// Flush the archive periodically and remove old days.
+	go flushOnPanic(archive.RunPeriodically)
+	// Wait until the service is stopped, and flush the histories before exiting.
+	waitForShutdown()
+}
+
+// Run a long-running task and flush the histories if it panics.
+func flushOnPanic(task func()) {
+	defer histories.FlushOnPanic()
+	task()
+}
+
+// Wait for a termination signal and write all pending histories before exiting.
+func waitForShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Info.Printf("Received %s, flushing histories before shutdown.", sig)
+	archive.Flush()
+	if err := histories.CloseStore(); err != nil {
+		log.Error.Println("Could not close history store:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Rebuild the history files from the observation archive and exit.
+func runBackfill(args []string) {
+	// Sync the things to know which datastreams to backfill.
+	things.SyncThings()
+	if err := backfill.Run(args); err != nil {
+		log.Error.Println("Backfill failed:", err)
+		histories.CloseStore()
+		os.Exit(1)
+	}
+	if err := histories.CloseStore(); err != nil {
+		log.Error.Println("Could not close history store:", err)
+		os.Exit(1)
 	}
-	observations.SignalProgramCallback = func(thingName string) {
-		predictions.PublishBestPrediction(thingName)
+	// Update the history index for the cycle visualizer.
+	histories.UpdateHistoryIndex()
+}
+
+// Copy the histories between two store backends and exit.
+func runMigration(args []string) {
+	if err := histories.RunMigration(args); err != nil {
+		log.Error.Println("Migration failed:", err)
+		os.Exit(1)
 	}
-	observations.CarDetectorCallback = func(thingName string) {
-		// This currently has no influence on the predictions.
+}
+
+// Export the histories and the archive and exit.
+func runExport(args []string) {
+	if err := export.Run(args); err != nil {
+		log.Error.Println("Export failed:", err)
+		os.Exit(1)
 	}
-	observations.BikeDetectorCallback = func(thingName string) {
-		// This currently has no influence on the predictions.
+}
+
+// Merge the histories of another instance into the history store and exit.
+func runImport(args []string) {
+	if err := histories.RunImport(args); err != nil {
+		log.Error.Println("Import failed:", err)
+		os.Exit(1)
 	}
-	observations.CycleSecondCallback = func(
-		thingName string,
-		newCycleStartTime time.Time, newCycleEndTime time.Time,
-		completedPrimarySignalCycle observations.CycleSnapshot,
-		completedSignalProgramCycle observations.CycleSnapshot,
-		completedCycleSecondCycle observations.CycleSnapshot,
-		completedCarDetectorCycle observations.CycleSnapshot,
-		completedBikeDetectorCycle observations.CycleSnapshot,
-	) {
-		_, err := histories.UpdateHistory(
-			thingName,
-			newCycleStartTime, newCycleEndTime,
-			completedPrimarySignalCycle,
-			completedSignalProgramCycle,
-			completedCycleSecondCycle,
-			completedCarDetectorCycle,
-			completedBikeDetectorCycle,
-		)
-		if err != nil {
-			return
-		}
-		predictions.PublishBestPrediction(thingName)
+	if err := histories.CloseStore(); err != nil {
+		log.Error.Println("Could not close history store:", err)
+		os.Exit(1)
+	}
+	// Update the history index for the cycle visualizer.
+	histories.UpdateHistoryIndex()
+}
+
+// Convert the histories into another encoding and exit.
+func runConversion(args []string) {
+	if err := histories.RunConversion(args); err != nil {
+		log.Error.Println("Conversion failed:", err)
+		os.Exit(1)
 	}
+}
 
-	// Wait forever.
-	select {}
+// Subscribe to the events of the pipeline.
+func subscribe() {
+	// Update the prediction when the signal or program changes.
+	// The prediction is published asynchronously, so that a slow MQTT publish
+	// doesn't block the delivery of the events of other things.
+	observations.ObservationReceivedBus.Subscribe("predictions", func(e observations.ObservationReceived) {
+		if e.Layer == "primary_signal" || e.Layer == "signal_program" {
+			go predictions.PublishBestPrediction(e.Thing)
+		}
+	})
+	// Append completed cycles to the history.
+	observations.CycleCompletedBus.Subscribe("histories", func(e observations.CycleCompleted) {
+		histories.UpdateHistory(
+			e.Thing,
+			e.StartTime, e.EndTime,
+			e.Layers["primary_signal"],
+			e.Layers["signal_program"],
+			e.Layers["cycle_second"],
+			e.Layers["detector_car"],
+			e.Layers["detector_bike"],
+		)
+	})
+	// Update the prediction when the history changed.
+	histories.HistoryUpdatedBus.Subscribe("predictions", func(e histories.HistoryUpdated) {
+		go predictions.PublishBestPrediction(e.Thing)
+	})
+	// Keep every completed cycle in the long-term archive.
+	histories.HistoryUpdatedBus.Subscribe("archive", func(e histories.HistoryUpdated) {
+		archive.Add(e.Thing, e.Cycle)
+	})
+	// Count the published predictions by the kind of history they are based on.
+	predictions.PredictionPublishedBus.Subscribe("metrics", monitor.CountPublishedPrediction)
 }
@@ -18,6 +18,7 @@ import (
 var (
 	getAllThingsForMap         = things.Things.Range              // pointer ref
 	getCurrentPredictionForMap = predictions.GetCurrentPrediction // func ref
+	getOfflineSinceForMap      = predictions.GetOfflineSince      // func ref
 )
 
 // Write geojson data that can be used to visualize the predictions.
@@ -55,6 +56,8 @@ func WriteGeoJSONMap() {
 			properties["prediction_sg_id"] = ""
 		}
 		// Add thing-related properties.
+		_, offline := getOfflineSinceForMap(thingName)
+		properties["thing_offline"] = offline
 		properties["thing_name"] = thing.Name
 		properties["thing_properties_lanetype"] = thing.Properties.LaneType
 
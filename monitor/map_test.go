@@ -123,6 +123,9 @@ func TestWriteGeoJSONMap(t *testing.T) {
 		"prediction_sg_id": func(v interface{}) bool {
 			return v.(string) == "1337_1"
 		},
+		"thing_offline": func(v interface{}) bool {
+			return v.(bool) == false
+		},
 	}
 
 	for key, check := range propertyChecks {
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"predictor/archive"
 	"predictor/calc"
+	"predictor/deadletters"
 	"predictor/env"
+	"predictor/events"
 	"predictor/histories"
 	"predictor/observations"
 	"predictor/predictions"
@@ -14,6 +17,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,6 +40,22 @@ type MetricsEntry struct {
 	PredictionAge     *int   `json:"age"`       // The age of the prediction in seconds.
 }
 
+// The number of published predictions that are based on a program-specific history.
+var PredictionsWithProgram uint64 = 0
+
+// The number of published predictions that are based on a history without a program.
+var PredictionsWithoutProgram uint64 = 0
+
+// Count a published prediction by the kind of history it is based on.
+// A high share without a program indicates that the program histories are not filled yet.
+func CountPublishedPrediction(e predictions.PredictionPublished) {
+	if e.Prediction.ProgramId != nil {
+		atomic.AddUint64(&PredictionsWithProgram, 1)
+	} else {
+		atomic.AddUint64(&PredictionsWithoutProgram, 1)
+	}
+}
+
 // The lock that must be used when writing or reading the metrics file.
 // This is to gobally protect concurrent access to the same file.
 var metricsFileLock = &sync.Mutex{}
@@ -45,19 +65,42 @@ var (
 	getAllThingsForMetrics            = things.Things.Range                            // pointer ref
 	getCurrentPrimarySignalForMetrics = observations.GetCurrentPrimarySignal           // func ref
 	getCurrentProgramForMetrics       = observations.GetCurrentProgram                 // func ref
+	getClockOffsetForMetrics          = observations.GetClockOffset                    // func ref
+	getLatencyHistograms              = observations.RangeLatencyHistograms            // func ref
+	getLatencyStatsForMetrics         = observations.GetLatencyStats                   // func ref
 	getAllPredictionQualities         = predictions.GetPredictionQualities             // func ref
 	getCurrentPredictionForMetrics    = predictions.GetCurrentPrediction               // func ref
 	getLastPredictionTimeForMetrics   = predictions.GetLastPredictionTime              // func ref
 	getObservationsReceivedByTopic    = observations.ObservationsReceivedByTopic.Range // pointer ref
+	getObservationsRejectedByRule     = observations.ObservationsRejectedByRule.Range  // pointer ref
+	getObservationsRejectedByThing    = observations.ObservationsRejectedByThing.Range // pointer ref
+	getQuarantinesByReason            = observations.QuarantinesByReason.Range         // pointer ref
+	getNumberOfQuarantinedForMetrics  = observations.CountQuarantined                  // func ref
 	getObservationsReceived           = func() uint64 { return observations.ObservationsReceived }
 	getObservationsProcessed          = func() uint64 { return observations.ObservationsProcessed }
 	getObservationsDiscarded          = func() uint64 { return observations.ObservationsDiscarded }
+	getObservationsDuplicated         = func() uint64 { return observations.ObservationsDuplicated }
+	getObservationsQuarantined        = func() uint64 { return observations.ObservationsQuarantined }
+	getDeadLettersAdded               = func() uint64 { return deadletters.LettersAdded }
+	getEventStats                     = events.GetStats // func ref
+	getCyclesArchived                 = func() uint64 { return archive.CyclesArchived }
+	getCyclesFailedToArchive          = func() uint64 { return archive.CyclesFailed }
+	getCyclesDroppedFromArchive       = func() uint64 { return archive.CyclesDropped }
 	getHistoryUpdatesRequested        = func() uint64 { return histories.HistoryUpdatesRequested }
 	getHistoryUpdatesProcessed        = func() uint64 { return histories.HistoryUpdatesProcessed }
 	getHistoryUpdatesDiscarded        = func() uint64 { return histories.HistoryUpdatesDiscarded }
+	getHistoryFilesCorrupted          = func() uint64 { return histories.HistoryFilesCorrupted }
+	getHistoryFilesRecovered          = func() uint64 { return histories.HistoryFilesRecovered }
+	getHistoryCyclesAppended          = func() uint64 { return histories.HistoryCyclesAppended }
+	getHistoryFlushesWritten          = func() uint64 { return histories.HistoryFlushesWritten }
+	getHistoryFlushesFailed           = func() uint64 { return histories.HistoryFlushesFailed }
+	getHistoryFlushDurationMs         = func() int64 { return atomic.LoadInt64(&histories.HistoryFlushDurationMs) }
+	getNumberOfDirtyHistories         = histories.CountDirty // func ref
 	getPredictionsChecked             = func() uint64 { return predictions.PredictionsChecked }
 	getPredictionsPublished           = func() uint64 { return predictions.PredictionsPublished }
 	getPredictionsDiscarded           = func() uint64 { return predictions.PredictionsDiscarded }
+	getPredictionsWithProgram         = func() uint64 { return atomic.LoadUint64(&PredictionsWithProgram) }
+	getPredictionsWithoutProgram      = func() uint64 { return atomic.LoadUint64(&PredictionsWithoutProgram) }
 )
 
 func generateMetrics() Metrics {
@@ -94,6 +137,7 @@ func generateMetrics() Metrics {
 			Sub(primarySignalObservation.PhenomenonTime)
 		delaySum += timeDelay.Seconds()
 		delayCount++ // For mean delay calculation.
+		timeDelay -= getClockOffsetForMetrics(thingName)
 		// Calculate the current time, subtracting the delay. In this way, we
 		// compare a delayed prediction with a delayed observation.
 		nowWithDelay := time.Now().Add(-timeDelay)
@@ -204,22 +248,67 @@ func generatePrometheusMetrics(m Metrics) []string {
 	lines = append(lines, fmt.Sprintf("predictor_observations{action=\"received\"} %d", getObservationsReceived()))
 	lines = append(lines, fmt.Sprintf("predictor_observations{action=\"processed\"} %d", getObservationsProcessed()))
 	lines = append(lines, fmt.Sprintf("predictor_observations{action=\"discarded\"} %d", getObservationsDiscarded()))
+	lines = append(lines, fmt.Sprintf("predictor_observations{action=\"duplicated\"} %d", getObservationsDuplicated()))
+	lines = append(lines, fmt.Sprintf("predictor_observations{action=\"quarantined\"} %d", getObservationsQuarantined()))
 	getObservationsReceivedByTopic(func(k, v interface{}) bool {
 		dsType := k.(string)
 		count := v.(uint64)
 		lines = append(lines, fmt.Sprintf("predictor_observations_by_topic{topic=\"%s\"} %d", dsType, count))
 		return true
 	})
+	getObservationsRejectedByRule(func(k, v interface{}) bool {
+		key := k.(observations.RejectionKey)
+		count := atomic.LoadUint64(v.(*uint64))
+		lines = append(lines, fmt.Sprintf("predictor_observations_rejected{layer=\"%s\",rule=\"%s\"} %d", key.Layer, key.Rule, count))
+		return true
+	})
+	getObservationsRejectedByThing(func(k, v interface{}) bool {
+		thingName := k.(string)
+		count := atomic.LoadUint64(v.(*uint64))
+		lines = append(lines, fmt.Sprintf("predictor_observations_rejected_by_thing{thing=\"%s\"} %d", thingName, count))
+		return true
+	})
+
+	// Add metrics for the quarantined datastreams.
+	lines = append(lines, fmt.Sprintf("predictor_quarantined_topics %d", getNumberOfQuarantinedForMetrics()))
+	getQuarantinesByReason(func(k, v interface{}) bool {
+		reason := k.(string)
+		count := atomic.LoadUint64(v.(*uint64))
+		lines = append(lines, fmt.Sprintf("predictor_quarantines{reason=\"%s\"} %d", reason, count))
+		return true
+	})
+
+	// Add metrics for the discarded observations and cycles.
+	lines = append(lines, fmt.Sprintf("predictor_dead_letters %d", getDeadLettersAdded()))
+
+	// Add metrics for the event buses of the pipeline.
+	for _, s := range getEventStats() {
+		lines = append(lines, fmt.Sprintf("predictor_events{bus=\"%s\",action=\"published\"} %d", s.Bus, s.Published))
+		lines = append(lines, fmt.Sprintf("predictor_events{bus=\"%s\",action=\"delivered\"} %d", s.Bus, s.Delivered))
+		lines = append(lines, fmt.Sprintf("predictor_events{bus=\"%s\",action=\"panicked\"} %d", s.Bus, s.Panics))
+	}
 
 	// Add metrics for the histories.
 	lines = append(lines, fmt.Sprintf("predictor_histories{action=\"requested\"} %d", getHistoryUpdatesRequested()))
 	lines = append(lines, fmt.Sprintf("predictor_histories{action=\"processed\"} %d", getHistoryUpdatesProcessed()))
 	lines = append(lines, fmt.Sprintf("predictor_histories{action=\"discarded\"} %d", getHistoryUpdatesDiscarded()))
+	lines = append(lines, fmt.Sprintf("predictor_history_files{action=\"corrupted\"} %d", getHistoryFilesCorrupted()))
+	lines = append(lines, fmt.Sprintf("predictor_history_files{action=\"recovered\"} %d", getHistoryFilesRecovered()))
+	lines = append(lines, fmt.Sprintf("predictor_history_appends %d", getHistoryCyclesAppended()))
+	lines = append(lines, fmt.Sprintf("predictor_history_flushes{action=\"written\"} %d", getHistoryFlushesWritten()))
+	lines = append(lines, fmt.Sprintf("predictor_history_flushes{action=\"failed\"} %d", getHistoryFlushesFailed()))
+	lines = append(lines, fmt.Sprintf("predictor_history_flush_duration_ms %d", getHistoryFlushDurationMs()))
+	lines = append(lines, fmt.Sprintf("predictor_history_dirty %d", getNumberOfDirtyHistories()))
+	lines = append(lines, fmt.Sprintf("predictor_archive{action=\"archived\"} %d", getCyclesArchived()))
+	lines = append(lines, fmt.Sprintf("predictor_archive{action=\"failed\"} %d", getCyclesFailedToArchive()))
+	lines = append(lines, fmt.Sprintf("predictor_archive{action=\"dropped\"} %d", getCyclesDroppedFromArchive()))
 
 	// Add metrics for the predictions.
 	lines = append(lines, fmt.Sprintf("predictor_predictions{action=\"checked\"} %d", getPredictionsChecked()))
 	lines = append(lines, fmt.Sprintf("predictor_predictions{action=\"published\"} %d", getPredictionsPublished()))
 	lines = append(lines, fmt.Sprintf("predictor_predictions{action=\"discarded\"} %d", getPredictionsDiscarded()))
+	lines = append(lines, fmt.Sprintf("predictor_predictions_by_program{program=\"known\"} %d", getPredictionsWithProgram()))
+	lines = append(lines, fmt.Sprintf("predictor_predictions_by_program{program=\"unknown\"} %d", getPredictionsWithoutProgram()))
 
 	for bucket, value := range m.Deviations {
 		// Add with trailing 0s to make the graph look nicer.
@@ -283,6 +372,62 @@ func generatePrometheusMetrics(m Metrics) []string {
 	// Sort alphabetically.
 	sort.Strings(lines)
 
+	// Add the message delay metrics after sorting, since each family must be a single group.
+	lines = append(lines, generateLatencyMetrics()...)
+
+	return lines
+}
+
+// Convert the message delays of all things to prometheus metrics, grouped by family.
+// The histogram counts all delays since the start, while the percentiles are rolling.
+func generateLatencyMetrics() []string {
+	histograms := map[string]observations.LatencyHistogram{}
+	thingNames := []string{}
+	getLatencyHistograms(func(thingName string, histogram observations.LatencyHistogram) bool {
+		histograms[thingName] = histogram
+		thingNames = append(thingNames, thingName)
+		return true
+	})
+	sort.Strings(thingNames)
+
+	lines := []string{"# TYPE predictor_thing_msg_delay_seconds histogram"}
+	for _, thingName := range thingNames {
+		histogram := histograms[thingName]
+		for i, bucket := range observations.LatencyBuckets {
+			lines = append(lines, fmt.Sprintf("predictor_thing_msg_delay_seconds_bucket{thing=\"%s\",le=\"%.1f\"} %d", thingName, bucket, histogram.Buckets[i]))
+		}
+		lines = append(lines, fmt.Sprintf("predictor_thing_msg_delay_seconds_bucket{thing=\"%s\",le=\"+Inf\"} %d", thingName, histogram.Count))
+		lines = append(lines, fmt.Sprintf("predictor_thing_msg_delay_seconds_sum{thing=\"%s\"} %f", thingName, histogram.Sum))
+		lines = append(lines, fmt.Sprintf("predictor_thing_msg_delay_seconds_count{thing=\"%s\"} %d", thingName, histogram.Count))
+	}
+
+	stats := map[string]observations.LatencyStats{}
+	for _, thingName := range thingNames {
+		if s, ok := getLatencyStatsForMetrics(thingName); ok {
+			stats[thingName] = s
+		}
+	}
+	gauges := []struct {
+		name  string
+		value func(s observations.LatencyStats) time.Duration
+	}{
+		{"predictor_thing_msg_delay_p50", func(s observations.LatencyStats) time.Duration { return s.P50 }},
+		{"predictor_thing_msg_delay_p95", func(s observations.LatencyStats) time.Duration { return s.P95 }},
+		{"predictor_thing_msg_delay_max", func(s observations.LatencyStats) time.Duration { return s.Max }},
+	}
+	for _, gauge := range gauges {
+		lines = append(lines, fmt.Sprintf("# TYPE %s gauge", gauge.name))
+		for _, thingName := range thingNames {
+			if s, ok := stats[thingName]; ok {
+				lines = append(lines, fmt.Sprintf("%s{thing=\"%s\"} %f", gauge.name, thingName, gauge.value(s).Seconds()))
+			}
+		}
+	}
+
+	lines = append(lines, "# TYPE predictor_thing_clock_offset_seconds gauge")
+	for _, thingName := range thingNames {
+		lines = append(lines, fmt.Sprintf("predictor_thing_clock_offset_seconds{thing=\"%s\"} %f", thingName, getClockOffsetForMetrics(thingName).Seconds()))
+	}
 	return lines
 }
 
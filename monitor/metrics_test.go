@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"predictor/env"
+	"predictor/events"
 	"predictor/observations"
 	"predictor/predictions"
 	"predictor/things"
@@ -43,6 +44,16 @@ func prepareMocks() {
 			ReferenceTime: time.Unix(0, 0),
 		}, true
 	}
+	getClockOffsetForMetrics = func(_ string) time.Duration {
+		return 0
+	}
+	getLatencyHistograms = func(f func(thingName string, histogram observations.LatencyHistogram) bool) {
+		f("1337_1", observations.LatencyHistogram{Buckets: []uint64{0, 1, 1, 2, 2, 2, 2, 2}, Sum: 4, Count: 2})
+		f("1337_2", observations.LatencyHistogram{Buckets: []uint64{0, 0, 0, 0, 0, 0, 0, 1}, Sum: 100, Count: 1})
+	}
+	getLatencyStatsForMetrics = func(_ string) (observations.LatencyStats, bool) {
+		return observations.LatencyStats{P50: time.Second, P95: 3 * time.Second, Max: 3 * time.Second, Count: 2}, true
+	}
 	getLastPredictionTimeForMetrics = func(_ string) (time.Time, bool) {
 		return time.Unix(0, 0), true
 	}
@@ -53,6 +64,21 @@ func prepareMocks() {
 		f("detector_bike", uint64(0))
 		f("detector_car", uint64(0))
 	}
+	getObservationsRejectedByRule = func(f func(k, v interface{}) bool) {
+		count := uint64(1)
+		f(observations.RejectionKey{Layer: "primary_signal", Rule: "signal_color"}, &count)
+	}
+	getObservationsRejectedByThing = func(f func(k, v interface{}) bool) {
+		count := uint64(1)
+		f("1337_1", &count)
+	}
+	getQuarantinesByReason = func(f func(k, v interface{}) bool) {
+		count := uint64(1)
+		f("flapping", &count)
+	}
+	getNumberOfQuarantinedForMetrics = func() int {
+		return 1
+	}
 	getObservationsReceived = func() uint64 {
 		return 1
 	}
@@ -62,6 +88,27 @@ func prepareMocks() {
 	getObservationsDiscarded = func() uint64 {
 		return 1
 	}
+	getObservationsDuplicated = func() uint64 {
+		return 1
+	}
+	getObservationsQuarantined = func() uint64 {
+		return 1
+	}
+	getDeadLettersAdded = func() uint64 {
+		return 1
+	}
+	getEventStats = func() []events.Stats {
+		return []events.Stats{{Bus: "cycle_completed", Published: 1, Delivered: 1, Panics: 1}}
+	}
+	getCyclesArchived = func() uint64 {
+		return 1
+	}
+	getCyclesFailedToArchive = func() uint64 {
+		return 1
+	}
+	getCyclesDroppedFromArchive = func() uint64 {
+		return 1
+	}
 	getHistoryUpdatesRequested = func() uint64 {
 		return 1
 	}
@@ -71,12 +118,39 @@ func prepareMocks() {
 	getHistoryUpdatesDiscarded = func() uint64 {
 		return 1
 	}
+	getHistoryFilesCorrupted = func() uint64 {
+		return 1
+	}
+	getHistoryFilesRecovered = func() uint64 {
+		return 1
+	}
+	getHistoryCyclesAppended = func() uint64 {
+		return 1
+	}
+	getHistoryFlushesWritten = func() uint64 {
+		return 1
+	}
+	getHistoryFlushesFailed = func() uint64 {
+		return 1
+	}
+	getHistoryFlushDurationMs = func() int64 {
+		return 1
+	}
+	getNumberOfDirtyHistories = func() int64 {
+		return 1
+	}
 	getPredictionsChecked = func() uint64 {
 		return 1
 	}
 	getPredictionsPublished = func() uint64 {
 		return 1
 	}
+	getPredictionsWithProgram = func() uint64 {
+		return 1
+	}
+	getPredictionsWithoutProgram = func() uint64 {
+		return 1
+	}
 	getPredictionsDiscarded = func() uint64 {
 		return 1
 	}
@@ -159,16 +233,80 @@ func TestGeneratePrometheusMetrics(t *testing.T) {
 	}
 	if !search("predictor_observations{action=\"received\"}", 1) || //
 		!search("predictor_observations{action=\"processed\"}", 1) || //
-		!search("predictor_observations{action=\"discarded\"}", 1) {
+		!search("predictor_observations{action=\"discarded\"}", 1) || //
+		!search("predictor_observations{action=\"duplicated\"}", 1) || //
+		!search("predictor_observations{action=\"quarantined\"}", 1) || //
+		!search("predictor_quarantined_topics", 1) || //
+		!search("predictor_quarantines{reason=\"flapping\"}", 1) {
+		t.Errorf("unexpected metrics value")
+		t.FailNow()
+	}
+	if !search("predictor_thing_msg_delay_seconds_bucket{thing=\"1337_1\",le=\"1.0\"}", 1) || //
+		!search("predictor_thing_msg_delay_seconds_bucket{thing=\"1337_1\",le=\"5.0\"}", 2) || //
+		!search("predictor_thing_msg_delay_seconds_count{thing=\"1337_1\"}", 2) || //
+		!search("predictor_thing_msg_delay_p95{thing=\"1337_1\"}", 3.0) {
+		t.Errorf("unexpected latency metrics value")
+		t.FailNow()
+	}
+	// Each metric family must be a single group, following its type.
+	family := func(line string) string {
+		if strings.HasPrefix(line, "# TYPE ") {
+			return strings.Fields(line)[2]
+		}
+		name := strings.FieldsFunc(line, func(r rune) bool { return r == '{' || r == ' ' })[0]
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			name = strings.TrimSuffix(name, suffix)
+		}
+		return name
+	}
+	finished := map[string]bool{}
+	previous := ""
+	for _, line := range prometheusMetrics {
+		if !strings.HasPrefix(line, "predictor_thing_") && !strings.HasPrefix(line, "# TYPE predictor_thing_") {
+			continue
+		}
+		current := family(line)
+		if current != previous {
+			if finished[current] {
+				t.Errorf("metric family %s is not a single group", current)
+				t.FailNow()
+			}
+			finished[previous] = true
+			previous = current
+		}
+	}
+	if !search("predictor_events{bus=\"cycle_completed\",action=\"published\"}", 1) || //
+		!search("predictor_events{bus=\"cycle_completed\",action=\"panicked\"}", 1) {
+		t.Errorf("unexpected event metrics value")
+		t.FailNow()
+	}
+	if !search("predictor_dead_letters", 1) {
 		t.Errorf("unexpected metrics value")
 		t.FailNow()
 	}
 	if !search("predictor_histories{action=\"requested\"}", 1) || //
 		!search("predictor_histories{action=\"processed\"}", 1) || //
 		!search("predictor_histories{action=\"discarded\"}", 1) || //
+		!search("predictor_history_files{action=\"corrupted\"}", 1) || //
+		!search("predictor_history_files{action=\"recovered\"}", 1) || //
+		!search("predictor_history_appends", 1) || //
+		!search("predictor_history_flushes{action=\"written\"}", 1) || //
+		!search("predictor_history_flushes{action=\"failed\"}", 1) || //
+		!search("predictor_history_flush_duration_ms", 1) || //
+		!search("predictor_history_dirty", 1) || //
+		!search("predictor_archive{action=\"archived\"}", 1) || //
+		!search("predictor_archive{action=\"failed\"}", 1) || //
+		!search("predictor_archive{action=\"dropped\"}", 1) || //
 		!search("predictor_predictions{action=\"checked\"}", 1) || //
 		!search("predictor_predictions{action=\"published\"}", 1) || //
-		!search("predictor_predictions{action=\"discarded\"}", 1) {
+		!search("predictor_predictions{action=\"discarded\"}", 1) || //
+		!search("predictor_predictions_by_program{program=\"known\"}", 1) || //
+		!search("predictor_predictions_by_program{program=\"unknown\"}", 1) {
+		t.Errorf("unexpected metrics value")
+		t.FailNow()
+	}
+	if !search("predictor_observations_rejected{layer=\"primary_signal\",rule=\"signal_color\"}", 1) || //
+		!search("predictor_observations_rejected_by_thing{thing=\"1337_1\"}", 1) {
 		t.Errorf("unexpected metrics value")
 		t.FailNow()
 	}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"predictor/deadletters"
 	"predictor/env"
 	"predictor/log"
+	"predictor/observations"
 	"predictor/predictions"
 	"predictor/things"
 	"time"
@@ -22,12 +24,28 @@ type SGStatus struct {
 	PredictionQuality *float64 `json:"prediction_quality"`
 	// The unix time of the last prediction, if there is a prediction.
 	PredictionTime *int64 `json:"prediction_time"`
+	// If the thing stopped sending data and its prediction was withdrawn.
+	Offline bool `json:"offline"`
+	// The unix time since when the thing is offline, if it is offline.
+	OfflineSince *int64 `json:"offline_since"`
+	// The number of recently discarded observations and cycles, by the stage where they were discarded.
+	DeadLetters map[string]int `json:"dead_letters"`
+	// If the cycles of the thing are inferred, since it has no `cycle_second` datastream.
+	Inferred bool `json:"inferred"`
+	// The inferred cycle length in seconds, if the cycles are inferred.
+	InferredCycleLength *int64 `json:"inferred_cycle_length"`
+	// The reasons why datastreams of the thing are quarantined, by their layer name.
+	Quarantined map[string]string `json:"quarantined"`
 }
 
 // Interface to other packages.
 var (
 	getThingsForSGStatus            = things.Things.Range
 	getCurrentPredictionForSGStatus = predictions.GetCurrentPrediction
+	getOfflineSinceForSGStatus      = predictions.GetOfflineSince
+	getDeadLettersForSGStatus       = deadletters.CountByStage
+	getQuarantinedForSGStatus       = observations.GetQuarantinedLayers
+	getInferredCycleForSGStatus     = observations.GetInferredCycleLength
 )
 
 // Write a status file for each signal group.
@@ -40,6 +58,8 @@ func WriteStatusForEachSG() {
 		status := SGStatus{
 			StatusUpdateTime: time.Now().Unix(),
 			ThingName:        thing.Name,
+			DeadLetters:      getDeadLettersForSGStatus(thingName),
+			Quarantined:      getQuarantinedForSGStatus(thingName),
 		}
 
 		// Get the prediction for the signal group.
@@ -51,6 +71,20 @@ func WriteStatusForEachSG() {
 			status.PredictionTime = &t
 		}
 
+		// Check if the signal group is offline.
+		if offlineSince, ok := getOfflineSinceForSGStatus(thingName); ok {
+			status.Offline = true
+			t := offlineSince.Unix()
+			status.OfflineSince = &t
+		}
+
+		// Check if the cycles of the signal group are inferred.
+		if length, ok := getInferredCycleForSGStatus(thingName); ok {
+			status.Inferred = true
+			l := int64(length / time.Second)
+			status.InferredCycleLength = &l
+		}
+
 		// Write the status update to a json file.
 		filePath := fmt.Sprintf("%s/status/%s/status.json", env.StaticPath, thing.Topic())
 		// Make sure the directory exists, otherwise create it.
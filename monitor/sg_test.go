@@ -25,6 +25,18 @@ func TestWriteStatusForEachSG(t *testing.T) {
 			ThenQuality:   []byte{100, 100, 100},
 		}, true
 	}
+	getDeadLettersForSGStatus = func(_ string) map[string]int {
+		return map[string]int{"validation": 2}
+	}
+	getQuarantinedForSGStatus = func(_ string) map[string]string {
+		return map[string]string{"primary_signal": "flapping"}
+	}
+	getInferredCycleForSGStatus = func(_ string) (time.Duration, bool) {
+		return 90 * time.Second, true
+	}
+	getOfflineSinceForSGStatus = func(_ string) (time.Time, bool) {
+		return time.Unix(10, 0), true
+	}
 
 	tempDir := t.TempDir()
 	env.StaticPath = tempDir
@@ -59,6 +71,22 @@ func TestWriteStatusForEachSG(t *testing.T) {
 		t.Errorf("wrong prediction time")
 		t.FailNow()
 	}
+	if !statusFromFile.Offline || statusFromFile.OfflineSince == nil || *statusFromFile.OfflineSince != 10 {
+		t.Errorf("signal group should be marked offline")
+		t.FailNow()
+	}
+	if statusFromFile.DeadLetters["validation"] != 2 {
+		t.Errorf("wrong number of dead letters")
+		t.FailNow()
+	}
+	if !statusFromFile.Inferred || statusFromFile.InferredCycleLength == nil || *statusFromFile.InferredCycleLength != 90 {
+		t.Errorf("signal group should be marked as inferred")
+		t.FailNow()
+	}
+	if statusFromFile.Quarantined["primary_signal"] != "flapping" {
+		t.Errorf("primary signal should be marked as quarantined")
+		t.FailNow()
+	}
 	if statusFromFile.ThingName != "1337_1" {
 		t.Errorf("wrong thing name")
 	}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"predictor/env"
 	"predictor/log"
+	"predictor/observations"
 	"predictor/predictions"
 	"predictor/things"
 	"time"
@@ -20,6 +21,12 @@ type StatusSummary struct {
 	NumThings int `json:"num_things"`
 	// The number of predictions.
 	NumPredictions int `json:"num_predictions"`
+	// The number of things that stopped sending data.
+	NumOfflineThings int `json:"num_offline_things"`
+	// The number of datastreams that are quarantined, since they misbehaved.
+	NumQuarantinedTopics int `json:"num_quarantined_topics"`
+	// The number of things whose cycles are inferred, since they have no `cycle_second` datastream.
+	NumInferredThings int `json:"num_inferred_things"`
 	// The number of predictions with quality <= 0.5.
 	NumBadPredictions int `json:"num_bad_predictions"`
 	// The time of the most recent prediction.
@@ -34,6 +41,9 @@ type StatusSummary struct {
 var (
 	getNumberOfThings      = things.CountThings
 	getNumberOfPredictions = predictions.CountPredictions
+	getNumberOfOffline     = predictions.CountOffline
+	getNumberOfQuarantined = observations.CountQuarantined
+	getNumberOfInferred    = observations.CountInferred
 	getCurrentPredictions  = predictions.Current.Range
 )
 
@@ -83,6 +93,9 @@ func WriteSummary() {
 		StatusUpdateTime:         time.Now().Unix(),
 		NumThings:                numThings,
 		NumPredictions:           numPredictions,
+		NumOfflineThings:         getNumberOfOffline(),
+		NumQuarantinedTopics:     getNumberOfQuarantined(),
+		NumInferredThings:        getNumberOfInferred(),
 		NumBadPredictions:        numBadPredictions,
 		MostRecentPredictionTime: mostRecentPredictionTime,
 		OldestPredictionTime:     oldestPredictionTime,
@@ -13,6 +13,9 @@ import (
 func TestWriteSummary(t *testing.T) {
 	getNumberOfThings = func() int { return 1 }
 	getNumberOfPredictions = func() int { return 1 }
+	getNumberOfOffline = func() int { return 1 }
+	getNumberOfQuarantined = func() int { return 2 }
+	getNumberOfInferred = func() int { return 3 }
 	getCurrentPredictions = func(f func(key, value interface{}) bool) {
 		f("mock-topic", predictions.Prediction{
 			ReferenceTime: time.Unix(0, 0),
@@ -48,4 +51,16 @@ func TestWriteSummary(t *testing.T) {
 		t.Errorf("expected 1 thing, 1 prediction, and 0 bad predictions")
 		t.FailNow()
 	}
+	if summary.NumOfflineThings != 1 {
+		t.Errorf("expected 1 offline thing")
+		t.FailNow()
+	}
+	if summary.NumQuarantinedTopics != 2 {
+		t.Errorf("expected 2 quarantined topics")
+		t.FailNow()
+	}
+	if summary.NumInferredThings != 3 {
+		t.Errorf("expected 3 inferred things")
+		t.FailNow()
+	}
 }
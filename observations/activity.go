@@ -0,0 +1,41 @@
+package observations
+
+import (
+	"sync"
+	"time"
+)
+
+// The times when observations were last received for a thing, by datastream type.
+type activity struct {
+	// The lock that must be used when accessing the times.
+	lock sync.RWMutex
+	// The time of the last received observation, by datastream type.
+	byType map[string]time.Time
+}
+
+// A map that contains the activity of each thing by the Thing name.
+var activities = &sync.Map{}
+
+// Remember that an observation was received for a thing and datastream type.
+func recordActivity(thingName string, dsType string, receivedTime time.Time) {
+	val, _ := activities.LoadOrStore(thingName, &activity{byType: make(map[string]time.Time)})
+	a := val.(*activity)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if receivedTime.After(a.byType[dsType]) {
+		a.byType[dsType] = receivedTime
+	}
+}
+
+// Get the time when the last observation was received for a thing and datastream type.
+func GetLastReceived(thingName string, dsType string) (time.Time, bool) {
+	val, ok := activities.Load(thingName)
+	if !ok {
+		return time.Time{}, false
+	}
+	a := val.(*activity)
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	t, ok := a.byType[dsType]
+	return t, ok
+}
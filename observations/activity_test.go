@@ -0,0 +1,23 @@
+package observations
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordActivity(t *testing.T) {
+	recordActivity("1337_1", "primary_signal", time.Unix(10, 0))
+	recordActivity("1337_1", "primary_signal", time.Unix(5, 0)) // Out of order
+	lastReceived, ok := GetLastReceived("1337_1", "primary_signal")
+	if !ok || lastReceived != time.Unix(10, 0) {
+		t.Errorf("expected the most recent time to be kept")
+		t.FailNow()
+	}
+	if _, ok := GetLastReceived("1337_1", "cycle_second"); ok {
+		t.Errorf("no activity should be recorded for other datastreams")
+		t.FailNow()
+	}
+	if _, ok := GetLastReceived("1337_2", "primary_signal"); ok {
+		t.Errorf("no activity should be recorded for other things")
+	}
+}
@@ -5,29 +5,12 @@ import "time"
 // Run a cleanup on the observations.
 func cleanup() {
 	// Truncate all cycles to the maximum length, to avoid storing too many observations.
-	primarySignalCycles.Range(func(key, value interface{}) bool {
-		cycle := value.(*Cycle)
-		cycle.truncatePending(20)
-		return true
-	})
-	signalProgramCycles.Range(func(key, value interface{}) bool {
-		cycle := value.(*Cycle)
-		cycle.truncatePending(5)
-		return true
-	})
-	carDetectorCycles.Range(func(key, value interface{}) bool {
-		cycle := value.(*Cycle)
-		cycle.truncatePending(300)
-		return true
-	})
-	bikeDetectorCycles.Range(func(key, value interface{}) bool {
-		cycle := value.(*Cycle)
-		cycle.truncatePending(300)
-		return true
-	})
-	cycleSecondCycles.Range(func(key, value interface{}) bool {
-		cycle := value.(*Cycle)
-		cycle.truncatePending(5)
+	// Also drop the observations of the timelines that are outside of the window.
+	now := time.Now()
+	states.Range(func(key, value interface{}) bool {
+		state := value.(*ThingState)
+		state.truncatePending()
+		state.pruneTimelines(now)
 		return true
 	})
 }
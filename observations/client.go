@@ -1,12 +1,13 @@
 package observations
 
 import (
-	"encoding/json"
 	"fmt"
-	"math/rand"
+	"predictor/deadletters"
 	"predictor/env"
 	"predictor/log"
+	"predictor/session"
 	"predictor/things"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -34,18 +35,21 @@ func CheckReceivedMessagesPeriodically() {
 		receivedNow := ObservationsReceived
 		canceledNow := ObservationsDiscarded
 		processedNow := ObservationsProcessed
+		duplicatedNow := ObservationsDuplicated
 		time.Sleep(60 * time.Second)
 		receivedThen := ObservationsReceived
 		canceledThen := ObservationsDiscarded
 		processedThen := ObservationsProcessed
+		duplicatedThen := ObservationsDuplicated
 		dReceived := receivedThen - receivedNow
 		dCanceled := canceledThen - canceledNow
 		dProcessed := processedThen - processedNow
+		dDuplicated := duplicatedThen - duplicatedNow
 		// Panic if the number of received messages is too low.
 		if dReceived == 0 {
 			panic("No messages received in the last 60 seconds")
 		}
-		log.Info.Printf("Received %d observations in the last 60 seconds. (%d processed, %d canceled)", dReceived, dProcessed, dCanceled)
+		log.Info.Printf("Received %d observations in the last 60 seconds. (%d processed, %d canceled, %d duplicates)", dReceived, dProcessed, dCanceled, dDuplicated)
 		ObservationsReceivedByTopic.Range(func(k, v interface{}) bool {
 			dsType := k.(string)
 			count := v.(uint64)
@@ -62,145 +66,81 @@ func processMessage(msg mqtt.Message) {
 	// Add the observation to the correct map.
 	topic := msg.Topic()
 
+	// Discard the message and keep it as a dead letter.
+	discard := func(thingName string, stage string, reason string) {
+		atomic.AddUint64(&ObservationsDiscarded, 1)
+		deadletters.Add(deadletters.Letter{
+			Thing:   thingName,
+			Topic:   topic,
+			Stage:   stage,
+			Reason:  reason,
+			Payload: string(msg.Payload()),
+		})
+	}
+
 	// Check if the topic should be processed.
 	dsType, ok := things.DatastreamMqttTopics.Load(topic)
 	if !ok {
-		atomic.AddUint64(&ObservationsDiscarded, 1)
+		discard("", deadletters.StageLookup, "unknown topic")
+		return
+	}
+	layer, ok := getLayer(dsType.(string))
+	if !ok {
+		discard("", deadletters.StageLookup, fmt.Sprintf("unknown layer %s", dsType))
 		return
 	}
 
 	// Increment the number of received messages.
-	val, _ := ObservationsReceivedByTopic.LoadOrStore(dsType.(string), uint64(1))
-	ObservationsReceivedByTopic.Store(dsType.(string), val.(uint64)+1)
+	val, _ := ObservationsReceivedByTopic.LoadOrStore(layer.Name, uint64(1))
+	ObservationsReceivedByTopic.Store(layer.Name, val.(uint64)+1)
 
-	var observation Observation
-	if err := json.Unmarshal(msg.Payload(), &observation); err != nil {
-		atomic.AddUint64(&ObservationsDiscarded, 1)
+	thingName, ok := things.DatastreamThings.Load(topic)
+	if !ok {
+		discard("", deadletters.StageLookup, "no thing for topic")
 		return
 	}
 
-	err := validateObservation(observation, dsType.(string))
+	observation, err := layer.Decode(msg.Payload())
 	if err != nil {
-		atomic.AddUint64(&ObservationsDiscarded, 1)
-		log.Warning.Printf("Invalid observation: %s", err)
+		discard(thingName.(string), deadletters.StageDecode, err.Error())
 		return
 	}
 
-	switch dsType {
-	case "primary_signal":
-		thingName, ok := things.PrimarySignalDatastreams.Load(topic)
-		if !ok {
+	// Drop messages of datastreams that flood us or toggle their signal.
+	if quarantined, started, reason := checkQuarantine(topic, thingName.(string), layer, observation, time.Now()); quarantined {
+		atomic.AddUint64(&ObservationsQuarantined, 1)
+		if !started {
 			atomic.AddUint64(&ObservationsDiscarded, 1)
 			return
 		}
-		cycle, _ := primarySignalCycles.LoadOrStore(thingName, &Cycle{})
-		cycle.(*Cycle).add(observation)
-		go PrimarySignalCallback(thingName.(string))
-	case "signal_program":
-		thingName, ok := things.SignalProgramDatastreams.Load(topic)
-		if !ok {
-			atomic.AddUint64(&ObservationsDiscarded, 1)
-			return
-		}
-		cycle, _ := signalProgramCycles.LoadOrStore(thingName, &Cycle{})
-		cycle.(*Cycle).add(observation)
-		go SignalProgramCallback(thingName.(string))
-	case "detector_car":
-		thingName, ok := things.CarDetectorDatastreams.Load(topic)
-		if !ok {
-			atomic.AddUint64(&ObservationsDiscarded, 1)
-			return
-		}
-		cycle, _ := carDetectorCycles.LoadOrStore(thingName, &Cycle{})
-		cycle.(*Cycle).add(observation)
-		go CarDetectorCallback(thingName.(string))
-	case "detector_bike":
-		thingName, ok := things.BikeDetectorDatastreams.Load(topic)
-		if !ok {
-			atomic.AddUint64(&ObservationsDiscarded, 1)
-			return
-		}
-		cycle, _ := bikeDetectorCycles.LoadOrStore(thingName, &Cycle{})
-		cycle.(*Cycle).add(observation)
-		go BikeDetectorCallback(thingName.(string))
-	case "cycle_second":
-		thingName, ok := things.CycleSecondDatastreams.Load(topic)
-		if !ok {
-			atomic.AddUint64(&ObservationsDiscarded, 1)
-			return
-		}
-		cycle, _ := cycleSecondCycles.LoadOrStore(thingName, &Cycle{})
-		cycle.(*Cycle).add(observation)
-
-		// Make sure that all cycles use the same timeframe.
-		cycleStartTime := cycle.(*Cycle).EndTime
-		cycleEndTime := observation.PhenomenonTime
+		discard(thingName.(string), deadletters.StageQuarantine, fmt.Sprintf("quarantined for %s: %s", env.QuarantineDuration, reason))
+		log.Warning.Printf("Quarantined %s datastream of %s for %s (%s)", layer.Name, thingName, env.QuarantineDuration, reason)
+		return
+	}
 
-		// Clamp startTime and endTime to a 5-second raster. For example, if the
-		// startTime is 12:34:56.123, it will be rounded down to 12:34:55.000.
-		// If the startTime is 12:34:58.123, it will be rounded up to 12:35:00.000.
-		// We do this since sometimes the cycle will be completed with a 1-2 second
-		// delay. This delay would otherwise cause the prediction to deviate
-		// 1-2 seconds each cycle when extrapolating. Note that here delay refers to
-		// an internal delay in the `phenomenonTime`, not a delay in the message.
-		cycleStartTimeRoundedDown := cycleStartTime.Truncate(5 * time.Second)
-		cycleStartTimeRoundedUp := cycleStartTimeRoundedDown.Add(5 * time.Second)
-		// Find the closest time to the original startTime.
-		if cycleStartTime.Sub(cycleStartTimeRoundedDown).Abs() < cycleStartTimeRoundedUp.Sub(cycleStartTime).Abs() {
-			cycleStartTime = cycleStartTimeRoundedDown
-		} else {
-			cycleStartTime = cycleStartTimeRoundedUp
-		}
-		cycleEndTimeRoundedDown := cycleEndTime.Truncate(5 * time.Second)
-		cycleEndTimeRoundedUp := cycleEndTimeRoundedDown.Add(5 * time.Second)
-		// Find the closest time to the original endTime.
-		if cycleEndTime.Sub(cycleEndTimeRoundedDown).Abs() < cycleEndTimeRoundedUp.Sub(cycleEndTime).Abs() {
-			cycleEndTime = cycleEndTimeRoundedDown
-		} else {
-			cycleEndTime = cycleEndTimeRoundedUp
-		}
+	if rule, err := checkRules(layer, observation, time.Now()); err != nil {
+		discard(thingName.(string), deadletters.StageValidation, fmt.Sprintf("%s: %s", rule, err))
+		countRejection(thingName.(string), layer.Name, rule)
+		log.Warning.Printf("Invalid %s observation for %s (%s): %s", layer.Name, thingName, rule, err)
+		return
+	}
 
-		// Complete all associated cycles.
-		completedCycleSecondCycle, err := cycle.(*Cycle).complete(cycleStartTime, cycleEndTime)
-		if err != nil {
-			atomic.AddUint64(&ObservationsDiscarded, 1)
-			return
-		}
-		cycle, _ = primarySignalCycles.LoadOrStore(thingName, &Cycle{})
-		completedPrimarySignalCycle, err := cycle.(*Cycle).complete(cycleStartTime, cycleEndTime)
-		if err != nil {
-			atomic.AddUint64(&ObservationsDiscarded, 1)
-			return
-		}
-		cycle, _ = signalProgramCycles.LoadOrStore(thingName, &Cycle{})
-		completedSignalProgramCycle, err := cycle.(*Cycle).complete(cycleStartTime, cycleEndTime)
-		if err != nil {
-			atomic.AddUint64(&ObservationsDiscarded, 1)
-			return
-		}
-		cycle, _ = carDetectorCycles.LoadOrStore(thingName, &Cycle{})
-		completedCarDetectorCycle, err := cycle.(*Cycle).complete(cycleStartTime, cycleEndTime)
-		if err != nil {
-			atomic.AddUint64(&ObservationsDiscarded, 1)
-			return
-		}
-		cycle, _ = bikeDetectorCycles.LoadOrStore(thingName, &Cycle{})
-		completedBikeDetectorCycle, err := cycle.(*Cycle).complete(cycleStartTime, cycleEndTime)
-		if err != nil {
-			atomic.AddUint64(&ObservationsDiscarded, 1)
-			return
-		}
+	// Suppress observations that were redelivered by the broker.
+	if isDuplicate(topic, observation) {
+		atomic.AddUint64(&ObservationsDuplicated, 1)
+		return
+	}
 
-		go CycleSecondCallback(
-			thingName.(string),
-			cycleStartTime, cycleEndTime,
-			completedPrimarySignalCycle,
-			completedSignalProgramCycle,
-			completedCycleSecondCycle,
-			completedCarDetectorCycle,
-			completedBikeDetectorCycle,
-		)
+	recordActivity(thingName.(string), layer.Name, observation.ReceivedTime)
+	if layer.TrackLatency {
+		recordLatency(thingName.(string), observation)
 	}
+	getState(thingName.(string)).add(layer.Name, observation)
+	if err := layer.Handle(thingName.(string), observation); err != nil {
+		discard(thingName.(string), deadletters.StageHandling, err.Error())
+		return
+	}
+	ObservationReceivedBus.Publish(thingName.(string), ObservationReceived{thingName.(string), layer.Name, observation})
 
 	atomic.AddUint64(&ObservationsProcessed, 1)
 }
@@ -212,47 +152,88 @@ func ConnectObservationListener() {
 		topics = append(topics, topic.(string))
 		return true
 	})
+	// Sort the topics, so that each shard gets the same topics after a restart.
+	// With persistent sessions, the broker resumes the subscriptions of each shard.
+	sort.Strings(topics)
 
 	// Create a new client for every 1000 subscriptions.
 	// Otherwise messages will queue up after some time, since the client
 	// is not parallelized enough. This is a workaround for the issue.
 	// Bonus points: this also reduces CPU usage significantly.
-	var client mqtt.Client
-	var wg sync.WaitGroup
-	for i, topic := range topics {
-		if (i % 1000) == 0 {
-			wg.Wait()
-			opts := mqtt.NewClientOptions()
-			opts.AddBroker(env.SensorThingsObservationMqttUrl)
-			opts.SetConnectTimeout(10 * time.Second)
-			opts.SetConnectRetry(true)
-			opts.SetConnectRetryInterval(5 * time.Second)
-			opts.SetAutoReconnect(true)
-			opts.SetKeepAlive(60 * time.Second)
-			opts.SetPingTimeout(10 * time.Second)
-			opts.SetOnConnectHandler(func(client mqtt.Client) {
-				log.Info.Printf(
-					"Connected to observation mqtt broker: %s",
-					env.SensorThingsObservationMqttUrl,
-				)
-			})
-			opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
-				log.Warning.Println("Connection to observation mqtt broker lost:", err)
-			})
-			randSource := rand.NewSource(time.Now().UnixNano())
-			random := rand.New(randSource)
-			clientID := fmt.Sprintf("priobike-predictor-%d", random.Int())
-			opts.SetClientID(clientID)
-			opts.SetOrderMatters(false)
-			opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
-				log.Warning.Println("Received unexpected message on topic:", msg.Topic())
-			})
-			client = mqtt.NewClient(opts)
-			if conn := client.Connect(); conn.Wait() && conn.Error() != nil {
-				panic(conn.Error())
+	for shard := 0; shard*1000 < len(topics); shard++ {
+		end := (shard + 1) * 1000
+		if end > len(topics) {
+			end = len(topics)
+		}
+		connectShard(shard, topics[shard*1000:end])
+	}
+
+	log.Info.Println("Subscribed to all datastreams.")
+}
+
+// Connect a client for a shard of the topics and subscribe to them.
+func connectShard(shard int, topics []string) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(env.SensorThingsObservationMqttUrl)
+	opts.SetConnectTimeout(10 * time.Second)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.SetAutoReconnect(true)
+	opts.SetKeepAlive(60 * time.Second)
+	opts.SetPingTimeout(10 * time.Second)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		log.Info.Printf(
+			"Connected to observation mqtt broker: %s",
+			env.SensorThingsObservationMqttUrl,
+		)
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		log.Warning.Println("Connection to observation mqtt broker lost:", err)
+	})
+	clientID := session.Configure(opts, "observations", shard)
+	log.Info.Println("Using client id:", clientID)
+	opts.SetOrderMatters(false)
+	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+		if session.IsPersistent() {
+			// With a persistent session, the broker may deliver queued messages
+			// before we have resubscribed. Unknown topics are discarded anyway.
+			go processMessage(msg)
+			return
+		}
+		log.Warning.Println("Received unexpected message on topic:", msg.Topic())
+	})
+
+	// The broker resumes the subscriptions of a persistent session, which may
+	// include topics that are no longer part of this shard. If the previous
+	// topics are unknown, the session is cleared instead.
+	previous, recorded := session.LoadTopics(clientID)
+	if session.IsPersistent() && !recorded {
+		if err := session.Clear(opts); err != nil {
+			log.Warning.Println("Could not clear the previous mqtt session:", err)
+		}
+	}
+	client := mqtt.NewClient(opts)
+	if conn := client.Connect(); conn.Wait() && conn.Error() != nil {
+		panic(conn.Error())
+	}
+	// The topics that may still be subscribed on the broker after this start.
+	subscribed := topics
+	if session.IsPersistent() && recorded {
+		if stale := session.StaleTopics(previous, topics); len(stale) > 0 {
+			if token := client.Unsubscribe(stale...); token.Wait() && token.Error() != nil {
+				log.Warning.Println("Could not unsubscribe from stale topics:", token.Error())
+				// Keep the stale topics, so that they are unsubscribed on the next start.
+				subscribed = append(append([]string{}, topics...), stale...)
+			} else {
+				log.Info.Printf("Unsubscribed from %d stale topics of client %s.", len(stale), clientID)
 			}
 		}
+	}
 
+	var wg sync.WaitGroup
+	// Subscription errors are raised by the calling goroutine, so that it can recover.
+	subscribeErrors := make(chan error, len(topics))
+	for _, topic := range topics {
 		wg.Add(1)
 		// Wait 40ms between each subscription to avoid overloading the mqtt broker.
 		time.Sleep(40 * time.Millisecond)
@@ -264,10 +245,19 @@ func ConnectObservationListener() {
 				// Process the message asynchronously to avoid blocking the mqtt client.
 				go processMessage(msg)
 			}); token.Wait() && token.Error() != nil {
-				panic(token.Error())
+				subscribeErrors <- token.Error()
 			}
 		}(topic)
 	}
+	wg.Wait()
+	close(subscribeErrors)
+	if err, ok := <-subscribeErrors; ok {
+		panic(err)
+	}
 
-	log.Info.Println("Subscribed to all datastreams.")
+	if session.IsPersistent() {
+		if err := session.SaveTopics(clientID, subscribed); err != nil {
+			log.Warning.Println("Could not record the subscribed topics:", err)
+		}
+	}
 }
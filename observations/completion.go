@@ -0,0 +1,37 @@
+package observations
+
+import "time"
+
+// The completed cycles of all layers of a thing.
+type CompletedCycles struct {
+	// The start of the completed cycle.
+	StartTime time.Time
+	// The end of the completed cycle.
+	EndTime time.Time
+	// The snapshots of the completed cycles by their layer name.
+	Layers map[string]CycleSnapshot
+}
+
+// Complete the cycles of all layers for a thing, after a `cycle_second`
+// observation arrived that marks the end of the running cycle.
+func completeAllCycles(thingName string, observation Observation) (CompletedCycles, error) {
+	// Make sure that all cycles use the same timeframe.
+	// The end of the cycle is snapped to the learned cycle model of the thing,
+	// or to a raster as long as there is no model. We do this since sometimes
+	// the cycle will be completed with a 1-2 second delay. This delay would
+	// otherwise cause the prediction to deviate 1-2 seconds each cycle when
+	// extrapolating. Note that here delay refers to an internal delay in the
+	// `phenomenonTime`, not a delay in the message. The start of the cycle is
+	// the snapped end of the previous cycle.
+	return getState(thingName).completeAll(snapBoundary(thingName, observation.PhenomenonTime))
+}
+
+// Complete the cycles of all layers for a thing and publish them.
+func completeCycles(thingName string, observation Observation) error {
+	completed, err := completeAllCycles(thingName, observation)
+	if err != nil {
+		return err
+	}
+	CycleCompletedBus.Publish(thingName, CycleCompleted{thingName, completed})
+	return nil
+}
@@ -3,7 +3,6 @@ package observations
 import (
 	"fmt"
 	"sort"
-	"sync"
 	"time"
 )
 
@@ -12,31 +11,23 @@ import (
 // When this observation arrives, the pending observations are moved to the completed
 // observations, and the most recent completed observation is orphaned as outdated.
 // In this way we will always have at least one last observation.
+// A cycle is not safe for concurrent use. It is protected by the lock
+// of the `ThingState` that it belongs to.
 type Cycle struct {
 	// Observations that have been received but not yet completed the full cycle.
 	// This slice is *always* sorted by `phenomenonTime`, ascending.
 	Pending []Observation
-	// A RW lock is used to protect the pending observations.
-	PendingLock sync.RWMutex
 	// The last full (completed) cycle of observations, after a `cycle_time` observation
 	// was received. This slice is *always* sorted by `phenomenonTime`, ascending.
 	Completed []Observation
-	// A RW lock is used to protect the completed observations.
-	CompletedLock sync.RWMutex
 	// The last observation that was received before the start of the current cycle.
 	Outdated *Observation
-	// A RW lock is used to protect the outdated observation.
-	OutdatedLock sync.RWMutex
 	// The start of the last completed cycle. This is marked by
 	// the time when we received the corresponding `cycle_time` observation.
 	StartTime time.Time
-	// A RW lock is used to protect the start time.
-	StartTimeLock sync.RWMutex
 	// The end of the last completed cycle. This is marked by
 	// the time when we received the corresponding `cycle_time` observation.
 	EndTime time.Time
-	// A RW lock is used to protect the end time.
-	EndTimeLock sync.RWMutex
 }
 
 // A snapshot of a cycle.
@@ -53,53 +44,21 @@ type CycleSnapshot struct {
 	Outdated *Observation
 }
 
-// Lock all locks in the cycle.
-func (c *Cycle) Lock() {
-	c.PendingLock.Lock()
-	c.CompletedLock.Lock()
-	c.OutdatedLock.Lock()
-	c.StartTimeLock.Lock()
-	c.EndTimeLock.Lock()
-}
-
-// Unlock all locks in the cycle.
-func (c *Cycle) Unlock() {
-	c.PendingLock.Unlock()
-	c.CompletedLock.Unlock()
-	c.OutdatedLock.Unlock()
-	c.StartTimeLock.Unlock()
-	c.EndTimeLock.Unlock()
-}
-
-// Lock all locks in the cycle, read-only.
-func (c *Cycle) RLock() {
-	c.PendingLock.RLock()
-	c.CompletedLock.RLock()
-	c.OutdatedLock.RLock()
-	c.StartTimeLock.RLock()
-	c.EndTimeLock.RLock()
-}
-
-// Unlock all locks in the cycle, read-only.
-func (c *Cycle) RUnlock() {
-	c.PendingLock.RUnlock()
-	c.CompletedLock.RUnlock()
-	c.OutdatedLock.RUnlock()
-	c.StartTimeLock.RUnlock()
-	c.EndTimeLock.RUnlock()
-}
-
 // Make a snapshot of the cycle.
+// The observations are copied, so that the snapshot is not
+// affected when observations are added to the cycle later.
 func (c *Cycle) MakeSnapshot() CycleSnapshot {
-	c.RLock()
-	defer c.RUnlock()
-	return CycleSnapshot{
+	snapshot := CycleSnapshot{
 		StartTime: c.StartTime,
 		EndTime:   c.EndTime,
-		Pending:   c.Pending,
-		Completed: c.Completed,
-		Outdated:  c.Outdated,
+		Pending:   append([]Observation{}, c.Pending...),
+		Completed: append([]Observation{}, c.Completed...),
+	}
+	if c.Outdated != nil {
+		outdated := *c.Outdated
+		snapshot.Outdated = &outdated
 	}
+	return snapshot
 }
 
 // Get the most recent observation from a cycle snapshot.
@@ -122,8 +81,6 @@ func (c CycleSnapshot) GetMostRecentObservation() (Observation, error) {
 // Truncate the pending observations to the given length.
 // This will remove the oldest observations.
 func (c *Cycle) truncatePending(length int) {
-	c.Lock()
-	defer c.Unlock()
 	if length > len(c.Pending) {
 		return
 	}
@@ -137,8 +94,6 @@ func (c *Cycle) truncatePending(length int) {
 // However if the observations arrive out of order, this will add the observation
 // to the completed or outdated observations.
 func (c *Cycle) add(observation Observation) {
-	c.Lock()
-	defer c.Unlock()
 	// If the observation is before the start of the current cycle, it is outdated.
 	if observation.PhenomenonTime.Before(c.StartTime) {
 		c.Outdated = &observation
@@ -170,9 +125,6 @@ func (c *Cycle) add(observation Observation) {
 // 3. Keep the most recent completed observation as outdated.
 // Returns a snapshot copy of the cycle that was completed.
 func (c *Cycle) complete(cycleStartTime time.Time, cycleEndTime time.Time) (CycleSnapshot, error) {
-	c.Lock()
-	defer c.Unlock()
-
 	// Make some sanity checks.
 	if cycleEndTime.Before(cycleStartTime) {
 		return CycleSnapshot{}, fmt.Errorf("cycle completion time is before end time")
@@ -218,11 +170,5 @@ func (c *Cycle) complete(cycleStartTime time.Time, cycleEndTime time.Time) (Cycl
 		}
 	}
 
-	return CycleSnapshot{
-		StartTime: c.StartTime,
-		EndTime:   c.EndTime,
-		Outdated:  c.Outdated,
-		Completed: c.Completed,
-		Pending:   c.Pending,
-	}, nil
+	return c.MakeSnapshot(), nil
 }
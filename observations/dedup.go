@@ -0,0 +1,61 @@
+package observations
+
+import "sync"
+
+// The number of most recent observations that are remembered per datastream.
+// Redelivered messages (QoS 1) usually arrive shortly after the original
+// message, so a small window is enough to catch most of them.
+const duplicateWindowSize = 64
+
+// The number of suppressed duplicate observations.
+var ObservationsDuplicated uint64 = 0
+
+// The identity of an observation within a datastream.
+type observationKey struct {
+	phenomenonTime int64
+	result         byte
+}
+
+// A window of the most recently seen observations of a datastream.
+type duplicateWindow struct {
+	// The lock that must be used when accessing the window.
+	lock sync.Mutex
+	// The keys in the window, for O(1) duplicate detection.
+	seen map[observationKey]struct{}
+	// The keys in the order they were seen, used as a ring buffer.
+	order []observationKey
+	// The next position in the ring buffer.
+	next int
+}
+
+// The duplicate windows by their datastream MQTT topic.
+var duplicateWindows = &sync.Map{}
+
+// Check if the observation was already seen on the datastream and remember it.
+// Returns true if the observation is a duplicate.
+func isDuplicate(topic string, observation Observation) bool {
+	val, _ := duplicateWindows.LoadOrStore(topic, &duplicateWindow{
+		seen: make(map[observationKey]struct{}, duplicateWindowSize),
+	})
+	window := val.(*duplicateWindow)
+	window.lock.Lock()
+	defer window.lock.Unlock()
+
+	key := observationKey{
+		phenomenonTime: observation.PhenomenonTime.UnixNano(),
+		result:         observation.Result,
+	}
+	if _, ok := window.seen[key]; ok {
+		return true
+	}
+	if len(window.order) < duplicateWindowSize {
+		window.order = append(window.order, key)
+	} else {
+		// Evict the oldest key from the window.
+		delete(window.seen, window.order[window.next])
+		window.order[window.next] = key
+		window.next = (window.next + 1) % duplicateWindowSize
+	}
+	window.seen[key] = struct{}{}
+	return false
+}
@@ -0,0 +1,50 @@
+package observations
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsDuplicate(t *testing.T) {
+	topic := "v1.1/Datastreams(1337)/Observations"
+	observation := Observation{
+		PhenomenonTime: time.Unix(10, 0),
+		Result:         3,
+	}
+	if isDuplicate(topic, observation) {
+		t.Errorf("first observation should not be a duplicate")
+		t.FailNow()
+	}
+	if !isDuplicate(topic, observation) {
+		t.Errorf("redelivered observation should be a duplicate")
+		t.FailNow()
+	}
+	// Same time, different result.
+	if isDuplicate(topic, Observation{PhenomenonTime: time.Unix(10, 0), Result: 1}) {
+		t.Errorf("observation with a different result should not be a duplicate")
+		t.FailNow()
+	}
+	// Same observation, different datastream.
+	if isDuplicate("v1.1/Datastreams(1338)/Observations", observation) {
+		t.Errorf("observation on a different datastream should not be a duplicate")
+		t.FailNow()
+	}
+}
+
+func TestDuplicateWindowIsBounded(t *testing.T) {
+	topic := "v1.1/Datastreams(1339)/Observations"
+	first := Observation{PhenomenonTime: time.Unix(0, 0)}
+	isDuplicate(topic, first)
+	for i := 1; i <= duplicateWindowSize; i++ {
+		isDuplicate(topic, Observation{PhenomenonTime: time.Unix(int64(i), 0)})
+	}
+	val, _ := duplicateWindows.Load(topic)
+	if len(val.(*duplicateWindow).seen) != duplicateWindowSize {
+		t.Errorf("window should not grow beyond its size")
+		t.FailNow()
+	}
+	// The first observation was evicted from the window.
+	if isDuplicate(topic, first) {
+		t.Errorf("evicted observation should not be a duplicate")
+	}
+}
@@ -0,0 +1,27 @@
+package observations
+
+import "predictor/events"
+
+// An observation that was processed and added to the cycle of its thing.
+type ObservationReceived struct {
+	// The name of the thing.
+	Thing string
+	// The layer of the observation's datastream.
+	Layer string
+	// The observation itself.
+	Observation Observation
+}
+
+// The cycles of all layers of a thing that were completed, after the end of a cycle.
+type CycleCompleted struct {
+	// The name of the thing.
+	Thing string
+	// The completed cycles.
+	CompletedCycles
+}
+
+// The bus on which processed observations are published.
+var ObservationReceivedBus = events.NewBus[ObservationReceived]("observation_received")
+
+// The bus on which completed cycles are published.
+var CycleCompletedBus = events.NewBus[CycleCompleted]("cycle_completed")
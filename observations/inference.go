@@ -0,0 +1,260 @@
+package observations
+
+import (
+	"predictor/env"
+	"predictor/things"
+	"sync"
+	"time"
+)
+
+// The window of recent `primary_signal` transitions used to infer the cycle length.
+const inferenceWindow = 15 * time.Minute
+
+// The range of cycle lengths that can be inferred.
+// Longer cycles are not used for predictions anyway.
+const (
+	minInferredCycleLength = 30 * time.Second
+	maxInferredCycleLength = 300 * time.Second
+)
+
+// The minimum fraction of seconds that must repeat after one cycle,
+// so that an inferred cycle length is trusted.
+const minInferenceScore = 0.9
+
+// The tolerance within which the best cycle length is considered ambiguous with
+// a shorter one. The shortest of such cycle lengths is used, since multiples of
+// the true cycle length correlate equally well.
+const inferenceScoreTolerance = 0.02
+
+// The interval in which the inference is retried, as long as no cycle length was found.
+const inferenceRetryInterval = time.Minute
+
+// The deviation after which a newly inferred cycle length replaces the current one.
+const inferredCycleLengthTolerance = 2 * time.Second
+
+// A change of the signal color.
+type transition struct {
+	time  time.Time
+	color byte
+}
+
+// The inferred cycle of a thing without a `cycle_second` datastream.
+type inferredCycle struct {
+	// The lock that must be used when accessing the inferred cycle.
+	lock sync.Mutex
+	// The recent transitions of the signal, sorted by time.
+	transitions []transition
+	// The inferred cycle length, or zero if none was found yet.
+	length time.Duration
+	// The time of the next synthesized cycle boundary.
+	nextBoundary time.Time
+	// The time when the cycle length was last inferred.
+	lastInference time.Time
+}
+
+// The inferred cycles by their Thing name.
+var inferredCycles = &sync.Map{}
+
+// Check if a thing has a `cycle_second` datastream.
+func hasCycleSecondDatastream(thingName string) bool {
+	val, ok := things.Things.Load(thingName)
+	if !ok {
+		return false
+	}
+	for _, datastream := range val.(things.Thing).Datastreams {
+		if datastream.Properties.LayerName == "cycle_second" {
+			return true
+		}
+	}
+	return false
+}
+
+// Remember a `primary_signal` observation, if it changes the color of the signal.
+func (c *inferredCycle) addTransition(observation Observation) {
+	if len(c.transitions) > 0 {
+		last := c.transitions[len(c.transitions)-1]
+		if !observation.PhenomenonTime.After(last.time) || observation.Result == last.color {
+			return
+		}
+	}
+	c.transitions = append(c.transitions, transition{observation.PhenomenonTime, observation.Result})
+	// Keep the transition before the window, so that we know the color at its start.
+	cutoff := observation.PhenomenonTime.Add(-inferenceWindow)
+	for len(c.transitions) > 1 && c.transitions[1].time.Before(cutoff) {
+		c.transitions = c.transitions[1:]
+	}
+}
+
+// Count the transitions within a time range.
+func (c *inferredCycle) countTransitions(from time.Time, to time.Time) int {
+	count := 0
+	for _, t := range c.transitions {
+		if !t.time.Before(from) && t.time.Before(to) {
+			count++
+		}
+	}
+	return count
+}
+
+// Infer the cycle length from the periodicity of the transitions until the given time.
+// The signal is sampled every second and the lag with the highest share of
+// repeating colors (the autocorrelation) is used as the cycle length.
+// Returns zero if no trustworthy cycle length was found.
+func (c *inferredCycle) inferLength(until time.Time) time.Duration {
+	if len(c.transitions) < 2 {
+		return 0
+	}
+	start := c.transitions[0].time
+	if cutoff := until.Add(-inferenceWindow); cutoff.After(start) {
+		start = cutoff
+	}
+	n := int(until.Sub(start) / time.Second)
+	if n < 2*int(minInferredCycleLength/time.Second) {
+		return 0
+	}
+	samples := make([]byte, n)
+	next := 0
+	var color byte = c.transitions[0].color
+	for s := 0; s < n; s++ {
+		t := start.Add(time.Duration(s) * time.Second)
+		for next < len(c.transitions) && !c.transitions[next].time.After(t) {
+			color = c.transitions[next].color
+			next++
+		}
+		samples[s] = color
+	}
+
+	minLag := int(minInferredCycleLength / time.Second)
+	maxLag := int(maxInferredCycleLength / time.Second)
+	if maxLag > n/2 {
+		maxLag = n / 2
+	}
+	scores := make(map[int]float64, maxLag-minLag+1)
+	bestScore := 0.0
+	for lag := minLag; lag <= maxLag; lag++ {
+		matches := 0
+		for s := 0; s+lag < n; s++ {
+			if samples[s] == samples[s+lag] {
+				matches++
+			}
+		}
+		scores[lag] = float64(matches) / float64(n-lag)
+		if scores[lag] > bestScore {
+			bestScore = scores[lag]
+		}
+	}
+	if bestScore < minInferenceScore {
+		return 0
+	}
+	for lag := minLag; lag <= maxLag; lag++ {
+		if scores[lag] < bestScore-inferenceScoreTolerance {
+			continue
+		}
+		// A longer lag that wasn't searched yet may correlate better.
+		if lag == maxLag && maxLag < int(maxInferredCycleLength/time.Second) {
+			return 0
+		}
+		length := time.Duration(lag) * time.Second
+		// A steady signal repeats at any lag, so we require the
+		// signal to change within each of the last two cycles.
+		if c.countTransitions(until.Add(-length), until) < 2 ||
+			c.countTransitions(until.Add(-2*length), until.Add(-length)) < 2 {
+			return 0
+		}
+		return length
+	}
+	return 0
+}
+
+// Synthesize a cycle boundary, as if a `cycle_second` observation was received.
+func synthesizeBoundary(thingName string, boundary time.Time, publish bool) error {
+	observation := Observation{PhenomenonTime: boundary, ReceivedTime: time.Now()}
+	getState(thingName).add("cycle_second", observation)
+	if !publish {
+		_, err := completeAllCycles(thingName, observation)
+		return err
+	}
+	return completeCycles(thingName, observation)
+}
+
+// Infer the cycle boundaries of a thing without a `cycle_second` datastream
+// from its `primary_signal` observations, and synthesize the cycle completions.
+func inferCycles(thingName string, observation Observation) error {
+	if !env.CycleInference || hasCycleSecondDatastream(thingName) {
+		return nil
+	}
+	val, _ := inferredCycles.LoadOrStore(thingName, &inferredCycle{})
+	c := val.(*inferredCycle)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.addTransition(observation)
+	now := observation.PhenomenonTime
+	if c.length == 0 {
+		if now.Sub(c.lastInference) < inferenceRetryInterval {
+			return nil
+		}
+		c.lastInference = now
+		c.length = c.inferLength(now)
+		if c.length == 0 {
+			return nil
+		}
+		// Anchor the cycles at the most recent transition. The first boundary only
+		// marks the start of the running cycle, so it is not published.
+		anchor := c.transitions[len(c.transitions)-1].time
+		c.nextBoundary = anchor.Add(c.length)
+		synthesizeBoundary(thingName, anchor, false)
+		return nil
+	}
+
+	boundaries := []time.Time{}
+	for !now.Before(c.nextBoundary) {
+		boundaries = append(boundaries, c.nextBoundary)
+		c.nextBoundary = c.nextBoundary.Add(c.length)
+	}
+	if len(boundaries) > 2 {
+		// The signal was silent for several cycles, so the phase may be lost.
+		c.length = 0
+		return nil
+	}
+	for _, boundary := range boundaries {
+		if err := synthesizeBoundary(thingName, boundary, true); err != nil {
+			return err
+		}
+		// Follow changes of the cycle length, e.g. when the program changes.
+		length := c.inferLength(boundary)
+		if length == 0 {
+			c.length = 0
+			return nil
+		}
+		if diff := length - c.length; diff > inferredCycleLengthTolerance || diff < -inferredCycleLengthTolerance {
+			c.length = length
+			c.nextBoundary = boundary.Add(length)
+		}
+	}
+	return nil
+}
+
+// Get the inferred cycle length of a thing, if its cycles are inferred.
+func GetInferredCycleLength(thingName string) (time.Duration, bool) {
+	val, ok := inferredCycles.Load(thingName)
+	if !ok {
+		return 0, false
+	}
+	c := val.(*inferredCycle)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.length, c.length > 0
+}
+
+// Count the number of things whose cycles are inferred.
+func CountInferred() int {
+	count := 0
+	inferredCycles.Range(func(k, _ interface{}) bool {
+		if _, ok := GetInferredCycleLength(k.(string)); ok {
+			count++
+		}
+		return true
+	})
+	return count
+}
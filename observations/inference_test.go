@@ -0,0 +1,97 @@
+package observations
+
+import (
+	"predictor/env"
+	"predictor/phases"
+	"predictor/things"
+	"testing"
+	"time"
+)
+
+// Feed a periodic signal with a cycle length of 90 seconds into the inference.
+func feedPeriodicSignal(thingName string, start time.Time, cycles int) {
+	schedule := []struct {
+		offset time.Duration
+		color  byte
+	}{
+		{0, phases.Green},
+		{30 * time.Second, phases.Amber},
+		{33 * time.Second, phases.Red},
+		{88 * time.Second, phases.RedAmber},
+	}
+	for i := 0; i < cycles; i++ {
+		cycleStart := start.Add(time.Duration(i) * 90 * time.Second)
+		for _, s := range schedule {
+			observation := Observation{PhenomenonTime: cycleStart.Add(s.offset), Result: s.color}
+			inferCycles(thingName, observation)
+		}
+	}
+}
+
+// Remove the state of a thing, so that other tests don't see them.
+func deleteState(thingName string) {
+	states.Delete(thingName)
+	inferredCycles.Delete(thingName)
+}
+
+func TestInferCycles(t *testing.T) {
+	env.CycleInference = true
+	defer func() { env.CycleInference = false }()
+	things.Things.Store("1337_inferred", things.Thing{Name: "1337_inferred"})
+	defer deleteState("1337_inferred")
+
+	completions := make(chan time.Duration, 100)
+	unsubscribe := CycleCompletedBus.Subscribe("test", func(e CycleCompleted) {
+		if e.Thing == "1337_inferred" {
+			completions <- e.EndTime.Sub(e.StartTime)
+		}
+	})
+	defer unsubscribe()
+
+	feedPeriodicSignal("1337_inferred", time.Unix(900, 0), 10)
+
+	length, ok := GetInferredCycleLength("1337_inferred")
+	if !ok || length != 90*time.Second {
+		t.Errorf("expected an inferred cycle length of 90s, got %s", length)
+		t.FailNow()
+	}
+	select {
+	case d := <-completions:
+		if d != 90*time.Second {
+			t.Errorf("expected a synthesized cycle of 90s, got %s", d)
+			t.FailNow()
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no cycle completion was synthesized")
+		t.FailNow()
+	}
+}
+
+func TestInferCyclesSkipsThingsWithCycleSecond(t *testing.T) {
+	env.CycleInference = true
+	defer func() { env.CycleInference = false }()
+	datastream := things.Datastream{IotId: 100}
+	datastream.Properties.LayerName = "cycle_second"
+	things.Things.Store("1337_measured", things.Thing{
+		Name:        "1337_measured",
+		Datastreams: []things.Datastream{datastream},
+	})
+	defer deleteState("1337_measured")
+
+	feedPeriodicSignal("1337_measured", time.Unix(900, 0), 10)
+
+	if _, ok := GetInferredCycleLength("1337_measured"); ok {
+		t.Errorf("cycles of things with a cycle second datastream should not be inferred")
+		t.FailNow()
+	}
+}
+
+func TestInferLengthOfSteadySignal(t *testing.T) {
+	c := &inferredCycle{}
+	c.addTransition(Observation{PhenomenonTime: time.Unix(0, 0), Result: phases.Red})
+	c.addTransition(Observation{PhenomenonTime: time.Unix(10, 0), Result: phases.Green})
+	if length := c.inferLength(time.Unix(600, 0)); length != 0 {
+		t.Errorf("a steady signal should not have a cycle length, got %s", length)
+		t.FailNow()
+	}
+}
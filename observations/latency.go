@@ -0,0 +1,167 @@
+package observations
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The number of most recent message delays that are kept per thing.
+const latencyWindowSize = 200
+
+// The number of message delays that are required before a clock offset is learned.
+const minClockOffsetSamples = 10
+
+// The smallest message delay that is treated as a skew of the controller clock.
+// Smaller delays are considered normal transmission times on a synced controller.
+const minClockSkew = 2 * time.Second
+
+// Rolling statistics about the message delays of a thing.
+type LatencyStats struct {
+	// The median delay.
+	P50 time.Duration
+	// The 95th percentile of the delay.
+	P95 time.Duration
+	// The smallest delay.
+	Min time.Duration
+	// The largest delay.
+	Max time.Duration
+	// The number of delays in the window.
+	Count int
+}
+
+// The upper bounds of the message delay histogram buckets, in seconds.
+var LatencyBuckets = []float64{0.5, 1, 2, 5, 10, 30, 60, 300}
+
+// A histogram of all message delays of a thing since the start.
+type LatencyHistogram struct {
+	// The number of delays that are smaller or equal to each bound in `LatencyBuckets`.
+	Buckets []uint64
+	// The sum of all delays, in seconds.
+	Sum float64
+	// The number of all delays.
+	Count uint64
+}
+
+// A rolling window of the most recent message delays of a thing.
+type latencyWindow struct {
+	// The lock that must be used when accessing the window.
+	lock sync.Mutex
+	// The delays, used as a ring buffer.
+	delays []time.Duration
+	// The next position in the ring buffer.
+	next int
+	// The number of delays within each bucket, which is not cumulative.
+	buckets []uint64
+	// The sum of all delays, in seconds.
+	sum float64
+	// The number of all delays.
+	count uint64
+}
+
+// The latency windows by their Thing name.
+var latencies = &sync.Map{}
+
+// Remember the delay between `phenomenonTime` and `receivedTime` of an observation.
+func recordLatency(thingName string, observation Observation) {
+	delay := observation.ReceivedTime.Sub(observation.PhenomenonTime)
+	val, _ := latencies.LoadOrStore(thingName, &latencyWindow{})
+	window := val.(*latencyWindow)
+	window.lock.Lock()
+	defer window.lock.Unlock()
+	// Count the delay in the histogram, which only grows.
+	if window.buckets == nil {
+		window.buckets = make([]uint64, len(LatencyBuckets))
+	}
+	if i := sort.SearchFloat64s(LatencyBuckets, delay.Seconds()); i < len(LatencyBuckets) {
+		window.buckets[i]++
+	}
+	window.sum += delay.Seconds()
+	window.count++
+	if len(window.delays) < latencyWindowSize {
+		window.delays = append(window.delays, delay)
+		return
+	}
+	window.delays[window.next] = delay
+	window.next = (window.next + 1) % latencyWindowSize
+}
+
+// Get a copy of the most recent message delays of a thing.
+func GetLatencies(thingName string) []time.Duration {
+	val, ok := latencies.Load(thingName)
+	if !ok {
+		return []time.Duration{}
+	}
+	window := val.(*latencyWindow)
+	window.lock.Lock()
+	defer window.lock.Unlock()
+	delays := make([]time.Duration, len(window.delays))
+	copy(delays, window.delays)
+	return delays
+}
+
+// Get the histogram of all message delays of a thing.
+func GetLatencyHistogram(thingName string) (LatencyHistogram, bool) {
+	val, ok := latencies.Load(thingName)
+	if !ok {
+		return LatencyHistogram{}, false
+	}
+	window := val.(*latencyWindow)
+	window.lock.Lock()
+	defer window.lock.Unlock()
+	histogram := LatencyHistogram{Buckets: make([]uint64, len(LatencyBuckets)), Sum: window.sum, Count: window.count}
+	var cumulative uint64
+	for i, count := range window.buckets {
+		cumulative += count
+		histogram.Buckets[i] = cumulative
+	}
+	return histogram, true
+}
+
+// Iterate over the message delay histograms of all things.
+func RangeLatencyHistograms(f func(thingName string, histogram LatencyHistogram) bool) {
+	latencies.Range(func(key, _ interface{}) bool {
+		thingName := key.(string)
+		histogram, _ := GetLatencyHistogram(thingName)
+		return f(thingName, histogram)
+	})
+}
+
+// Calculate rolling statistics about the message delays of a thing.
+func GetLatencyStats(thingName string) (LatencyStats, bool) {
+	delays := GetLatencies(thingName)
+	if len(delays) == 0 {
+		return LatencyStats{}, false
+	}
+	sort.Slice(delays, func(i, j int) bool {
+		return delays[i] < delays[j]
+	})
+	n := len(delays)
+	return LatencyStats{
+		P50:   delays[(n-1)*50/100],
+		P95:   delays[(n-1)*95/100],
+		Min:   delays[0],
+		Max:   delays[n-1],
+		Count: n,
+	}, true
+}
+
+// Get the learned clock offset of a thing. This is the time that needs to
+// be added to a `phenomenonTime` of the thing to get the time on our clock.
+// We use the smallest message delay as an estimate, since it consists of
+// the (small) minimal transmission time and the skew of the controller clock.
+// Only delays above `minClockSkew` are treated as skew. The offset is truncated
+// to full seconds, since predictions have a 1-second resolution and the
+// transmission time should not be rounded up to an offset.
+// The reference time of predictions is corrected by this offset, so consumers
+// that compensate the message delay only need to compensate the remaining delay.
+func GetClockOffset(thingName string) time.Duration {
+	stats, ok := GetLatencyStats(thingName)
+	if !ok || stats.Count < minClockOffsetSamples {
+		return 0
+	}
+	if stats.Min.Abs() < minClockSkew {
+		return 0
+	}
+	return stats.Min.Truncate(time.Second)
+}
@@ -0,0 +1,85 @@
+package observations
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyStats(t *testing.T) {
+	for i := 1; i <= 100; i++ {
+		recordLatency("1337_1", Observation{
+			PhenomenonTime: time.Unix(0, 0),
+			ReceivedTime:   time.Unix(int64(i), 0),
+		})
+	}
+	stats, ok := GetLatencyStats("1337_1")
+	if !ok {
+		t.Errorf("expected latency stats")
+		t.FailNow()
+	}
+	if stats.Count != 100 || stats.Min != time.Second || stats.Max != 100*time.Second {
+		t.Errorf("unexpected latency stats: %+v", stats)
+	}
+	if stats.P50 != 50*time.Second || stats.P95 != 95*time.Second {
+		t.Errorf("unexpected latency percentiles: %+v", stats)
+	}
+	if _, ok := GetLatencyStats("1337_2"); ok {
+		t.Errorf("no latency stats expected for unknown thing")
+	}
+}
+
+func TestLatencyWindowIsBounded(t *testing.T) {
+	for i := 0; i < latencyWindowSize+10; i++ {
+		recordLatency("1337_3", Observation{
+			PhenomenonTime: time.Unix(0, 0),
+			ReceivedTime:   time.Unix(int64(i), 0),
+		})
+	}
+	stats, _ := GetLatencyStats("1337_3")
+	if stats.Count != latencyWindowSize {
+		t.Errorf("latency window should not grow beyond its size")
+	}
+	if stats.Min != 10*time.Second {
+		t.Errorf("the oldest delays should be dropped first")
+	}
+	// The histogram counts all delays, also beyond the window.
+	histogram, ok := GetLatencyHistogram("1337_3")
+	if !ok || histogram.Count != latencyWindowSize+10 {
+		t.Errorf("histogram should count all delays: %+v", histogram)
+	}
+	// Delays of 0 and 1 seconds are within the 1-second bucket, others are counted from 2 seconds.
+	if histogram.Buckets[1] != 2 || histogram.Buckets[len(LatencyBuckets)-1] != latencyWindowSize+10 {
+		t.Errorf("histogram buckets should be cumulative: %v", histogram.Buckets)
+	}
+}
+
+func TestClockOffset(t *testing.T) {
+	// The controller clock is 3 seconds behind, with some transmission jitter.
+	for i := 0; i < minClockOffsetSamples; i++ {
+		recordLatency("1337_4", Observation{
+			PhenomenonTime: time.Unix(100, 0),
+			ReceivedTime:   time.Unix(103, int64(i)*100_000_000),
+		})
+	}
+	if offset := GetClockOffset("1337_4"); offset != 3*time.Second {
+		t.Errorf("unexpected clock offset: %s", offset)
+	}
+	// Not enough samples to learn an offset.
+	recordLatency("1337_5", Observation{
+		PhenomenonTime: time.Unix(100, 0),
+		ReceivedTime:   time.Unix(110, 0),
+	})
+	if offset := GetClockOffset("1337_5"); offset != 0 {
+		t.Errorf("no clock offset expected without enough samples: %s", offset)
+	}
+	// A synced controller with a normal transmission delay has no offset.
+	for i := 0; i < minClockOffsetSamples; i++ {
+		recordLatency("1337_6", Observation{
+			PhenomenonTime: time.Unix(100, 0),
+			ReceivedTime:   time.Unix(100, 700_000_000),
+		})
+	}
+	if offset := GetClockOffset("1337_6"); offset != 0 {
+		t.Errorf("no clock offset expected for a transmission delay: %s", offset)
+	}
+}
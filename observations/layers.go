@@ -0,0 +1,58 @@
+package observations
+
+import "time"
+
+// The maximum age of real-time observations. Older observations are discarded.
+const maxObservationAge = 300 * time.Second
+
+// Register the layers of the traffic light datastreams.
+func init() {
+	// Primary signal observations tell which "color" the traffic light is currently showing.
+	RegisterLayer(Layer{
+		Name:           "primary_signal",
+		Prefetch:       true,
+		PrefetchRecent: true,
+		TrackLatency:   true,
+		DetectFlapping: true,
+		Rules:          []Rule{maxAge(maxObservationAge), resultInRange, signalColor},
+		CleanupLimit:   20,
+		Handle:         inferCycles,
+	})
+	// Signal program observations tell which program the traffic light is currently running.
+	// Programs change rarely, so we don't discard old observations.
+	RegisterLayer(Layer{
+		Name:         "signal_program",
+		Rules:        []Rule{resultInRange},
+		CleanupLimit: 5,
+		Prefetch:     true,
+	})
+	// Detector car observations tell when a car is detected, from 0 to 100 pct.
+	RegisterLayer(Layer{
+		Name:           "detector_car",
+		Prefetch:       true,
+		PrefetchRecent: true,
+		TrackLatency:   true,
+		Rules:          []Rule{maxAge(maxObservationAge), resultInRange, detectorPct},
+		CleanupLimit:   300,
+	})
+	// Detector bike observations tell when a bike is detected, from 0 to 100 pct.
+	RegisterLayer(Layer{
+		Name:           "detector_bike",
+		Prefetch:       true,
+		PrefetchRecent: true,
+		TrackLatency:   true,
+		Rules:          []Rule{maxAge(maxObservationAge), resultInRange, detectorPct},
+		CleanupLimit:   300,
+	})
+	// Cycle second observations tell when a new cycle starts.
+	// Their result is not used, so we only validate the time.
+	RegisterLayer(Layer{
+		Name:           "cycle_second",
+		Prefetch:       true,
+		PrefetchRecent: true,
+		TrackLatency:   true,
+		Rules:          []Rule{maxAge(maxObservationAge), notInFuture(futureTolerance)},
+		CleanupLimit:   5,
+		Handle:         completeCycles,
+	})
+}
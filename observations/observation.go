@@ -19,6 +19,8 @@ type Observation struct {
 	// This means that we can use a byte to store the result.
 	// This saves us a lot of memory and makes the code faster.
 	Result byte `json:"result"`
+	// If the result had to be clamped, since it didn't fit into a byte.
+	outOfRange bool
 }
 
 // Unmarshal an observation from JSON.
@@ -34,6 +36,7 @@ func (o *Observation) UnmarshalJSON(data []byte) error {
 	}
 	o.PhenomenonTime = temp.PhenomenonTime
 	o.ReceivedTime = receivedTime
+	o.outOfRange = temp.Result > 255 || temp.Result < 0
 	if temp.Result > 255 {
 		log.Warning.Println("Observation result is too large:", temp.Result)
 		temp.Result = 255
@@ -37,6 +37,9 @@ func TestUnmarshalErroneousObservation(t *testing.T) {
 	if o.Result != 255 {
 		t.Fatalf("result should be reset to a valid value on overflow")
 	}
+	if !o.outOfRange {
+		t.Fatalf("result should be marked as out of range on overflow")
+	}
 
 	data = []byte(`
 		{
@@ -51,4 +54,7 @@ func TestUnmarshalErroneousObservation(t *testing.T) {
 	if o.Result != 0 {
 		t.Fatalf("result should be reset to a valid value on underflow")
 	}
+	if !o.outOfRange {
+		t.Fatalf("result should be marked as out of range on underflow")
+	}
 }
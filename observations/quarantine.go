@@ -0,0 +1,183 @@
+package observations
+
+import (
+	"predictor/env"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The window over which the message rate of a topic is measured.
+const rateWindow = 10 * time.Second
+
+// The reasons why a topic can be quarantined.
+const (
+	// The topic received more messages than the rate limit allows.
+	QuarantineRate = "rate"
+	// The signal on the topic changed its color more often than the flapping limit allows.
+	QuarantineFlapping = "flapping"
+)
+
+// The number of observations that were dropped because their topic was quarantined.
+var ObservationsQuarantined uint64 = 0
+
+// The number of quarantines that were started, by their reason.
+// The values are pointers to uint64 counters.
+var QuarantinesByReason = &sync.Map{}
+
+// A quarantined datastream topic.
+type Quarantine struct {
+	// The MQTT topic of the datastream.
+	Topic string
+	// The name of the thing that the datastream belongs to.
+	Thing string
+	// The layer of the datastream.
+	Layer string
+	// Why the topic was quarantined.
+	Reason string
+	// The time until the topic is quarantined.
+	Until time.Time
+}
+
+// The message rate of a topic, measured within a fixed window.
+type topicRate struct {
+	// The lock that must be used when accessing the rate.
+	lock sync.Mutex
+	// The name of the thing that the topic belongs to.
+	thingName string
+	// The layer of the topic.
+	layerName string
+	// The start of the current window.
+	windowStart time.Time
+	// The number of messages in the current window.
+	messages int
+	// The number of result changes in the current window.
+	changes int
+	// The result of the last message, if there was one.
+	lastResult *byte
+	// The time until the topic is quarantined.
+	quarantinedUntil time.Time
+	// Why the topic was quarantined.
+	reason string
+}
+
+// The message rates by their datastream MQTT topic.
+var topicRates = &sync.Map{}
+
+// The message rates of the topics of a thing.
+type thingRates struct {
+	// The lock that must be used when accessing the rates.
+	lock sync.RWMutex
+	// The message rates by their topic.
+	rates map[string]*topicRate
+}
+
+// The message rates of the topics by their thing name, so that the
+// quarantines of a thing can be looked up without ranging over all topics.
+var ratesByThing = &sync.Map{}
+
+// Get the message rate of a topic, or create a new one.
+func getTopicRate(topic string, thingName string, layerName string) *topicRate {
+	if val, ok := topicRates.Load(topic); ok {
+		return val.(*topicRate)
+	}
+	val, loaded := topicRates.LoadOrStore(topic, &topicRate{thingName: thingName, layerName: layerName})
+	rate := val.(*topicRate)
+	if !loaded {
+		thingVal, _ := ratesByThing.LoadOrStore(thingName, &thingRates{rates: map[string]*topicRate{}})
+		t := thingVal.(*thingRates)
+		t.lock.Lock()
+		t.rates[topic] = rate
+		t.lock.Unlock()
+	}
+	return rate
+}
+
+// Track a message on a topic and check if the topic is quarantined.
+// The topic is quarantined if its message rate or, for layers that detect
+// flapping, its rate of result changes exceeds the configured limits.
+// Returns if the message must be dropped, and if the quarantine was started by this message.
+func checkQuarantine(topic string, thingName string, layer *Layer, observation Observation, now time.Time) (quarantined bool, started bool, reason string) {
+	rate := getTopicRate(topic, thingName, layer.Name)
+	rate.lock.Lock()
+	defer rate.lock.Unlock()
+
+	if now.Before(rate.quarantinedUntil) {
+		return true, false, rate.reason
+	}
+	if now.Sub(rate.windowStart) >= rateWindow {
+		rate.windowStart = now
+		rate.messages = 0
+		rate.changes = 0
+	}
+	rate.messages++
+	if rate.lastResult != nil && *rate.lastResult != observation.Result {
+		rate.changes++
+	}
+	result := observation.Result
+	rate.lastResult = &result
+
+	seconds := rateWindow.Seconds()
+	if env.TopicRateLimit > 0 && float64(rate.messages) > env.TopicRateLimit*seconds {
+		reason = QuarantineRate
+	} else if layer.DetectFlapping && env.FlappingLimit > 0 && float64(rate.changes) > env.FlappingLimit*seconds {
+		reason = QuarantineFlapping
+	} else {
+		return false, false, ""
+	}
+
+	rate.quarantinedUntil = now.Add(env.QuarantineDuration)
+	rate.reason = reason
+	rate.windowStart = time.Time{}
+	counter, _ := QuarantinesByReason.LoadOrStore(reason, new(uint64))
+	atomic.AddUint64(counter.(*uint64), 1)
+	return true, true, reason
+}
+
+// Get all topics that are currently quarantined.
+func GetQuarantines() []Quarantine {
+	now := time.Now()
+	quarantines := []Quarantine{}
+	topicRates.Range(func(k, v interface{}) bool {
+		rate := v.(*topicRate)
+		rate.lock.Lock()
+		defer rate.lock.Unlock()
+		if now.Before(rate.quarantinedUntil) {
+			quarantines = append(quarantines, Quarantine{
+				Topic:  k.(string),
+				Thing:  rate.thingName,
+				Layer:  rate.layerName,
+				Reason: rate.reason,
+				Until:  rate.quarantinedUntil,
+			})
+		}
+		return true
+	})
+	return quarantines
+}
+
+// Count the number of topics that are currently quarantined.
+func CountQuarantined() int {
+	return len(GetQuarantines())
+}
+
+// Get the reasons why the datastreams of a thing are quarantined, by their layer name.
+func GetQuarantinedLayers(thingName string) map[string]string {
+	layers := make(map[string]string)
+	val, ok := ratesByThing.Load(thingName)
+	if !ok {
+		return layers
+	}
+	t := val.(*thingRates)
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	now := time.Now()
+	for _, rate := range t.rates {
+		rate.lock.Lock()
+		if now.Before(rate.quarantinedUntil) {
+			layers[rate.layerName] = rate.reason
+		}
+		rate.lock.Unlock()
+	}
+	return layers
+}
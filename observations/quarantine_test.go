@@ -0,0 +1,79 @@
+package observations
+
+import (
+	"predictor/env"
+	"testing"
+	"time"
+)
+
+func TestQuarantineRate(t *testing.T) {
+	env.TopicRateLimit = 1
+	env.FlappingLimit = 0
+	env.QuarantineDuration = time.Minute
+	layer, _ := getLayer("detector_car")
+	topic := "v1.1/Datastreams(10)/Observations"
+	now := time.Unix(1000, 0)
+
+	// 10 messages within the window are allowed with a rate limit of 1 per second.
+	for i := 0; i < 10; i++ {
+		quarantined, _, _ := checkQuarantine(topic, "1337_1", layer, Observation{Result: 0}, now)
+		if quarantined {
+			t.Errorf("topic should not be quarantined after %d messages", i+1)
+			t.FailNow()
+		}
+	}
+	quarantined, started, reason := checkQuarantine(topic, "1337_1", layer, Observation{Result: 0}, now)
+	if !quarantined || !started || reason != QuarantineRate {
+		t.Errorf("topic should be quarantined for its rate")
+		t.FailNow()
+	}
+	quarantined, started, _ = checkQuarantine(topic, "1337_1", layer, Observation{Result: 0}, now.Add(30*time.Second))
+	if !quarantined || started {
+		t.Errorf("topic should still be quarantined")
+		t.FailNow()
+	}
+	quarantined, _, _ = checkQuarantine(topic, "1337_1", layer, Observation{Result: 0}, now.Add(2*time.Minute))
+	if quarantined {
+		t.Errorf("quarantine should have expired")
+		t.FailNow()
+	}
+}
+
+func TestQuarantineFlapping(t *testing.T) {
+	env.TopicRateLimit = 0
+	env.FlappingLimit = 0.5
+	env.QuarantineDuration = time.Minute
+	primarySignal, _ := getLayer("primary_signal")
+	detector, _ := getLayer("detector_car")
+	now := time.Now()
+
+	// The first message has no previous result, so 6 messages make 5 changes.
+	toggle := func(topic string, layer *Layer, n int) (quarantined bool) {
+		for i := 0; i < n; i++ {
+			quarantined, _, _ = checkQuarantine(topic, "1337_2", layer, Observation{Result: byte(i % 2)}, now)
+		}
+		return quarantined
+	}
+	if toggle("v1.1/Datastreams(11)/Observations", primarySignal, 6) {
+		t.Errorf("primary signal should not be quarantined after 5 changes")
+		t.FailNow()
+	}
+	if !toggle("v1.1/Datastreams(11)/Observations", primarySignal, 1) {
+		t.Errorf("flapping primary signal should be quarantined")
+		t.FailNow()
+	}
+	if toggle("v1.1/Datastreams(12)/Observations", detector, 20) {
+		t.Errorf("detectors should not be checked for flapping")
+		t.FailNow()
+	}
+
+	quarantined := GetQuarantinedLayers("1337_2")
+	if quarantined["primary_signal"] != QuarantineFlapping || len(quarantined) != 1 {
+		t.Errorf("unexpected quarantined layers: %v", quarantined)
+		t.FailNow()
+	}
+	if other := GetQuarantinedLayers("1337_unknown"); len(other) != 0 {
+		t.Errorf("unexpected quarantined layers of another thing: %v", other)
+		t.FailNow()
+	}
+}
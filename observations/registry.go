@@ -0,0 +1,90 @@
+package observations
+
+import (
+	"encoding/json"
+	"fmt"
+	"predictor/things"
+	"time"
+)
+
+// A validation rule for observations of a layer.
+type Rule struct {
+	// The name of the rule, used for logging and metrics.
+	Name string
+	// Check an observation, relative to the current time.
+	Check func(observation Observation, now time.Time) error
+}
+
+// A datastream layer that is processed by the observation listener.
+// New layers can be added by registering them with `RegisterLayer`.
+type Layer struct {
+	// The name of the layer, as in the `layerName` property of the datastream.
+	Name string
+	// Decode an observation from the raw MQTT payload.
+	Decode func(payload []byte) (Observation, error)
+	// The rules that observations of this layer must satisfy.
+	Rules []Rule
+	// The number of pending observations that are kept during a cleanup.
+	CleanupLimit int
+	// If the most recent observation of this layer is prefetched on startup.
+	Prefetch bool
+	// If all observations within the prefetch window are prefetched,
+	// instead of only the most recent one.
+	PrefetchRecent bool
+	// If observations of this layer are sent in real time, so that
+	// their message delay can be used to learn the latency of a thing.
+	TrackLatency bool
+	// If the datastreams of this layer are quarantined when their result
+	// changes too often, e.g. a signal that toggles between colors.
+	DetectFlapping bool
+	// Handle an observation after it was added to the cycle of the thing.
+	Handle func(thingName string, observation Observation) error
+}
+
+// The registered layers, in the order of their registration.
+var layers = []*Layer{}
+
+// The registered layers by their name.
+var layersByName = map[string]*Layer{}
+
+// Register a new layer. This should be called from an `init` function,
+// so that the layer is known before the things are synced.
+func RegisterLayer(layer Layer) {
+	if _, ok := layersByName[layer.Name]; ok {
+		panic(fmt.Sprintf("layer %s is already registered", layer.Name))
+	}
+	if layer.Decode == nil {
+		layer.Decode = decodeJSON
+	}
+	if layer.Handle == nil {
+		layer.Handle = func(thingName string, observation Observation) error { return nil }
+	}
+	layers = append(layers, &layer)
+	layersByName[layer.Name] = &layer
+	things.RegisterLayer(layer.Name)
+}
+
+// Unregister a layer, e.g. to clean up after a test.
+func unregisterLayer(name string) {
+	for i, layer := range layers {
+		if layer.Name == name {
+			layers = append(layers[:i], layers[i+1:]...)
+			break
+		}
+	}
+	delete(layersByName, name)
+	things.UnregisterLayer(name)
+}
+
+// Get a registered layer by its name.
+func getLayer(name string) (*Layer, bool) {
+	layer, ok := layersByName[name]
+	return layer, ok
+}
+
+// Decode an observation from its JSON representation.
+func decodeJSON(payload []byte) (Observation, error) {
+	var observation Observation
+	err := json.Unmarshal(payload, &observation)
+	return observation, err
+}
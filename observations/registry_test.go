@@ -0,0 +1,92 @@
+package observations
+
+import (
+	"predictor/things"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A minimal mqtt message for testing.
+type mockMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m mockMessage) Duplicate() bool   { return false }
+func (m mockMessage) Qos() byte         { return observationQoS }
+func (m mockMessage) Retained() bool    { return false }
+func (m mockMessage) Topic() string     { return m.topic }
+func (m mockMessage) MessageID() uint16 { return 0 }
+func (m mockMessage) Payload() []byte   { return m.payload }
+func (m mockMessage) Ack()              {}
+
+func TestRegisterLayer(t *testing.T) {
+	handled := make(chan string, 1)
+	RegisterLayer(Layer{
+		Name:  "test_layer",
+		Rules: []Rule{maxAge(300 * time.Second)},
+		Handle: func(thingName string, observation Observation) error {
+			handled <- thingName
+			return nil
+		},
+	})
+	t.Cleanup(func() { unregisterLayer("test_layer") })
+	if !strings.Contains(things.LayerFilter(""), "properties/layerName eq 'test_layer'") {
+		t.Errorf("registered layer should be synced")
+		t.FailNow()
+	}
+
+	topic := "v1.1/Datastreams(4242)/Observations"
+	things.DatastreamMqttTopics.Store(topic, "test_layer")
+	things.DatastreamThings.Store(topic, "4242_1")
+	t.Cleanup(func() {
+		things.DatastreamMqttTopics.Delete(topic)
+		things.DatastreamThings.Delete(topic)
+	})
+	payload := `{"phenomenonTime": "` + time.Now().Format(time.RFC3339) + `", "result": 7}`
+	processMessage(mockMessage{topic: topic, payload: []byte(payload)})
+	t.Cleanup(func() { states.Delete("4242_1") })
+
+	select {
+	case thingName := <-handled:
+		if thingName != "4242_1" {
+			t.Errorf("handled observation for wrong thing: %s", thingName)
+			t.FailNow()
+		}
+	default:
+		t.Errorf("observation was not handled")
+		t.FailNow()
+	}
+	snapshot, err := GetCycleSnapshot("4242_1", "test_layer")
+	if err != nil {
+		t.Errorf("no cycle for the layer: %v", err)
+		t.FailNow()
+	}
+	o, err := snapshot.GetMostRecentObservation()
+	if err != nil || o.Result != 7 {
+		t.Errorf("observation was not added to the cycle")
+	}
+}
+
+func TestUnregisterLayer(t *testing.T) {
+	RegisterLayer(Layer{Name: "test_layer_unregister"})
+	unregisterLayer("test_layer_unregister")
+	if _, ok := getLayer("test_layer_unregister"); ok {
+		t.Errorf("unregistered layer should not be found")
+		t.FailNow()
+	}
+	if strings.Contains(things.LayerFilter(""), "test_layer_unregister") {
+		t.Errorf("unregistered layer should not be synced")
+		t.FailNow()
+	}
+}
+
+func TestRegisterLayerTwice(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("should panic")
+		}
+	}()
+	RegisterLayer(Layer{Name: "primary_signal"})
+}
@@ -0,0 +1,29 @@
+package observations
+
+import (
+	"fmt"
+	"time"
+)
+
+// Replay an observation into the cycles of a thing, as if it was received at the given time.
+// Observations must be replayed in the order of their phenomenon time.
+// If the observation completes the running cycle, the completed cycles are returned.
+// No events are published, since replayed observations are not live.
+func ReplayObservation(thingName string, layerName string, observation Observation, now time.Time) (*CompletedCycles, error) {
+	layer, ok := getLayer(layerName)
+	if !ok {
+		return nil, fmt.Errorf("unknown layer: %s", layerName)
+	}
+	if rule, err := checkRules(layer, observation, now); err != nil {
+		return nil, fmt.Errorf("%s observation violates %s: %v", layerName, rule, err)
+	}
+	getState(thingName).add(layer.Name, observation)
+	if layer.Name != "cycle_second" {
+		return nil, nil
+	}
+	completed, err := completeAllCycles(thingName, observation)
+	if err != nil {
+		return nil, err
+	}
+	return &completed, nil
+}
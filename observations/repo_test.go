@@ -7,32 +7,26 @@ import (
 )
 
 func TestRepo(t *testing.T) {
-	mockCycle := &Cycle{
+	mockCycle := Cycle{
 		Outdated: &Observation{
 			PhenomenonTime: time.Unix(0, 0),
 			// don't care about the result
 		},
 	}
-	primarySignalCycles.Store("1337_1", mockCycle)
-	signalProgramCycles.Store("1337_1", mockCycle)
-	carDetectorCycles.Store("1337_1", mockCycle)
-	bikeDetectorCycles.Store("1337_1", mockCycle)
-	cycleSecondCycles.Store("1337_1", mockCycle)
-	for _, f := range []func(thingName string) (*Cycle, error){
-		GetPrimarySignalCycle,
-		GetSignalProgramCycle,
-		GetCarDetectorCycle,
-		GetBikeDetectorCycle,
-		GetCycleSecondCycle,
-	} {
-		cycle, err := f("1337_1")
+	state := getState("1337_1")
+	for _, layer := range []string{"primary_signal", "signal_program", "detector_car", "detector_bike", "cycle_second"} {
+		cycle := mockCycle
+		state.cycles[layer] = &cycle
+	}
+	for _, layer := range []string{"primary_signal", "signal_program", "detector_car", "detector_bike", "cycle_second"} {
+		snapshot, err := GetCycleSnapshot("1337_1", layer)
 		if err != nil {
 			t.Fatalf("failure to load current cycle: %s", err.Error())
 		}
-		if !reflect.DeepEqual(cycle, mockCycle) {
+		if !reflect.DeepEqual(snapshot, mockCycle.MakeSnapshot()) {
 			t.Fatalf("got wrong cycle")
 		}
-		_, err = f("1337_2") // nonexistent
+		_, err = GetCycleSnapshot("1337_2", layer) // nonexistent
 		if err == nil {
 			t.Fatalf("expected error")
 		}
@@ -0,0 +1,161 @@
+package observations
+
+import (
+	"math"
+	"predictor/env"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The number of recent cycle boundaries that are used to fit the cycle model of a thing.
+const maxBoundarySamples = 20
+
+// The number of cycle boundaries that are needed before the cycle model is used.
+// Until then, the boundaries are snapped to the raster.
+const minBoundarySamples = 4
+
+// The maximum deviation of a cycle boundary from the cycle model.
+// If a boundary deviates more, e.g. since the program changed, the model is learned anew.
+const maxBoundaryResidual = 2 * time.Second
+
+// A model of the cycles of a thing, learned from its recent cycle boundaries.
+// The boundaries are assumed to be at `offset + k * length` for an integer k.
+type cycleModel struct {
+	// The lock that must be used when accessing the model.
+	lock sync.Mutex
+	// The recent unsnapped cycle boundaries, sorted by time.
+	samples []time.Time
+	// The learned cycle length, or zero if the model is not (yet) valid.
+	length time.Duration
+	// The learned time of a cycle boundary, which defines the phase of the cycles.
+	offset time.Time
+}
+
+// The cycle models by their Thing name.
+var cycleModels = &sync.Map{}
+
+// Round a time to the closest point on the raster given by `CYCLE_RASTER`.
+// For example, on a 5-second raster, 12:34:56.123 will be rounded down to
+// 12:34:55.000, while 12:34:58.123 will be rounded up to 12:35:00.000.
+func snapToRaster(t time.Time) time.Time {
+	if env.CycleRaster <= 0 {
+		return t
+	}
+	roundedDown := t.Truncate(env.CycleRaster)
+	roundedUp := roundedDown.Add(env.CycleRaster)
+	// Find the closest time to the original time.
+	if t.Sub(roundedDown).Abs() < roundedUp.Sub(t).Abs() {
+		return roundedDown
+	}
+	return roundedUp
+}
+
+// Get the model boundary that is closest to the given time.
+func (m *cycleModel) predict(t time.Time) time.Time {
+	k := math.Round(float64(t.Sub(m.offset)) / float64(m.length))
+	return m.offset.Add(time.Duration(k * float64(m.length))).Round(time.Millisecond)
+}
+
+// Fit the cycle length and offset to the samples with a linear regression.
+// The model is invalidated if the samples don't fit a regular cycle.
+func (m *cycleModel) fit() {
+	m.length = 0
+	if len(m.samples) < minBoundarySamples {
+		return
+	}
+	// Use the median distance between boundaries as a first guess,
+	// so that missed boundaries can be assigned to the right cycle.
+	diffs := make([]time.Duration, 0, len(m.samples)-1)
+	for i := 1; i < len(m.samples); i++ {
+		diffs = append(diffs, m.samples[i].Sub(m.samples[i-1]))
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i] < diffs[j] })
+	guess := diffs[len(diffs)/2]
+	if guess < time.Second {
+		return
+	}
+
+	// Fit `t = offset + k * length` by least squares, with t in seconds since the first sample.
+	first := m.samples[0]
+	ks := make([]float64, len(m.samples))
+	ts := make([]float64, len(m.samples))
+	var kMean, tMean float64
+	for i, sample := range m.samples {
+		ks[i] = math.Round(float64(sample.Sub(first)) / float64(guess))
+		ts[i] = sample.Sub(first).Seconds()
+		if i > 0 && ks[i] == ks[i-1] {
+			return // Two boundaries within the same cycle.
+		}
+		kMean += ks[i]
+		tMean += ts[i]
+	}
+	n := float64(len(m.samples))
+	kMean /= n
+	tMean /= n
+	var cov, variance float64
+	for i := range ks {
+		cov += (ks[i] - kMean) * (ts[i] - tMean)
+		variance += (ks[i] - kMean) * (ks[i] - kMean)
+	}
+	length := cov / variance
+	offset := tMean - length*kMean
+
+	// Check that all samples are close to the model.
+	for i := range ks {
+		residual := ts[i] - (offset + length*ks[i])
+		if math.Abs(residual) > maxBoundaryResidual.Seconds() {
+			return
+		}
+	}
+	m.length = time.Duration(length * float64(time.Second))
+	m.offset = first.Add(time.Duration(offset * float64(time.Second)))
+}
+
+// Learn from a new cycle boundary of a thing and snap it to the cycle model.
+// As long as the model is not valid, the boundary is snapped to the raster.
+func snapBoundary(thingName string, t time.Time) time.Time {
+	val, _ := cycleModels.LoadOrStore(thingName, &cycleModel{})
+	m := val.(*cycleModel)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.samples) > 0 && !t.After(m.samples[len(m.samples)-1]) {
+		// Out-of-order boundaries are not learned from.
+		if m.length == 0 {
+			return snapToRaster(t)
+		}
+		return m.predict(t)
+	}
+	// Start over if the boundary doesn't fit the model anymore.
+	if m.length > 0 && t.Sub(m.predict(t)).Abs() > maxBoundaryResidual {
+		m.samples = m.samples[:0]
+	}
+	m.samples = append(m.samples, t)
+	if len(m.samples) > maxBoundarySamples {
+		m.samples = m.samples[len(m.samples)-maxBoundarySamples:]
+	}
+	m.fit()
+	if m.length == 0 {
+		// Start over from this boundary if the samples don't fit a regular cycle,
+		// e.g. since a spurious boundary was detected within a cycle. Otherwise,
+		// a single bad sample would block the model until it left the window.
+		if len(m.samples) >= minBoundarySamples {
+			m.samples = m.samples[len(m.samples)-1:]
+		}
+		return snapToRaster(t)
+	}
+	return m.predict(t)
+}
+
+// Get the learned cycle model of a thing, if there is a valid one.
+func GetCycleModel(thingName string) (length time.Duration, offset time.Time, ok bool) {
+	val, ok := cycleModels.Load(thingName)
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	m := val.(*cycleModel)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.length, m.offset, m.length > 0
+}
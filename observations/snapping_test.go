@@ -0,0 +1,92 @@
+package observations
+
+import (
+	"predictor/env"
+	"testing"
+	"time"
+)
+
+func TestSnapToRaster(t *testing.T) {
+	raster := env.CycleRaster
+	t.Cleanup(func() { env.CycleRaster = raster })
+	env.CycleRaster = 5 * time.Second
+	if snapped := snapToRaster(time.Unix(56, 123)); !snapped.Equal(time.Unix(55, 0)) {
+		t.Errorf("expected rounding down, got %s", snapped)
+		t.FailNow()
+	}
+	if snapped := snapToRaster(time.Unix(58, 123)); !snapped.Equal(time.Unix(60, 0)) {
+		t.Errorf("expected rounding up, got %s", snapped)
+		t.FailNow()
+	}
+	env.CycleRaster = 0
+	if snapped := snapToRaster(time.Unix(58, 123)); !snapped.Equal(time.Unix(58, 123)) {
+		t.Errorf("expected no rounding without a raster, got %s", snapped)
+		t.FailNow()
+	}
+}
+
+func TestSnapBoundary(t *testing.T) {
+	raster := env.CycleRaster
+	t.Cleanup(func() { env.CycleRaster = raster })
+	env.CycleRaster = 5 * time.Second
+	defer cycleModels.Delete("1337_snap")
+
+	// A cycle of 87 seconds, with a phase that is not on the raster and some jitter.
+	jitter := []time.Duration{0, 800 * time.Millisecond, -500 * time.Millisecond, 300 * time.Millisecond, 1 * time.Second, -200 * time.Millisecond}
+	start := time.Unix(1002, 0)
+	snapped := []time.Time{}
+	for i, j := range jitter {
+		snapped = append(snapped, snapBoundary("1337_snap", start.Add(time.Duration(i)*87*time.Second+j)))
+	}
+	// The first boundaries are snapped to the raster.
+	if !snapped[0].Equal(time.Unix(1000, 0)) {
+		t.Errorf("expected raster fallback, got %s", snapped[0])
+		t.FailNow()
+	}
+	// Afterwards, the boundaries follow the learned cycle length.
+	length, _, ok := GetCycleModel("1337_snap")
+	if !ok || (length-87*time.Second).Abs() > 500*time.Millisecond {
+		t.Errorf("expected a cycle length of about 87s, got %s", length)
+		t.FailNow()
+	}
+	if d := snapped[5].Sub(snapped[4]); (d - 87*time.Second).Abs() > 500*time.Millisecond {
+		t.Errorf("expected snapped cycles of about 87s, got %s", d)
+		t.FailNow()
+	}
+
+	// A missed boundary doesn't break the model.
+	missed := snapBoundary("1337_snap", start.Add(7*87*time.Second))
+	if _, _, ok := GetCycleModel("1337_snap"); !ok || (missed.Sub(snapped[5])-2*87*time.Second).Abs() > time.Second {
+		t.Errorf("expected the model to survive a missed boundary, got %s", missed)
+		t.FailNow()
+	}
+
+	// A different cycle length, e.g. after a program change, makes the model start over.
+	snapBoundary("1337_snap", start.Add(7*87*time.Second+60*time.Second))
+	if _, _, ok := GetCycleModel("1337_snap"); ok {
+		t.Errorf("expected the model to be reset")
+		t.FailNow()
+	}
+}
+
+func TestSnapBoundaryRecoversFromSpuriousBoundary(t *testing.T) {
+	raster := env.CycleRaster
+	t.Cleanup(func() { env.CycleRaster = raster })
+	env.CycleRaster = 5 * time.Second
+	defer cycleModels.Delete("1337_spurious")
+
+	// A spurious boundary within the second cycle, before a model could be learned.
+	start := time.Unix(1002, 0)
+	snapBoundary("1337_spurious", start)
+	snapBoundary("1337_spurious", start.Add(87*time.Second))
+	snapBoundary("1337_spurious", start.Add(100*time.Second))
+	for i := 2; i <= 5; i++ {
+		snapBoundary("1337_spurious", start.Add(time.Duration(i)*87*time.Second))
+	}
+	// The model is learned anew within a few cycles instead of the whole sample window.
+	length, _, ok := GetCycleModel("1337_spurious")
+	if !ok || (length-87*time.Second).Abs() > 500*time.Millisecond {
+		t.Errorf("expected the model to recover from a spurious boundary, got %s", length)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,178 @@
+package observations
+
+import (
+	"fmt"
+	"predictor/env"
+	"sync"
+	"time"
+)
+
+// The observation state of a thing, with the cycles of all layers.
+// All cycles are protected by a single lock, so that they are always
+// completed together and snapshots are consistent across the layers.
+type ThingState struct {
+	// The lock that must be used when accessing the cycles.
+	lock sync.RWMutex
+	// The cycles by their layer name.
+	cycles map[string]*Cycle
+	// The timelines of the most recent observations by their layer name.
+	timelines map[string]*timeline
+}
+
+// A consistent snapshot of the cycles of all layers of a thing.
+type ThingSnapshot struct {
+	// The snapshots of the cycles by their layer name.
+	Layers map[string]CycleSnapshot
+}
+
+// The observation states by their Thing name.
+var states = &sync.Map{}
+
+// Get the state of a thing, or create a new one.
+func getState(thingName string) *ThingState {
+	if state, ok := states.Load(thingName); ok {
+		return state.(*ThingState)
+	}
+	cycles := make(map[string]*Cycle, len(layers))
+	for _, layer := range layers {
+		cycles[layer.Name] = &Cycle{}
+	}
+	state, _ := states.LoadOrStore(thingName, &ThingState{cycles: cycles, timelines: map[string]*timeline{}})
+	return state.(*ThingState)
+}
+
+// Get the cycle of a layer, or create a new one.
+// The lock must be held when calling this function.
+func (s *ThingState) cycle(layerName string) *Cycle {
+	cycle, ok := s.cycles[layerName]
+	if !ok {
+		cycle = &Cycle{}
+		s.cycles[layerName] = cycle
+	}
+	return cycle
+}
+
+// Add an observation to the cycle of a layer.
+func (s *ThingState) add(layerName string, observation Observation) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cycle(layerName).add(observation)
+	if env.TimelineWindow > 0 {
+		s.timeline(layerName).add(observation, env.TimelineWindow)
+	}
+}
+
+// Get the timeline of a layer, or create a new one.
+// The lock must be held when calling this function.
+func (s *ThingState) timeline(layerName string) *timeline {
+	t, ok := s.timelines[layerName]
+	if !ok {
+		t = &timeline{}
+		s.timelines[layerName] = t
+	}
+	return t
+}
+
+// Get a copy of the timeline of a layer in the time range [from, to].
+func (s *ThingState) timelineBetween(layerName string, from time.Time, to time.Time) []Observation {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	t, ok := s.timelines[layerName]
+	if !ok {
+		return []Observation{}
+	}
+	return t.between(from, to)
+}
+
+// Complete the cycles of all layers at once. The running cycle is ended at the
+// given end time and starts at the end of the previous cycle. If the cycles can't
+// be completed, none of them are changed, except for remembering the first end time.
+func (s *ThingState) completeAll(cycleEndTime time.Time) (CompletedCycles, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	completed := CompletedCycles{
+		StartTime: s.cycle("cycle_second").EndTime,
+		EndTime:   cycleEndTime,
+		Layers:    make(map[string]CycleSnapshot, len(s.cycles)),
+	}
+	if completed.EndTime.Before(completed.StartTime) {
+		return CompletedCycles{}, fmt.Errorf("cycle completion time is before end time")
+	}
+	for layerName, cycle := range s.cycles {
+		// This only fails if the start time is not yet known, which is the same for all layers.
+		snapshot, err := cycle.complete(completed.StartTime, completed.EndTime)
+		if err != nil {
+			continue
+		}
+		completed.Layers[layerName] = snapshot
+	}
+	if completed.StartTime.IsZero() {
+		return CompletedCycles{}, fmt.Errorf("cycle not yet complete")
+	}
+	return completed, nil
+}
+
+// Truncate the pending observations of all layers to their cleanup limit.
+func (s *ThingState) truncatePending() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, layer := range layers {
+		s.cycle(layer.Name).truncatePending(layer.CleanupLimit)
+	}
+}
+
+// Drop the observations of all timelines that are older than the window before now.
+// This frees the memory of things that stopped sending observations.
+func (s *ThingState) pruneTimelines(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, t := range s.timelines {
+		t.prune(now.Add(-env.TimelineWindow))
+		t.compact()
+	}
+}
+
+// Make a consistent snapshot of the cycles of all layers.
+func (s *ThingState) snapshot() ThingSnapshot {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	snapshot := ThingSnapshot{Layers: make(map[string]CycleSnapshot, len(s.cycles))}
+	for layerName, cycle := range s.cycles {
+		snapshot.Layers[layerName] = cycle.MakeSnapshot()
+	}
+	return snapshot
+}
+
+// Make a consistent snapshot of the cycles of the given layers.
+// Only these layers are copied, layers without a cycle are left out.
+func (s *ThingState) snapshotLayers(layerNames ...string) ThingSnapshot {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	snapshot := ThingSnapshot{Layers: make(map[string]CycleSnapshot, len(layerNames))}
+	for _, layerName := range layerNames {
+		if cycle, ok := s.cycles[layerName]; ok {
+			snapshot.Layers[layerName] = cycle.MakeSnapshot()
+		}
+	}
+	return snapshot
+}
+
+// Get a consistent snapshot of the cycles of some layers of a thing.
+// This is cheaper than a snapshot of all layers, which copies the detector observations.
+func GetLayersSnapshot(thingName string, layerNames ...string) (ThingSnapshot, bool) {
+	state, ok := states.Load(thingName)
+	if !ok {
+		return ThingSnapshot{}, false
+	}
+	return state.(*ThingState).snapshotLayers(layerNames...), true
+}
+
+// Get a consistent snapshot of the cycles of all layers of a thing.
+func GetSnapshot(thingName string) (ThingSnapshot, bool) {
+	state, ok := states.Load(thingName)
+	if !ok {
+		return ThingSnapshot{}, false
+	}
+	return state.(*ThingState).snapshot(), true
+}
@@ -0,0 +1,90 @@
+package observations
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompleteAll(t *testing.T) {
+	state := getState("1337_state")
+	defer states.Delete("1337_state")
+
+	// The first completion only remembers the end of the cycle.
+	if _, err := state.completeAll(time.Unix(100, 0)); err == nil {
+		t.Errorf("first completion should not complete a cycle")
+		t.FailNow()
+	}
+	state.add("primary_signal", Observation{PhenomenonTime: time.Unix(110, 0), Result: 3})
+	state.add("signal_program", Observation{PhenomenonTime: time.Unix(120, 0), Result: 2})
+	state.add("primary_signal", Observation{PhenomenonTime: time.Unix(200, 0), Result: 1})
+
+	completed, err := state.completeAll(time.Unix(190, 0))
+	if err != nil {
+		t.Errorf("error during completion: %s", err)
+		t.FailNow()
+	}
+	if !completed.StartTime.Equal(time.Unix(100, 0)) || !completed.EndTime.Equal(time.Unix(190, 0)) {
+		t.Errorf("unexpected cycle time frame: %s - %s", completed.StartTime, completed.EndTime)
+		t.FailNow()
+	}
+	for _, layer := range layers {
+		cycle, ok := completed.Layers[layer.Name]
+		if !ok || !cycle.EndTime.Equal(time.Unix(190, 0)) {
+			t.Errorf("layer %s was not completed", layer.Name)
+			t.FailNow()
+		}
+	}
+	if len(completed.Layers["primary_signal"].Completed) != 1 || len(completed.Layers["signal_program"].Completed) != 1 {
+		t.Errorf("observations were not completed")
+		t.FailNow()
+	}
+
+	// A completion that goes back in time doesn't change any layer.
+	if _, err := state.completeAll(time.Unix(150, 0)); err == nil {
+		t.Errorf("completion before the last end time should fail")
+		t.FailNow()
+	}
+	snapshot, _ := GetSnapshot("1337_state")
+	for layerName, cycle := range snapshot.Layers {
+		if !cycle.EndTime.Equal(time.Unix(190, 0)) {
+			t.Errorf("layer %s was changed by a failed completion", layerName)
+			t.FailNow()
+		}
+	}
+}
+
+func TestSnapshotIsCopied(t *testing.T) {
+	state := getState("1337_copy")
+	defer states.Delete("1337_copy")
+
+	state.add("primary_signal", Observation{PhenomenonTime: time.Unix(20, 0), Result: 1})
+	snapshot, _ := GetSnapshot("1337_copy")
+	// An out-of-order observation sorts the pending observations in place.
+	state.add("primary_signal", Observation{PhenomenonTime: time.Unix(10, 0), Result: 3})
+
+	pending := snapshot.Layers["primary_signal"].Pending
+	if len(pending) != 1 || pending[0].Result != 1 {
+		t.Errorf("snapshot was changed by a later observation: %v", pending)
+		t.FailNow()
+	}
+}
+
+func TestLayersSnapshot(t *testing.T) {
+	state := getState("1337_layers")
+	defer states.Delete("1337_layers")
+
+	state.add("primary_signal", Observation{PhenomenonTime: time.Unix(20, 0), Result: 1})
+	snapshot, ok := GetLayersSnapshot("1337_layers", "primary_signal", "signal_program", "unknown_layer")
+	if !ok || len(snapshot.Layers) != 2 {
+		t.Errorf("unexpected layers in snapshot: %v", snapshot.Layers)
+		t.FailNow()
+	}
+	if pending := snapshot.Layers["primary_signal"].Pending; len(pending) != 1 || pending[0].Result != 1 {
+		t.Errorf("unexpected primary signal snapshot: %v", pending)
+		t.FailNow()
+	}
+	if _, ok := GetLayersSnapshot("1337_missing", "primary_signal"); ok {
+		t.Errorf("snapshot of an unknown thing should fail")
+		t.FailNow()
+	}
+}
@@ -8,21 +8,97 @@ import (
 	"net/url"
 	"predictor/env"
 	"predictor/log"
+	"predictor/things"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
-func prefetchMostRecentObservationsPage(page int) (more bool) {
+// A prefetched observation, before it is replayed into the cycles.
+type prefetchedObservation struct {
+	// The name of the thing that the observation belongs to.
+	thingName string
+	// The MQTT topic of the datastream, used for the duplicate detection.
+	topic string
+	// The layer of the datastream.
+	layer *Layer
+	// The observation itself.
+	observation Observation
+}
+
+// Build a filter expression that matches all layers that should be prefetched.
+// If recent is set, only layers that prefetch a window of recent observations are matched.
+func prefetchLayerFilter(recent bool) string {
+	conditions := []string{}
+	for _, layer := range layers {
+		if !layer.Prefetch || layer.PrefetchRecent != recent {
+			continue
+		}
+		conditions = append(conditions, fmt.Sprintf("properties/layerName eq '%s'", layer.Name))
+	}
+	return "(" + strings.Join(conditions, " or ") + ")"
+}
+
+// The number of observations that are requested per datastream and page within the prefetch window.
+// Further observations of busy datastreams are fetched by following the next links.
+const prefetchObservationsPerPage = 1000
+
+// Build the expand expression for the observations of the prefetched datastreams.
+// If since is zero, only the most recent observation is fetched.
+func prefetchObservationsExpand(since time.Time) string {
+	if since.IsZero() {
+		return "Observations($orderby=phenomenonTime desc;$top=1)"
+	}
+	return fmt.Sprintf(
+		"Observations($filter=phenomenonTime ge %s;$orderby=phenomenonTime desc;$top=%d)",
+		since.UTC().Format(time.RFC3339), prefetchObservationsPerPage,
+	)
+}
+
+// Fetch the remaining observations of a datastream, starting with the next link of its expanded observations.
+func fetchRemainingObservations(nextUri string) ([]Observation, error) {
+	fetched := []Observation{}
+	for {
+		resp, err := http.Get(nextUri)
+		if err != nil {
+			return fetched, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fetched, err
+		}
+		if resp.StatusCode >= 300 {
+			return fetched, fmt.Errorf("could not fetch observations: %s", resp.Status)
+		}
+		var observationsResponse struct {
+			Value   []Observation `json:"value"`
+			NextUri *string       `json:"@iot.nextLink"`
+		}
+		if err := json.Unmarshal(body, &observationsResponse); err != nil {
+			return fetched, err
+		}
+		fetched = append(fetched, observationsResponse.Value...)
+		if observationsResponse.NextUri == nil {
+			return fetched, nil
+		}
+		nextUri = *observationsResponse.NextUri
+	}
+}
+
+func prefetchObservationsPage(page int, recent bool, since time.Time) (fetched []prefetchedObservation, more bool) {
 	elementsPerPage := 100
 	pageUrl := env.SensorThingsBaseUrlObservations + "Datastreams?" + url.QueryEscape(
 		"$filter="+
 			"properties/serviceName eq 'HH_STA_traffic_lights' "+
-			"and (properties/layerName eq 'signal_program') "+
+			"and "+prefetchLayerFilter(recent)+" "+
 			"and (Thing/properties/laneType eq 'Radfahrer' "+
 			"  or Thing/properties/laneType eq 'KFZ/Radfahrer' "+
 			"  or Thing/properties/laneType eq 'Fußgänger/Radfahrer' "+
 			"  or Thing/properties/laneType eq 'Bus/Radfahrer' "+
 			"  or Thing/properties/laneType eq 'KFZ/Bus/Radfahrer')"+
-			"&$expand=Thing,Observations($orderby=phenomenonTime;$top=1)"+
+			"&$expand=Thing,"+prefetchObservationsExpand(since)+
 			"&$skip="+fmt.Sprintf("%d", page*elementsPerPage),
 	)
 	log.Info.Println("------- Fetching observations from ", pageUrl)
@@ -34,7 +110,7 @@ func prefetchMostRecentObservationsPage(page int) (more bool) {
 	defer resp.Body.Close()
 	if resp.StatusCode >= 300 {
 		log.Warning.Println("Could not sync observations: ", resp.Status)
-		return false
+		return nil, false
 	}
 
 	body, err := io.ReadAll(resp.Body)
@@ -53,6 +129,8 @@ func prefetchMostRecentObservationsPage(page int) (more bool) {
 				Name string `json:"name"`
 			}
 			Observations []Observation `json:"Observations"`
+			// The link to further observations, if not all were expanded.
+			NextObservationsUri *string `json:"Observations@iot.nextLink"`
 		} `json:"value"`
 		NextUri *string `json:"@iot.nextLink"`
 	}
@@ -63,25 +141,35 @@ func prefetchMostRecentObservationsPage(page int) (more bool) {
 	}
 
 	for _, expandedDatastream := range observationsResponse.Value {
-		if len(expandedDatastream.Observations) == 0 {
+		layer, ok := getLayer(expandedDatastream.Properties.LayerName)
+		if !ok || !layer.Prefetch || layer.PrefetchRecent != recent {
 			continue
 		}
-		o := expandedDatastream.Observations[0]
-		switch expandedDatastream.Properties.LayerName {
-		// At the moment, we only care about signal programs.
-		case "signal_program":
-			cycle, _ := signalProgramCycles.LoadOrStore(expandedDatastream.Thing.Name, &Cycle{})
-			cycle.(*Cycle).add(o)
-		default:
-			continue
+		topic := things.Datastream{IotId: expandedDatastream.DatastreamId}.MqttTopic()
+		observations := expandedDatastream.Observations
+		if expandedDatastream.NextObservationsUri != nil {
+			remaining, err := fetchRemainingObservations(*expandedDatastream.NextObservationsUri)
+			if err != nil {
+				log.Warning.Printf("Could not prefetch all observations of datastream %d: %v", expandedDatastream.DatastreamId, err)
+			}
+			observations = append(observations, remaining...)
+		}
+		for _, o := range observations {
+			fetched = append(fetched, prefetchedObservation{
+				thingName:   expandedDatastream.Thing.Name,
+				topic:       topic,
+				layer:       layer,
+				observation: o,
+			})
 		}
 	}
-	return observationsResponse.NextUri != nil
+	return fetched, observationsResponse.NextUri != nil
 }
 
-// Prefetch the most recent observations for all datastreams.
-func PrefetchMostRecentObservations() {
-	log.Info.Println("Prefetching most recent observations...")
+// Fetch all pages of the prefetch query for the given layers.
+func prefetchObservations(recent bool, since time.Time) []prefetchedObservation {
+	var fetched []prefetchedObservation
+	var fetchedLock sync.Mutex
 
 	// Fetch all pages of the SensorThings query.
 	var page = 0
@@ -93,7 +181,10 @@ func PrefetchMostRecentObservations() {
 			wg.Add(1)
 			go func(page int) {
 				defer wg.Done()
-				more := prefetchMostRecentObservationsPage(page)
+				fetchedPage, more := prefetchObservationsPage(page, recent, since)
+				fetchedLock.Lock()
+				defer fetchedLock.Unlock()
+				fetched = append(fetched, fetchedPage...)
 				if more {
 					foundMore = true
 				}
@@ -106,6 +197,54 @@ func PrefetchMostRecentObservations() {
 			break
 		}
 	}
+	return fetched
+}
+
+// Replay prefetched observations into the cycles, in the order they were observed.
+// Cycles are completed on `cycle_second` observations as they would be live,
+// but without publishing events, since no prediction should be made yet.
+func replayPrefetchedObservations(fetched []prefetchedObservation) {
+	sort.SliceStable(fetched, func(i, j int) bool {
+		return fetched[i].observation.PhenomenonTime.Before(fetched[j].observation.PhenomenonTime)
+	})
+	now := time.Now()
+	for _, p := range fetched {
+		// Remember the observation, so that it is not processed again
+		// when the broker delivers it after the subscription.
+		if isDuplicate(p.topic, p.observation) {
+			continue
+		}
+		// The replay clock is the time of the observation itself, so that the
+		// age limit doesn't discard observations while the pages are fetched.
+		// Observations from the future are still checked against our clock.
+		replayTime := p.observation.PhenomenonTime
+		if replayTime.After(now) {
+			replayTime = now
+		}
+		// Invalid observations and incomplete cycles are skipped.
+		ReplayObservation(p.thingName, p.layer.Name, p.observation, replayTime)
+	}
+}
+
+// Prefetch the most recent observations for all datastreams.
+// For layers that prefetch recent observations, all observations
+// within the prefetch window are loaded to warm up the cycles.
+func PrefetchMostRecentObservations() {
+	log.Info.Println("Prefetching most recent observations...")
+
+	fetched := prefetchObservations(false, time.Time{})
+	var since time.Time
+	if env.PrefetchWindow > 0 {
+		window := env.PrefetchWindow
+		// Older observations would be discarded if they were received live.
+		if window > maxObservationAge {
+			log.Warning.Printf("PREFETCH_WINDOW %s exceeds the maximum age of observations, using %s.", window, maxObservationAge)
+			window = maxObservationAge
+		}
+		since = time.Now().Add(-window)
+	}
+	fetched = append(fetched, prefetchObservations(true, since)...)
+	replayPrefetchedObservations(fetched)
 
-	log.Info.Println("Prefetched most recent observations.")
+	log.Info.Printf("Prefetched %d most recent observations.", len(fetched))
 }
@@ -5,7 +5,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"predictor/env"
+	"strings"
 	"testing"
+	"time"
 )
 
 var mockResponse = `
@@ -41,18 +43,13 @@ func TestPrefetchMostRecentObservations(t *testing.T) {
 	env.SensorThingsBaseUrlObservations = fmt.Sprintf("%s/", testServer.URL)
 	PrefetchMostRecentObservations()
 
-	signalProgramCycles.Range(func(k, v interface{}) bool {
+	states.Range(func(k, v interface{}) bool {
 		thingName := k.(string)
 		if thingName != "1337_1" {
 			t.Errorf("unexpected thing name: %s", thingName)
 			t.FailNow()
 		}
-		cycle := v.(*Cycle)
-		if cycle == nil {
-			t.Errorf("no cycle parsed")
-			t.FailNow()
-		}
-		observation, err := cycle.MakeSnapshot().GetMostRecentObservation()
+		observation, err := v.(*ThingState).snapshot().Layers["signal_program"].GetMostRecentObservation()
 		if err != nil {
 			t.Errorf("last observation could not be fetched")
 			t.FailNow()
@@ -64,3 +61,137 @@ func TestPrefetchMostRecentObservations(t *testing.T) {
 		return true
 	})
 }
+
+func TestPrefetchRecentObservations(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	format := func(d time.Duration) string {
+		return now.Add(-d).UTC().Format(time.RFC3339)
+	}
+	recentResponse := fmt.Sprintf(`
+	{
+		"value": [
+			{
+				"@iot.id": 2,
+				"properties": {
+					"layerName": "primary_signal"
+				},
+				"Thing": {
+					"name": "1337_2"
+				},
+				"Observations": [
+					{"phenomenonTime": "%s", "receivedTime": "%s", "result": 3},
+					{"phenomenonTime": "%s", "receivedTime": "%s", "result": 1}
+				]
+			},
+			{
+				"@iot.id": 3,
+				"properties": {
+					"layerName": "cycle_second"
+				},
+				"Thing": {
+					"name": "1337_2"
+				},
+				"Observations": [
+					{"phenomenonTime": "%s", "receivedTime": "%s", "result": 0},
+					{"phenomenonTime": "%s", "receivedTime": "%s", "result": 0}
+				]
+			}
+		]
+	}
+	`,
+		format(30*time.Second), format(30*time.Second),
+		format(70*time.Second), format(70*time.Second),
+		format(20*time.Second), format(20*time.Second),
+		format(80*time.Second), format(80*time.Second),
+	)
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(200)
+		if strings.Contains(req.URL.RawQuery, "cycle_second") {
+			res.Write([]byte(recentResponse))
+			return
+		}
+		res.Write([]byte(`{"value": []}`))
+	}))
+	defer testServer.Close()
+
+	env.SensorThingsBaseUrlObservations = fmt.Sprintf("%s/", testServer.URL)
+	env.PrefetchWindow = 5 * time.Minute
+	PrefetchMostRecentObservations()
+
+	snapshot, ok := GetSnapshot("1337_2")
+	if !ok {
+		t.Errorf("no cycles prefetched")
+		t.FailNow()
+	}
+	if snapshot.Layers["cycle_second"].EndTime.IsZero() {
+		t.Errorf("cycle boundary was not replayed")
+		t.FailNow()
+	}
+	primarySignal := snapshot.Layers["primary_signal"]
+	if len(primarySignal.Completed)+len(primarySignal.Pending) == 0 {
+		t.Errorf("primary signal observations were not replayed")
+		t.FailNow()
+	}
+	o, err := primarySignal.GetMostRecentObservation()
+	if err != nil || o.Result != 3 {
+		t.Errorf("unexpected most recent primary signal: %v", o)
+		t.FailNow()
+	}
+	if !isDuplicate("v1.1/Datastreams(2)/Observations", o) {
+		t.Errorf("prefetched observation not remembered for duplicate detection")
+		t.FailNow()
+	}
+}
+
+func TestReplayPrefetchedObservationsByTheirTime(t *testing.T) {
+	layer, _ := getLayer("cycle_second")
+	now := time.Now()
+	t.Cleanup(func() { states.Delete("1337_replay") })
+	replayPrefetchedObservations([]prefetchedObservation{
+		// Older than the age limit by now, e.g. since the prefetch was slow.
+		{"1337_replay", "v1.1/Datastreams(4)/Observations", layer, Observation{PhenomenonTime: now.Add(-maxObservationAge - time.Minute)}},
+		// Too far in the future, even with the tolerance for the controller clocks.
+		{"1337_replay", "v1.1/Datastreams(4)/Observations", layer, Observation{PhenomenonTime: now.Add(2 * futureTolerance)}},
+	})
+	snapshot, ok := GetSnapshot("1337_replay")
+	if !ok || snapshot.Layers["cycle_second"].EndTime.IsZero() {
+		t.Errorf("old prefetched observation was not replayed")
+		t.FailNow()
+	}
+	if o, err := snapshot.Layers["cycle_second"].GetMostRecentObservation(); err != nil || o.PhenomenonTime.After(now) {
+		t.Errorf("observation from the future was replayed: %v, %v", o, err)
+		t.FailNow()
+	}
+}
+
+func TestPrefetchFollowsObservationNextLinks(t *testing.T) {
+	var testServer *httptest.Server
+	observation := func(result int) string {
+		return fmt.Sprintf(`{"phenomenonTime": "2024-04-30T03:02:28Z", "receivedTime": "2024-04-30T03:02:28Z", "result": %d}`, result)
+	}
+	testServer = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(200)
+		switch req.URL.Path {
+		case "/next1":
+			fmt.Fprintf(res, `{"value": [%s], "@iot.nextLink": "%s/next2"}`, observation(2), testServer.URL)
+		case "/next2":
+			fmt.Fprintf(res, `{"value": [%s]}`, observation(3))
+		default:
+			fmt.Fprintf(res, `{"value": [{
+				"@iot.id": 5,
+				"properties": {"layerName": "detector_car"},
+				"Thing": {"name": "1337_next"},
+				"Observations": [%s],
+				"Observations@iot.nextLink": "%s/next1"
+			}]}`, observation(1), testServer.URL)
+		}
+	}))
+	defer testServer.Close()
+
+	env.SensorThingsBaseUrlObservations = fmt.Sprintf("%s/", testServer.URL)
+	fetched, more := prefetchObservationsPage(0, true, time.Now().Add(-time.Minute))
+	if more || len(fetched) != 3 || fetched[2].observation.Result != 3 {
+		t.Errorf("next links of the observations were not followed: %v", fetched)
+		t.FailNow()
+	}
+}
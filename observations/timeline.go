@@ -0,0 +1,81 @@
+package observations
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The maximum number of observations in the timeline of a layer.
+// This bounds the memory of datastreams that send close to the rate limit.
+const maxTimelineLength = 20000
+
+// A bounded buffer of the most recent observations of a layer, ordered by phenomenon time.
+// Unlike the cycles, the timeline is not reset when a cycle is completed.
+type timeline struct {
+	observations []Observation
+}
+
+// Insert an observation in the order of its phenomenon time.
+// Observations that are older than the window before the newest observation are dropped.
+func (t *timeline) add(observation Observation, window time.Duration) {
+	i := sort.Search(len(t.observations), func(i int) bool {
+		return t.observations[i].PhenomenonTime.After(observation.PhenomenonTime)
+	})
+	t.observations = append(t.observations, Observation{})
+	copy(t.observations[i+1:], t.observations[i:])
+	t.observations[i] = observation
+	newest := t.observations[len(t.observations)-1].PhenomenonTime
+	t.prune(newest.Add(-window))
+}
+
+// Drop all observations before the given time and beyond the maximum length.
+func (t *timeline) prune(before time.Time) {
+	i := sort.Search(len(t.observations), func(i int) bool {
+		return !t.observations[i].PhenomenonTime.Before(before)
+	})
+	if excess := len(t.observations) - maxTimelineLength; excess > i {
+		i = excess
+	}
+	if i == 0 {
+		return
+	}
+	// Re-slicing is cheap on every insert. The dropped observations are freed
+	// when the append reallocates the buffer, or when the timeline is compacted.
+	t.observations = t.observations[i:]
+}
+
+// Copy the observations into a new buffer if the buffer is mostly unused,
+// so that the memory of dropped observations is freed.
+func (t *timeline) compact() {
+	if cap(t.observations) > 2*len(t.observations) {
+		t.observations = append([]Observation(nil), t.observations...)
+	}
+}
+
+// Get a copy of the observations in the time range [from, to].
+func (t *timeline) between(from time.Time, to time.Time) []Observation {
+	start := sort.Search(len(t.observations), func(i int) bool {
+		return !t.observations[i].PhenomenonTime.Before(from)
+	})
+	end := sort.Search(len(t.observations), func(i int) bool {
+		return t.observations[i].PhenomenonTime.After(to)
+	})
+	if start >= end {
+		return []Observation{}
+	}
+	return append([]Observation(nil), t.observations[start:end]...)
+}
+
+// Get the observations of a layer for a given thing in the time range [from, to].
+// Only observations within the timeline window before the newest observation are kept.
+func GetTimeline(thingName string, layerName string, from time.Time, to time.Time) ([]Observation, error) {
+	if _, ok := getLayer(layerName); !ok {
+		return nil, fmt.Errorf("unknown layer: %s", layerName)
+	}
+	state, ok := states.Load(thingName)
+	if !ok {
+		return nil, fmt.Errorf("no timeline found for thing %s", thingName)
+	}
+	return state.(*ThingState).timelineBetween(layerName, from, to), nil
+}
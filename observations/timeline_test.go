@@ -0,0 +1,80 @@
+package observations
+
+import (
+	"predictor/env"
+	"testing"
+	"time"
+)
+
+func TestTimeline(t *testing.T) {
+	env.TimelineWindow = 60 * time.Second
+	defer func() { env.TimelineWindow = 0 }()
+	state := getState("1337_timeline")
+	defer states.Delete("1337_timeline")
+
+	// Observations are ordered by their phenomenon time, also if they arrive out of order.
+	state.add("primary_signal", Observation{PhenomenonTime: time.Unix(10, 0), Result: 1})
+	state.add("primary_signal", Observation{PhenomenonTime: time.Unix(30, 0), Result: 3})
+	state.add("primary_signal", Observation{PhenomenonTime: time.Unix(20, 0), Result: 4})
+	state.add("signal_program", Observation{PhenomenonTime: time.Unix(25, 0), Result: 2})
+
+	timeline, err := GetTimeline("1337_timeline", "primary_signal", time.Unix(15, 0), time.Unix(30, 0))
+	if err != nil {
+		t.Errorf("error during timeline query: %s", err)
+		t.FailNow()
+	}
+	if len(timeline) != 2 || timeline[0].Result != 4 || timeline[1].Result != 3 {
+		t.Errorf("unexpected timeline: %v", timeline)
+		t.FailNow()
+	}
+
+	// Observations outside of the window before the newest observation are dropped.
+	state.add("primary_signal", Observation{PhenomenonTime: time.Unix(75, 0), Result: 1})
+	timeline, _ = GetTimeline("1337_timeline", "primary_signal", time.Unix(0, 0), time.Unix(100, 0))
+	if len(timeline) != 3 || !timeline[0].PhenomenonTime.Equal(time.Unix(20, 0)) {
+		t.Errorf("old observations were not dropped: %v", timeline)
+		t.FailNow()
+	}
+
+	// The cleanup drops observations outside of the window before now.
+	state.pruneTimelines(time.Unix(130, 0))
+	timeline, _ = GetTimeline("1337_timeline", "primary_signal", time.Unix(0, 0), time.Unix(100, 0))
+	if len(timeline) != 1 {
+		t.Errorf("timeline was not pruned: %v", timeline)
+		t.FailNow()
+	}
+
+	if _, err := GetTimeline("1337_timeline", "unknown", time.Unix(0, 0), time.Unix(100, 0)); err == nil {
+		t.Errorf("query of an unknown layer should fail")
+		t.FailNow()
+	}
+	if _, err := GetTimeline("unknown", "primary_signal", time.Unix(0, 0), time.Unix(100, 0)); err == nil {
+		t.Errorf("query of an unknown thing should fail")
+		t.FailNow()
+	}
+}
+
+func TestTimelineAddDoesNotCopyOnEveryInsert(t *testing.T) {
+	tl := &timeline{}
+	window := 60 * time.Second
+	second := int64(0)
+	add := func() {
+		tl.add(Observation{PhenomenonTime: time.Unix(second, 0)}, window)
+		second++
+	}
+	for i := 0; i < 600; i++ {
+		add()
+	}
+	// Once the window is full, each insert drops an observation.
+	if allocs := testing.AllocsPerRun(100, add); allocs > 0.5 {
+		t.Errorf("too many allocations per insert: %f", allocs)
+		t.FailNow()
+	}
+
+	tl.prune(time.Unix(second-5, 0))
+	tl.compact()
+	if len(tl.observations) != 5 || cap(tl.observations) > 10 {
+		t.Errorf("timeline was not compacted: len %d, cap %d", len(tl.observations), cap(tl.observations))
+		t.FailNow()
+	}
+}
@@ -2,30 +2,106 @@ package observations
 
 import (
 	"fmt"
+	"predictor/phases"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Validate an observation for a given datastream type.
-func validateObservation(observation Observation, dsType string) error {
-	var shouldValidateTime = false
-	switch dsType {
-	case "primary_signal":
-		shouldValidateTime = true
-	case "cycle_second":
-		shouldValidateTime = true
-	case "detector_car":
-		shouldValidateTime = true
-	case "detector_bike":
-		shouldValidateTime = true
-	case "signal_program":
-		shouldValidateTime = false
-	}
-	if shouldValidateTime {
-		// Check if the observation is too old.
-		timeSince := time.Since(observation.PhenomenonTime)
-		if timeSince > 300*time.Second {
-			return fmt.Errorf("%s observation is too old: %d seconds", dsType, timeSince/time.Second)
+// How far in the future a `cycle_second` observation may be. The clocks
+// of the traffic light controllers are not perfectly synchronized with ours.
+const futureTolerance = 5 * time.Second
+
+// The key under which rejected observations are counted.
+type RejectionKey struct {
+	// The layer of the rejected observation.
+	Layer string
+	// The name of the violated rule.
+	Rule string
+}
+
+// The number of rejected observations (*uint64) by their `RejectionKey`.
+var ObservationsRejectedByRule = &sync.Map{}
+
+// The number of rejected observations (*uint64) by their Thing name.
+var ObservationsRejectedByThing = &sync.Map{}
+
+// Count a rejected observation for the violated rule and thing.
+func countRejection(thingName string, dsType string, rule string) {
+	val, _ := ObservationsRejectedByRule.LoadOrStore(RejectionKey{Layer: dsType, Rule: rule}, new(uint64))
+	atomic.AddUint64(val.(*uint64), 1)
+	val, _ = ObservationsRejectedByThing.LoadOrStore(thingName, new(uint64))
+	atomic.AddUint64(val.(*uint64), 1)
+}
+
+// Check an observation against the rules of a layer.
+// Returns the name of the first violated rule and the reason.
+func checkRules(layer *Layer, observation Observation, now time.Time) (string, error) {
+	for _, rule := range layer.Rules {
+		if err := rule.Check(observation, now); err != nil {
+			return rule.Name, err
 		}
 	}
-	return nil
+	return "", nil
+}
+
+// A rule that discards observations that are older than the given duration.
+func maxAge(d time.Duration) Rule {
+	return Rule{
+		Name: "max_age",
+		Check: func(observation Observation, now time.Time) error {
+			timeSince := now.Sub(observation.PhenomenonTime)
+			if timeSince > d {
+				return fmt.Errorf("observation is too old: %d seconds", timeSince/time.Second)
+			}
+			return nil
+		},
+	}
+}
+
+// A rule that discards observations that are further in the future than the given duration.
+func notInFuture(tolerance time.Duration) Rule {
+	return Rule{
+		Name: "future_time",
+		Check: func(observation Observation, now time.Time) error {
+			timeUntil := observation.PhenomenonTime.Sub(now)
+			if timeUntil > tolerance {
+				return fmt.Errorf("observation is in the future: %d seconds", timeUntil/time.Second)
+			}
+			return nil
+		},
+	}
+}
+
+// A rule that discards observations with results that didn't fit into a byte.
+var resultInRange = Rule{
+	Name: "result_range",
+	Check: func(observation Observation, _ time.Time) error {
+		if observation.outOfRange {
+			return fmt.Errorf("result is out of range")
+		}
+		return nil
+	},
+}
+
+// A rule that discards observations with unknown signal colors.
+var signalColor = Rule{
+	Name: "signal_color",
+	Check: func(observation Observation, _ time.Time) error {
+		if !phases.IsValid(observation.Result) {
+			return fmt.Errorf("unknown signal color: %d", observation.Result)
+		}
+		return nil
+	},
+}
+
+// A rule that discards detector observations that are not a percentage.
+var detectorPct = Rule{
+	Name: "detector_pct",
+	Check: func(observation Observation, _ time.Time) error {
+		if observation.Result > 100 {
+			return fmt.Errorf("detector value is not a percentage: %d", observation.Result)
+		}
+		return nil
+	},
 }
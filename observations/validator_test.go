@@ -5,7 +5,18 @@ import (
 	"time"
 )
 
-func TestValidateObservation(t *testing.T) {
+// Check an observation against the rules of a registered layer.
+func checkLayerRules(t *testing.T, observation Observation, dsType string) error {
+	layer, ok := getLayer(dsType)
+	if !ok {
+		t.Errorf("layer %s is not registered", dsType)
+		t.FailNow()
+	}
+	_, err := checkRules(layer, observation, time.Now())
+	return err
+}
+
+func TestCheckRules(t *testing.T) {
 	outdatedObservation := Observation{
 		PhenomenonTime: time.Unix(0, 0),
 	}
@@ -20,13 +31,66 @@ func TestValidateObservation(t *testing.T) {
 	}
 
 	for _, dsType := range timeSensitiveDsTypes {
-		if validateObservation(outdatedObservation, dsType) == nil {
+		if checkLayerRules(t, outdatedObservation, dsType) == nil {
 			t.Errorf("expected validation to error")
 			t.FailNow()
 		}
-		if validateObservation(recentObservation, dsType) != nil {
+		if checkLayerRules(t, recentObservation, dsType) != nil {
 			t.Errorf("unexpected validation error")
 			t.FailNow()
 		}
 	}
 }
+
+func TestCheckRulesResults(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		dsType      string
+		observation Observation
+		valid       bool
+	}{
+		{"primary_signal", Observation{PhenomenonTime: now, Result: 3}, true},
+		{"primary_signal", Observation{PhenomenonTime: now, Result: 42}, false},
+		{"primary_signal", Observation{PhenomenonTime: now, Result: 255, outOfRange: true}, false},
+		{"detector_car", Observation{PhenomenonTime: now, Result: 100}, true},
+		{"detector_car", Observation{PhenomenonTime: now, Result: 180}, false},
+		{"detector_bike", Observation{PhenomenonTime: now, Result: 180}, false},
+		{"signal_program", Observation{PhenomenonTime: time.Unix(0, 0), Result: 12}, true},
+		{"signal_program", Observation{PhenomenonTime: now, Result: 255, outOfRange: true}, false},
+		// The result of cycle second observations is not used.
+		{"cycle_second", Observation{PhenomenonTime: now, Result: 0, outOfRange: true}, true},
+		{"cycle_second", Observation{PhenomenonTime: now.Add(futureTolerance / 2)}, true},
+		{"cycle_second", Observation{PhenomenonTime: now.Add(2 * futureTolerance)}, false},
+	}
+	for _, c := range cases {
+		err := checkLayerRules(t, c.observation, c.dsType)
+		if c.valid && err != nil {
+			t.Errorf("unexpected validation error for %s: %s", c.dsType, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("expected validation of %s with result %d to error", c.dsType, c.observation.Result)
+		}
+	}
+}
+
+func TestCheckRulesReturnsViolatedRule(t *testing.T) {
+	layer, _ := getLayer("primary_signal")
+	rule, err := checkRules(layer, Observation{PhenomenonTime: time.Now(), Result: 42}, time.Now())
+	if err == nil || rule != "signal_color" {
+		t.Errorf("expected the signal_color rule to be violated, got %q", rule)
+		t.FailNow()
+	}
+}
+
+func TestCountRejection(t *testing.T) {
+	countRejection("1337_1", "primary_signal", "signal_color")
+	countRejection("1337_1", "primary_signal", "signal_color")
+	val, ok := ObservationsRejectedByRule.Load(RejectionKey{Layer: "primary_signal", Rule: "signal_color"})
+	if !ok || *val.(*uint64) != 2 {
+		t.Errorf("rejections should be counted per rule")
+	}
+	val, ok = ObservationsRejectedByThing.Load("1337_1")
+	if !ok || *val.(*uint64) != 2 {
+		t.Errorf("rejections should be counted per thing")
+	}
+}
@@ -7,3 +7,13 @@ var Green byte = 3
 var RedAmber byte = 4
 var AmberFlashing byte = 5
 var GreenFlashing byte = 6
+
+// Check if a value is one of the known signal colors.
+func IsValid(color byte) bool {
+	for _, known := range []byte{Dark, Red, Amber, Green, RedAmber, AmberFlashing, GreenFlashing} {
+		if color == known {
+			return true
+		}
+	}
+	return false
+}
@@ -6,64 +6,9 @@ import (
 	"predictor/calc"
 	"predictor/histories"
 	"predictor/observations"
-	"sort"
 	"time"
 )
 
-// The max cluster distance defines how far apart two cycles can be
-// to be considered in the same cluster. Note that with a very
-// high value, two distinct programs will be mixed together. This
-// makes the prediction more robust against noise, but less agile.
-// Thus we need to find a good balance.
-const maxClusterDistance = 20 // Seconds
-
-// An O(n) distance function between two phase arrays.
-func distance(a []byte, b []byte) int {
-	lenA := len(a)
-	lenB := len(b)
-	if lenA == 0 {
-		return lenB
-	}
-	if lenB == 0 {
-		return lenA
-	}
-	var diff = 0
-	for i := 0; i < calc.Min(lenA, lenB); i++ {
-		if a[i] == b[i] {
-			continue
-		}
-		diff++
-	}
-	return diff + calc.Abs(lenA-lenB)
-}
-
-// Cluster a flattened history.
-// Returns the clusters ordered descending by size.
-func cluster(flattened [][]byte) [][][]byte {
-	if len(flattened) == 0 {
-		return [][][]byte{}
-	}
-	clusters := [][][]byte{}
-	for _, colors := range flattened {
-		clustered := false
-		for i, cluster := range clusters {
-			if distance(cluster[0], colors) < maxClusterDistance {
-				clusters[i] = append(cluster, colors)
-				clustered = true
-				break
-			}
-		}
-		if !clustered {
-			clusters = append(clusters, [][]byte{colors})
-		}
-	}
-	// Sort the clusters by size.
-	sort.Slice(clusters, func(i, j int) bool {
-		return len(clusters[i]) > len(clusters[j])
-	})
-	return clusters
-}
-
 // Find the best cluster with respect to a current prediction.
 func best(clustered [][][]byte, current []byte) [][]byte {
 	if len(clustered) == 0 {
@@ -79,7 +24,7 @@ func best(clustered [][][]byte, current []byte) [][]byte {
 		if len(cluster) < 1 {
 			continue // We need at least one row to compare.
 		}
-		clusterDistance := distance(cluster[0], current)
+		clusterDistance := histories.Distance(cluster[0], current)
 		if clusterDistance < bestDistance {
 			bestDistance = clusterDistance
 			bestCluster = cluster
@@ -193,8 +138,15 @@ func flatten(observations []observations.Observation, lower time.Time, upper tim
 // - Load the currently running signal cycle and correlate it with clusters of the history.
 // - Select the best cluster and collapse it to a prediction.
 func predict(thingName string) (Prediction, error) {
+	// Take a consistent snapshot of the program and the primary signal,
+	// so that the history fits the running cycle.
+	snapshot, _ := observations.GetLayersSnapshot(thingName, "primary_signal", "signal_program")
+	var currentProgram *byte
+	if programObservation, err := snapshot.Layers["signal_program"].GetMostRecentObservation(); err == nil {
+		currentProgram = &programObservation.Result
+	}
 	// Find the best fitting history file.
-	history, programId, err := histories.LoadBestFittingHistory(thingName)
+	history, programId, err := histories.LoadBestFittingHistoryForProgram(thingName, currentProgram)
 	if err != nil {
 		return Prediction{}, err
 	}
@@ -212,23 +164,20 @@ func predict(thingName string) (Prediction, error) {
 	}
 	// Get the current primary signal cycle.
 	var runningCycle = []observations.Observation{}
-	primarySignalCycle, err := observations.GetPrimarySignalCycle(thingName)
-	if err == nil {
-		snapshot := primarySignalCycle.MakeSnapshot()
-
-		runningCycle = snapshot.Pending
+	if primarySignal, ok := snapshot.Layers["primary_signal"]; ok {
+		runningCycle = primarySignal.Pending
 		// If the running cycle is empty, use the most recent observation.
 		// This will help us when the signal is not updating its cycle but continously
 		// in the same state. If we only predict based on the empty running cycle,
 		// we won't have a chance of detecting this edge case.
 		if len(runningCycle) == 0 {
-			mostRecent, err := snapshot.GetMostRecentObservation()
+			mostRecent, err := primarySignal.GetMostRecentObservation()
 			if err == nil {
 				runningCycle = []observations.Observation{mostRecent}
 			}
 		}
-		if snapshot.EndTime.After(runningCycleStartTime) { // Could be unix.Epoch if the cycle is not yet complete.
-			runningCycleStartTime = snapshot.EndTime // End time of the completed cycle.
+		if primarySignal.EndTime.After(runningCycleStartTime) { // Could be unix.Epoch if the cycle is not yet complete.
+			runningCycleStartTime = primarySignal.EndTime // End time of the completed cycle.
 		}
 	}
 
@@ -236,15 +185,18 @@ func predict(thingName string) (Prediction, error) {
 	// If we have observations, use them as a basis for the prediction.
 	// Clamp them to the last cycle end time and now, but only if the
 	// time is not too far in the past.
+	// The clock of the traffic light controller may be skewed. Therefore we
+	// compare the observations with the current time on the controller clock.
+	clockOffset := observations.GetClockOffset(thingName)
 	var runningCycleFlat = []byte{}
-	now := time.Now()
+	now := time.Now().Add(-clockOffset)
 	if len(runningCycle) > 0 && now.Sub(runningCycleStartTime) < 300*time.Second {
 		runningCycleFlat = flatten(runningCycle /* between */, runningCycleStartTime /* and */, now)
 	}
 	// Flatten the history into an array of cycles of signal state colors.
 	historyFlattened := history.Flatten()
 	// Cluster the history into clusters of cycles.
-	clustered := cluster(historyFlattened)
+	clustered := histories.Cluster(historyFlattened)
 	// Find the best fitting cluster, for the currently running cycle.
 	bestNow := best(clustered, runningCycleFlat)
 	// Collapse the best fitting clusters into a single prediction.
@@ -269,7 +221,7 @@ func predict(thingName string) (Prediction, error) {
 		Then:             predictionThen,
 		ThenQuality:      qualitiesThen,
 		EvaluatedQuality: predictionQuality,
-		ReferenceTime:    runningCycleStartTime,
+		ReferenceTime:    runningCycleStartTime.Add(clockOffset), // On our clock.
 		ProgramId:        programId,
 	}, nil
 }
@@ -3,9 +3,9 @@ package predictions
 import (
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"predictor/env"
 	"predictor/log"
+	"predictor/session"
 	"sync"
 	"time"
 
@@ -40,6 +40,22 @@ func publish(p Prediction) error {
 	return nil
 }
 
+// Publishes an empty retained message to the prediction MQTT broker.
+// This removes the retained prediction of a thing from the broker
+// and tells subscribed clients that no prediction is available.
+func publishTombstone(thingName string) error {
+	// Acquire the lock.
+	publishLock.Lock()
+	defer publishLock.Unlock()
+
+	topic := fmt.Sprintf("hamburg/%s", thingName)
+	if pub := client.Publish(topic, 2, true, []byte{}); pub.Wait() && pub.Error() != nil {
+		log.Error.Println("Failed to publish tombstone:", pub.Error())
+		return pub.Error()
+	}
+	return nil
+}
+
 func ConnectMQTTClient() {
 	log.Info.Println("Connecting to prediction mqtt broker at :", env.PredictionMqttUrl)
 	opts := mqtt.NewClientOptions()
@@ -56,11 +72,8 @@ func ConnectMQTTClient() {
 	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
 		log.Warning.Println("Connection to prediction mqtt broker lost:", err)
 	})
-	randSource := rand.NewSource(time.Now().UnixNano())
-	random := rand.New(randSource)
-	clientID := fmt.Sprintf("priobike-predictor-%d", random.Int())
+	clientID := session.Configure(opts, "predictions", 0)
 	log.Info.Println("Using client id:", clientID)
-	opts.SetClientID(clientID)
 	opts.SetOrderMatters(false)
 	opts.SetProtocolVersion(4)
 	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
@@ -0,0 +1,14 @@
+package predictions
+
+import "predictor/events"
+
+// A prediction that was published to the prediction MQTT broker.
+type PredictionPublished struct {
+	// The name of the thing.
+	Thing string
+	// The published prediction.
+	Prediction Prediction
+}
+
+// The bus on which published predictions are published.
+var PredictionPublishedBus = events.NewBus[PredictionPublished]("prediction_published")
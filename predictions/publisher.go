@@ -58,6 +58,12 @@ func PublishBestPrediction(thingName string) {
 
 	atomic.AddUint64(&PredictionsChecked, 1)
 
+	// Don't publish predictions for things that stopped sending data.
+	if isStale(thingName, time.Now()) {
+		atomic.AddUint64(&PredictionsDiscarded, 1)
+		return
+	}
+
 	prediction, err := predict(thingName)
 	if err != nil {
 		atomic.AddUint64(&PredictionsDiscarded, 1)
@@ -89,6 +95,8 @@ func PublishBestPrediction(thingName string) {
 
 	Current.Store(prediction.ThingName, prediction)
 	Times.Store(thingName, time.Now())
+	Offline.Delete(thingName)
+	PredictionPublishedBus.Publish(thingName, PredictionPublished{thingName, prediction})
 
 	atomic.AddUint64(&PredictionsPublished, 1)
 	if (PredictionsPublished%1000) == 0 && PredictionsPublished > 0 {
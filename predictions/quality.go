@@ -31,7 +31,7 @@ func calculatePredictionQuality(thingName string) error {
 		return fmt.Errorf("no primary signal observation available")
 	}
 	timeDelay := primarySignalObservation.ReceivedTime.
-		Sub(primarySignalObservation.PhenomenonTime)
+		Sub(primarySignalObservation.PhenomenonTime) - observations.GetClockOffset(thingName)
 
 	// If the time delay is too large (>10min), store -1 as quality.
 	if timeDelay > 10*time.Minute {
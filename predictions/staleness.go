@@ -0,0 +1,93 @@
+package predictions
+
+import (
+	"predictor/env"
+	"predictor/log"
+	"predictor/observations"
+	"predictor/things"
+	"sync"
+	"time"
+)
+
+// The things that are currently marked offline, with the time when they were marked.
+var Offline = &sync.Map{}
+
+// The time when the service was started. Things that never sent
+// any observation are considered silent since this time.
+var startTime = time.Now()
+
+// Interfaces to overwrite for tests.
+var getLastPrimarySignalTime = func(thingName string) (time.Time, bool) {
+	return observations.GetLastReceived(thingName, "primary_signal")
+}
+var publishTombstoneForStaleness = publishTombstone
+
+// Check if a thing didn't send `primary_signal` observations for too long.
+func isStale(thingName string, now time.Time) bool {
+	if env.StaleThingTimeout == 0 {
+		return false
+	}
+	lastReceived, ok := getLastPrimarySignalTime(thingName)
+	if !ok {
+		lastReceived = startTime
+	}
+	return now.Sub(lastReceived) > env.StaleThingTimeout
+}
+
+// Get the time since when a thing is marked offline.
+func GetOfflineSince(thingName string) (time.Time, bool) {
+	t, ok := Offline.Load(thingName)
+	if !ok {
+		return time.Time{}, false
+	}
+	return t.(time.Time), true
+}
+
+// Get the number of things that are currently marked offline.
+func CountOffline() int {
+	var count int
+	Offline.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// Mark a thing offline and withdraw its prediction from the broker.
+func markOffline(thingName string, now time.Time) {
+	// Acquire the corresponding lock to avoid races with a new prediction.
+	lock, _ := predictionLocks.LoadOrStore(thingName, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	if _, ok := Offline.Load(thingName); ok {
+		return
+	}
+	if err := publishTombstoneForStaleness(thingName); err != nil {
+		log.Error.Printf("Could not withdraw prediction for %s: %s", thingName, err)
+		return
+	}
+	Current.Delete(thingName)
+	Times.Delete(thingName)
+	Offline.Store(thingName, now)
+}
+
+// Mark all things offline that stopped sending observations.
+func checkStaleThings() {
+	now := time.Now()
+	things.Things.Range(func(key, value interface{}) bool {
+		thingName := key.(string)
+		if isStale(thingName, now) {
+			markOffline(thingName, now)
+		}
+		return true
+	})
+}
+
+// Check periodically for things that stopped sending observations.
+func CheckStaleThingsPeriodically() {
+	for {
+		time.Sleep(10 * time.Second)
+		checkStaleThings()
+	}
+}
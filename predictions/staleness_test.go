@@ -0,0 +1,135 @@
+package predictions
+
+import (
+	"predictor/env"
+	"predictor/things"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Overwrite the interfaces of the staleness check for a test.
+// Returns the number of published tombstones.
+func mockStaleness(t *testing.T, lastReceived map[string]time.Time) *uint64 {
+	timeout, getLast, publish := env.StaleThingTimeout, getLastPrimarySignalTime, publishTombstoneForStaleness
+	t.Cleanup(func() {
+		env.StaleThingTimeout = timeout
+		getLastPrimarySignalTime = getLast
+		publishTombstoneForStaleness = publish
+	})
+	env.StaleThingTimeout = 5 * time.Minute
+	getLastPrimarySignalTime = func(thingName string) (time.Time, bool) {
+		t, ok := lastReceived[thingName]
+		return t, ok
+	}
+	tombstones := new(uint64)
+	publishTombstoneForStaleness = func(thingName string) error {
+		atomic.AddUint64(tombstones, 1)
+		return nil
+	}
+	return tombstones
+}
+
+func TestIsStale(t *testing.T) {
+	now := time.Now()
+	mockStaleness(t, map[string]time.Time{
+		"1337_fresh": now.Add(-time.Minute),
+		"1337_stale": now.Add(-10 * time.Minute),
+	})
+	if isStale("1337_fresh", now) {
+		t.Errorf("thing with recent observations should not be stale")
+		t.FailNow()
+	}
+	if !isStale("1337_stale", now) {
+		t.Errorf("thing without recent observations should be stale")
+		t.FailNow()
+	}
+	// Things that never sent observations are stale after the timeout since the start.
+	if isStale("1337_silent", startTime.Add(time.Minute)) {
+		t.Errorf("silent thing should not be stale before the timeout")
+		t.FailNow()
+	}
+	if !isStale("1337_silent", startTime.Add(10*time.Minute)) {
+		t.Errorf("silent thing should be stale after the timeout")
+		t.FailNow()
+	}
+	// The check can be disabled.
+	env.StaleThingTimeout = 0
+	if isStale("1337_stale", now) {
+		t.Errorf("no thing should be stale if the check is disabled")
+		t.FailNow()
+	}
+}
+
+func TestMarkOffline(t *testing.T) {
+	tombstones := mockStaleness(t, map[string]time.Time{})
+	t.Cleanup(func() {
+		Current.Delete("1337_offline")
+		Times.Delete("1337_offline")
+		Offline.Delete("1337_offline")
+	})
+	Current.Store("1337_offline", Prediction{ThingName: "1337_offline"})
+	Times.Store("1337_offline", time.Now())
+
+	markedAt := time.Now()
+	markOffline("1337_offline", markedAt)
+	if since, ok := GetOfflineSince("1337_offline"); !ok || !since.Equal(markedAt) {
+		t.Errorf("thing should be marked offline")
+		t.FailNow()
+	}
+	if _, ok := GetCurrentPrediction("1337_offline"); ok {
+		t.Errorf("prediction of an offline thing should be withdrawn")
+		t.FailNow()
+	}
+	if _, ok := GetLastPredictionTime("1337_offline"); ok {
+		t.Errorf("prediction time of an offline thing should be cleared")
+		t.FailNow()
+	}
+
+	// An already offline thing is not withdrawn again.
+	markOffline("1337_offline", markedAt.Add(time.Minute))
+	if since, _ := GetOfflineSince("1337_offline"); !since.Equal(markedAt) {
+		t.Errorf("offline time should not change for an already offline thing")
+		t.FailNow()
+	}
+	if n := atomic.LoadUint64(tombstones); n != 1 {
+		t.Errorf("expected a single tombstone, got %d", n)
+		t.FailNow()
+	}
+}
+
+func TestCheckStaleThings(t *testing.T) {
+	now := time.Now()
+	lastReceived := map[string]time.Time{
+		"1337_check_stale":     now.Add(-10 * time.Minute),
+		"1337_check_recovered": now,
+	}
+	tombstones := mockStaleness(t, lastReceived)
+	for name := range lastReceived {
+		name := name
+		things.Things.Store(name, things.Thing{Name: name})
+		t.Cleanup(func() {
+			things.Things.Delete(name)
+			Offline.Delete(name)
+		})
+	}
+	// The recovered thing was offline before, but sends observations again.
+	Offline.Store("1337_check_recovered", now.Add(-time.Hour))
+
+	checkStaleThings()
+	if _, ok := GetOfflineSince("1337_check_stale"); !ok {
+		t.Errorf("stale thing should be marked offline")
+		t.FailNow()
+	}
+	// The recovered thing is not withdrawn again, since it is not stale.
+	if n := atomic.LoadUint64(tombstones); n != 1 {
+		t.Errorf("expected a tombstone only for the stale thing, got %d", n)
+		t.FailNow()
+	}
+	// Stale things that are already offline are not withdrawn on the next check.
+	checkStaleThings()
+	if n := atomic.LoadUint64(tombstones); n != 1 {
+		t.Errorf("expected no further tombstones, got %d", n)
+		t.FailNow()
+	}
+}
@@ -1,3 +1,3 @@
 set -e
 cp -RT ./static/ $STATIC_PATH
-./main
\ No newline at end of file
+exec ./main
\ No newline at end of file
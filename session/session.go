@@ -0,0 +1,133 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"predictor/env"
+	"predictor/log"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Get the client id for a given role and shard index.
+// With an instance name, the client id is stable between restarts, so that
+// the broker can resume the session. Otherwise, a random client id is used.
+func ClientId(role string, shard int) string {
+	if env.InstanceName == "" {
+		randSource := rand.NewSource(time.Now().UnixNano())
+		random := rand.New(randSource)
+		return fmt.Sprintf("priobike-predictor-%d", random.Int())
+	}
+	return fmt.Sprintf("%s-%s-%d", env.InstanceName, role, shard)
+}
+
+// Check if the clients use persistent sessions.
+func IsPersistent() bool {
+	return env.MqttPersistentSession && env.InstanceName != ""
+}
+
+// Configure the client id and session behavior of an mqtt client.
+// Returns the client id that was set.
+func Configure(opts *mqtt.ClientOptions, role string, shard int) string {
+	clientId := ClientId(role, shard)
+	opts.SetClientID(clientId)
+	if !IsPersistent() {
+		opts.SetCleanSession(true)
+		return clientId
+	}
+	// Keep the session on the broker, so that QoS > 0 messages sent
+	// during a short disconnect are delivered after the reconnect.
+	opts.SetCleanSession(false)
+	opts.SetResumeSubs(true)
+	if env.MqttStorePath != "" {
+		// Persist in-flight messages, so that they survive a restart.
+		opts.SetStore(mqtt.NewFileStore(fmt.Sprintf("%s/%s", env.MqttStorePath, clientId)))
+	}
+	return clientId
+}
+
+// Get the path of the file in which the subscribed topics of a client are recorded.
+// Without a store path, the topics are not recorded.
+func topicsPath(clientId string) string {
+	if env.MqttStorePath == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s.topics.json", env.MqttStorePath, clientId)
+}
+
+// Load the topics that a client subscribed in its previous session.
+// Returns false if the topics were not recorded.
+func LoadTopics(clientId string) ([]string, bool) {
+	path := topicsPath(clientId)
+	if path == "" {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var topics []string
+	if err := json.Unmarshal(data, &topics); err != nil {
+		return nil, false
+	}
+	return topics, true
+}
+
+// Record the topics that a client subscribed, so that they can be compared on the next start.
+func SaveTopics(clientId string, topics []string) error {
+	path := topicsPath(clientId)
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(env.MqttStorePath, os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.Marshal(topics)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Get the topics of the previous session that are no longer subscribed.
+// The broker keeps these subscriptions in a persistent session, so they must be unsubscribed.
+func StaleTopics(previous []string, current []string) []string {
+	subscribed := make(map[string]bool, len(current))
+	for _, topic := range current {
+		subscribed[topic] = true
+	}
+	stale := []string{}
+	for _, topic := range previous {
+		if !subscribed[topic] {
+			stale = append(stale, topic)
+		}
+	}
+	return stale
+}
+
+// Remove the session of a client from the broker by connecting once with a clean session.
+// This is needed if the subscriptions of the previous session are unknown,
+// since they would otherwise be resumed in addition to the new subscriptions.
+func Clear(opts *mqtt.ClientOptions) error {
+	clean := *opts
+	clean.SetCleanSession(true)
+	clean.SetStore(mqtt.NewMemoryStore())
+	clean.SetConnectRetry(false)
+	clean.SetAutoReconnect(false)
+	clean.SetOnConnectHandler(nil)
+	clean.SetConnectionLostHandler(nil)
+	client := mqtt.NewClient(&clean)
+	if conn := client.Connect(); conn.Wait() && conn.Error() != nil {
+		return conn.Error()
+	}
+	client.Disconnect(250)
+	log.Info.Println("Cleared the previous mqtt session of client:", opts.ClientID)
+	return nil
+}
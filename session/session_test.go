@@ -0,0 +1,87 @@
+package session
+
+import (
+	"predictor/env"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestStableClientId(t *testing.T) {
+	env.InstanceName = "predictor-a"
+	defer func() { env.InstanceName = "" }()
+	if ClientId("observations", 2) != "predictor-a-observations-2" {
+		t.Errorf("unexpected client id: %s", ClientId("observations", 2))
+	}
+	if ClientId("observations", 2) != ClientId("observations", 2) {
+		t.Errorf("client id should be stable")
+	}
+	if ClientId("observations", 1) == ClientId("observations", 2) {
+		t.Errorf("client ids of different shards should differ")
+	}
+}
+
+func TestRandomClientIdWithoutInstanceName(t *testing.T) {
+	env.InstanceName = ""
+	env.MqttPersistentSession = true
+	defer func() { env.MqttPersistentSession = false }()
+	if IsPersistent() {
+		t.Errorf("sessions should not be persistent without an instance name")
+	}
+	opts := mqtt.NewClientOptions()
+	Configure(opts, "predictions", 0)
+	if !opts.CleanSession {
+		t.Errorf("random client ids should use clean sessions")
+	}
+}
+
+func TestConfigurePersistentSession(t *testing.T) {
+	env.InstanceName = "predictor-a"
+	env.MqttPersistentSession = true
+	env.MqttStorePath = t.TempDir()
+	defer func() {
+		env.InstanceName = ""
+		env.MqttPersistentSession = false
+		env.MqttStorePath = ""
+	}()
+	opts := mqtt.NewClientOptions()
+	clientId := Configure(opts, "predictions", 0)
+	if opts.ClientID != clientId || clientId != "predictor-a-predictions-0" {
+		t.Errorf("unexpected client id: %s", opts.ClientID)
+	}
+	if opts.CleanSession {
+		t.Errorf("persistent sessions should not be clean")
+	}
+	if !opts.ResumeSubs {
+		t.Errorf("persistent sessions should resume subscriptions")
+	}
+	if _, ok := opts.Store.(*mqtt.FileStore); !ok {
+		t.Errorf("expected a file store")
+	}
+}
+
+func TestTopicsRoundTrip(t *testing.T) {
+	env.MqttStorePath = t.TempDir()
+	defer func() { env.MqttStorePath = "" }()
+	if _, ok := LoadTopics("predictor-a-observations-0"); ok {
+		t.Errorf("topics should not be recorded yet")
+	}
+	if err := SaveTopics("predictor-a-observations-0", []string{"a", "b"}); err != nil {
+		t.Errorf("could not save topics: %s", err)
+		t.FailNow()
+	}
+	topics, ok := LoadTopics("predictor-a-observations-0")
+	if !ok || len(topics) != 2 || topics[1] != "b" {
+		t.Errorf("unexpected topics: %v", topics)
+	}
+	if _, ok := LoadTopics("predictor-a-observations-1"); ok {
+		t.Errorf("topics of other clients should not be recorded")
+	}
+}
+
+func TestStaleTopics(t *testing.T) {
+	stale := StaleTopics([]string{"a", "b", "c"}, []string{"b", "d"})
+	if len(stale) != 2 || stale[0] != "a" || stale[1] != "c" {
+		t.Errorf("unexpected stale topics: %v", stale)
+	}
+}
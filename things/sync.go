@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"predictor/env"
 	"predictor/log"
+	"strings"
 	"sync"
 )
 
@@ -30,31 +31,54 @@ var Crossings = &sync.Map{}
 // A map that contains all datastream MQTT topics to subscribe to, by their type.
 var DatastreamMqttTopics = &sync.Map{}
 
-// A map that points `primary_signal` Datastream MQTT topics to Thing names.
-var PrimarySignalDatastreams = &sync.Map{}
+// A map that points Datastream MQTT topics to Thing names.
+var DatastreamThings = &sync.Map{}
 
-// A map that points `signal_program` Datastream MQTT topics to Thing names.
-var SignalProgramDatastreams = &sync.Map{}
+// The names of the datastream layers that are synced.
+var layerNames = []string{}
 
-// A map that points `cycle_second` Datastream MQTT topics to Thing names.
-var CycleSecondDatastreams = &sync.Map{}
+// Register a datastream layer that should be synced.
+// This is called when a layer is registered for the observation processing.
+func RegisterLayer(name string) {
+	layerNames = append(layerNames, name)
+}
+
+// Unregister a datastream layer, so that it is no longer synced.
+func UnregisterLayer(name string) {
+	for i, layerName := range layerNames {
+		if layerName == name {
+			layerNames = append(layerNames[:i], layerNames[i+1:]...)
+			return
+		}
+	}
+}
 
-// A map that points `detector_car` Datastream MQTT topics to Thing names.
-var CarDetectorDatastreams = &sync.Map{}
+// Check if a datastream layer is registered.
+func isRegisteredLayer(name string) bool {
+	for _, layerName := range layerNames {
+		if layerName == name {
+			return true
+		}
+	}
+	return false
+}
 
-// A map that points `detector_bike` Datastream MQTT topics to Thing names.
-var BikeDetectorDatastreams = &sync.Map{}
+// Build a filter expression that matches any of the registered layers.
+// The prefix is the path to the datastream, e.g. `Datastreams/`.
+func LayerFilter(prefix string) string {
+	conditions := []string{}
+	for _, layerName := range layerNames {
+		conditions = append(conditions, fmt.Sprintf("%sproperties/layerName eq '%s'", prefix, layerName))
+	}
+	return "(" + strings.Join(conditions, " or ") + ")"
+}
 
 func syncThingsPage(page int) (more bool) {
 	elementsPerPage := 100
 	pageUrl := env.SensorThingsBaseUrlThings + "Things?" + url.QueryEscape(
 		"$filter="+
 			"Datastreams/properties/serviceName eq 'HH_STA_traffic_lights' "+
-			"and (Datastreams/properties/layerName eq 'primary_signal' "+
-			"  or Datastreams/properties/layerName eq 'signal_program' "+
-			"  or Datastreams/properties/layerName eq 'cycle_second' "+
-			"  or Datastreams/properties/layerName eq 'detector_car' "+
-			"  or Datastreams/properties/layerName eq 'detector_bike') "+
+			"and "+LayerFilter("Datastreams/")+" "+
 			"and (properties/laneType eq 'Radfahrer' "+
 			"  or properties/laneType eq 'KFZ/Radfahrer' "+
 			"  or properties/laneType eq 'Fußgänger/Radfahrer' "+
@@ -96,23 +120,11 @@ func syncThingsPage(page int) (more bool) {
 		Crossings.Store(t.Properties.TrafficLightsId, cs)
 
 		for _, d := range t.Datastreams {
-			switch d.Properties.LayerName {
-			case "primary_signal":
-				DatastreamMqttTopics.Store(d.MqttTopic(), "primary_signal")
-				PrimarySignalDatastreams.Store(d.MqttTopic(), t.Name)
-			case "signal_program":
-				DatastreamMqttTopics.Store(d.MqttTopic(), "signal_program")
-				SignalProgramDatastreams.Store(d.MqttTopic(), t.Name)
-			case "cycle_second":
-				DatastreamMqttTopics.Store(d.MqttTopic(), "cycle_second")
-				CycleSecondDatastreams.Store(d.MqttTopic(), t.Name)
-			case "detector_car":
-				DatastreamMqttTopics.Store(d.MqttTopic(), "detector_car")
-				CarDetectorDatastreams.Store(d.MqttTopic(), t.Name)
-			case "detector_bike":
-				DatastreamMqttTopics.Store(d.MqttTopic(), "detector_bike")
-				BikeDetectorDatastreams.Store(d.MqttTopic(), t.Name)
+			if !isRegisteredLayer(d.Properties.LayerName) {
+				continue
 			}
+			DatastreamMqttTopics.Store(d.MqttTopic(), d.Properties.LayerName)
+			DatastreamThings.Store(d.MqttTopic(), t.Name)
 		}
 	}
 